@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/yaanst/W2P/config"
+	"github.com/yaanst/W2P/control"
+	"github.com/yaanst/W2P/utils"
+)
+
+// command is a subcommand of the CLI managing a running node through its
+// control API
+type command struct {
+	args  string
+	usage string
+	run   func(fs *flag.FlagSet, args []string)
+}
+
+// commands are the subcommands by name, W2P starting a node without one
+var commands = map[string]*command{
+	"publish": {"<dir>", "Copy a folder in the websites of the node and share it", publish},
+	"update":  {"<name>", "Publish a new version of a website owned or delegated", update},
+	"list":    {"", "List the known websites", list},
+	"search":  {"<keywords>", "Search the websites matching keywords", search},
+	"fetch":   {"<name>", "Retrieve a website from its seeders", fetch},
+	"peers":   {"", "List the known peers", peers},
+}
+
+// runCommand parses the flags of a subcommand, wherever they are among its
+// arguments, and runs it
+func runCommand(name string, args []string) {
+	cmd := commands[name]
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: W2P %v [flags] %v\n%v\n", name, cmd.args, cmd.usage)
+		fs.PrintDefaults()
+	}
+	cmd.run(fs, args)
+}
+
+// parseArgs parses the flags of fs mixed with the positional arguments and
+// returns the latter
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// connect registers the settings of the node in fs, parses args and returns
+// the positional arguments with a client of the node's control API, exiting
+// if there are not nArgs of them or the token of the node cannot be read
+func connect(fs *flag.FlagSet, args []string, nArgs int) ([]string, *control.Client) {
+	configPath := fs.String("config", "", "JSON config file of the node")
+	config.Flags(fs, "uiPort", "datadir", "tokenFile")
+	positional := parseArgs(fs, args)
+	if len(positional) != nArgs {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*configPath, fs)
+	utils.CheckError(err)
+	cfg.Apply()
+
+	// the token is in the data directory of the node
+	token, err := control.LoadToken(utils.TokenFile)
+	if err != nil {
+		log.Fatal("Cannot read the token of the node, check that it runs with the same -datadir: " + err.Error())
+	}
+
+	return positional, control.NewClient("127.0.0.1:"+cfg.UIPort, token)
+}
+
+// publish shares a folder as a new website
+func publish(fs *flag.FlagSet, args []string) {
+	name := fs.String("name", "", "Name of the website (default the name of the folder)")
+	keywords := fs.String("keywords", "", "Comma-separated keywords of the website")
+	algorithm := fs.String("algorithm", "", "Algorithm of the website's key (default ed25519)")
+	positional, client := connect(fs, args, 1)
+
+	dir, err := filepath.Abs(positional[0])
+	utils.CheckError(err)
+	if *name == "" {
+		*name = filepath.Base(dir)
+	}
+
+	passphrase := utils.ReadPassphrase("Passphrase of the website's key: ")
+	_, err = client.Publish(&control.PublishRequest{
+		Name:       *name,
+		Dir:        dir,
+		Keywords:   splitKeywords(*keywords),
+		Algorithm:  *algorithm,
+		Passphrase: string(passphrase),
+	})
+	utils.CheckError(err)
+
+	fmt.Println("Published website '" + *name + "'")
+}
+
+// update publishes a new version of a website
+func update(fs *flag.FlagSet, args []string) {
+	dir := fs.String("dir", "", "Folder with the new contents of the website (default the current ones)")
+	keywords := fs.String("keywords", "", "Comma-separated keywords of the website (default the current ones)")
+	positional, client := connect(fs, args, 1)
+	name := positional[0]
+
+	if *dir != "" {
+		abs, err := filepath.Abs(*dir)
+		utils.CheckError(err)
+		*dir = abs
+	}
+
+	passphrase := utils.ReadPassphrase("Passphrase of the website's key: ")
+	site, err := client.Update(name, &control.UpdateRequest{
+		Dir:      *dir,
+		Keywords: splitKeywords(*keywords),
+	}, passphrase)
+	utils.CheckError(err)
+
+	fmt.Printf("Updated website '%v' to version %v\n", name, site.Version)
+}
+
+// list prints the known websites
+func list(fs *flag.FlagSet, args []string) {
+	_, client := connect(fs, args, 0)
+
+	sites, err := client.Sites()
+	utils.CheckError(err)
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Name < sites[j].Name })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVERSION\tSEEDERS\tOWNED\tKEYWORDS")
+	for _, site := range sites {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", site.Name, site.Version, site.Seeders,
+			site.Owned, strings.Join(site.Keywords, ","))
+	}
+	w.Flush()
+}
+
+// search prints the names of the websites matching keywords
+func search(fs *flag.FlagSet, args []string) {
+	positional, client := connect(fs, args, 1)
+
+	sites, err := client.Search(positional[0])
+	utils.CheckError(err)
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Name < sites[j].Name })
+
+	for _, site := range sites {
+		fmt.Println(site.Name)
+	}
+}
+
+// fetch retrieves a website and prints where to browse it
+func fetch(fs *flag.FlagSet, args []string) {
+	positional, client := connect(fs, args, 1)
+	name := positional[0]
+
+	_, err := client.Fetch(name)
+	utils.CheckError(err)
+
+	fmt.Println("Fetched website '" + name + "', browse it at " + client.URL + "/w/" + name + "/")
+}
+
+// peers prints the known peers
+func peers(fs *flag.FlagSet, args []string) {
+	_, client := connect(fs, args, 0)
+
+	peers, err := client.Peers()
+	utils.CheckError(err)
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Score > peers[j].Score })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tID\tSTATE\tSCORE\tREPUTATION")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "%v\t%.16v\t%v\t%.2f\t%.2f\n", peer.Addr, peer.ID, peer.State,
+			peer.Score, peer.Reputation)
+	}
+	w.Flush()
+}
+
+// splitKeywords splits comma-separated keywords, none giving an empty list
+func splitKeywords(keywords string) []string {
+	if keywords == "" {
+		return nil
+	}
+	return strings.Split(keywords, ",")
+}
+
+// usage prints the usage of the node and of the subcommands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: W2P [flags]\n       W2P <command> [flags] [args]\n\nCommands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-8v %v\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(out, "\nFlags of the node:")
+	flag.PrintDefaults()
+}
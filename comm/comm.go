@@ -3,8 +3,8 @@ package comm
 import (
 	"bytes"
 	"encoding/gob"
-	"log"
 	"net"
+	"sync"
 
 	"github.com/yaanst/W2P/structs"
 )
@@ -19,6 +19,21 @@ type Message struct {
 	Dest *structs.Peer
 	Meta *Meta
 	Data *Data
+	Nat  *Nat
+	Pex  *Pex
+
+	// Probe asks Dest to check whether this peer is alive for Orig, Alive is
+	// in the answer
+	Probe *structs.Peer
+	Alive bool
+
+	// RequestID identifies a request, its answer (marked by Reply) having the
+	// same RequestID
+	RequestID uint64
+	Reply     bool
+
+	// envelope is the signed envelope a received message came in
+	envelope *Envelope
 }
 
 // Data are the messages containing binary data for file exchange
@@ -33,10 +48,60 @@ type Meta struct {
 	WebsiteMap *structs.WebsiteMap
 }
 
+// Nat are the messages used to reach nodes behind a NAT
+type Nat struct {
+	// Register asks Dest to relay traffic for Orig, Accepted is in the answer
+	Register bool
+	Answer   bool
+	Accepted bool
+
+	// Introduce asks a common peer to introduce Orig to a peer behind a NAT,
+	// Introduction is the public address of the peer to punch a path to
+	Introduce    *structs.Peer
+	Introduction *structs.Peer
+
+	// Punch is sent to open a path through NATs, it needs no answer
+	Punch bool
+}
+
+// Pex are the messages used to exchange samples of known live peers, the
+// answer carrying a sample of the peers of Dest
+type Pex struct {
+	Peers []*structs.Peer
+}
+
+// Announce is multicast on the local network by nodes looking for peers,
+// Addr being the address of the node, with an unspecified IP if it listens
+// on all of them
+type Announce struct {
+	Network string
+	ID      string
+	Addr    string
+}
+
+// Requests is the table of the requests of a node waiting for their answer
+type Requests struct {
+	mux     sync.Mutex
+	pending map[uint64]*pendingRequest
+}
+
+// pendingRequest is a request waiting for the answer of dest
+type pendingRequest struct {
+	dest   *structs.Peer
+	answer chan *Message
+}
+
 // ----------------
 // - Constructors -
 // ----------------
 
+// NewRequests constructs an empty table of requests
+func NewRequests() *Requests {
+	return &Requests{
+		pending: make(map[uint64]*pendingRequest),
+	}
+}
+
 // NewDataRequest construct a data request for a piece in a specific website
 func NewDataRequest(orig, dest *structs.Peer, website, piece string) *Message {
 	data := &Data{
@@ -60,9 +125,11 @@ func NewDataReply(request *Message, data []byte) *Message {
 	}
 
 	return &Message{
-		Orig: request.Dest,
-		Dest: request.Orig,
-		Data: dataMessage,
+		Orig:      request.Dest,
+		Dest:      request.Orig,
+		Data:      dataMessage,
+		RequestID: request.RequestID,
+		Reply:     true,
 	}
 }
 
@@ -80,6 +147,63 @@ func NewMeta(orig, dest *structs.Peer, wm *structs.WebsiteMap) *Message {
 	}
 }
 
+// NewRegister construct a request to be relayed by dest
+func NewRegister(orig, dest *structs.Peer) *Message {
+	return &Message{
+		Orig: orig,
+		Dest: dest,
+		Nat: &Nat{
+			Register: true,
+		},
+	}
+}
+
+// NewRegisterAnswer construct the answer to a request to be relayed
+func NewRegisterAnswer(request *Message, orig *structs.Peer, accepted bool) *Message {
+	return &Message{
+		Orig: orig,
+		Dest: request.Orig,
+		Nat: &Nat{
+			Register: true,
+			Answer:   true,
+			Accepted: accepted,
+		},
+	}
+}
+
+// NewIntroduce construct a request to dest to be introduced to peer
+func NewIntroduce(orig, dest, peer *structs.Peer) *Message {
+	return &Message{
+		Orig: orig,
+		Dest: dest,
+		Nat: &Nat{
+			Introduce: peer,
+		},
+	}
+}
+
+// NewIntroduction construct the introduction of peer to dest
+func NewIntroduction(orig, dest, peer *structs.Peer) *Message {
+	return &Message{
+		Orig: orig,
+		Dest: dest,
+		Nat: &Nat{
+			Introduction: peer,
+		},
+	}
+}
+
+// NewPunch construct a message opening a path through NATs
+func NewPunch(orig, dest *structs.Peer) *Message {
+	return &Message{
+		Orig: orig,
+		Dest: dest,
+		Nat: &Nat{
+			Punch: true,
+		},
+	}
+}
+
 // NewHeartbeat construct a simple heartbeat message
 func NewHeartbeat(orig, dest *structs.Peer) *Message {
 	return &Message{
@@ -88,33 +212,168 @@ func NewHeartbeat(orig, dest *structs.Peer) *Message {
 	}
 }
 
+// NewHeartbeatReply construct the answer to a heartbeat
+func NewHeartbeatReply(request *Message, orig *structs.Peer) *Message {
+	return &Message{
+		Orig:      orig,
+		Dest:      request.Orig,
+		RequestID: request.RequestID,
+		Reply:     true,
+	}
+}
+
+// NewPex construct a peer exchange request sharing peers with dest
+func NewPex(orig, dest *structs.Peer, peers []*structs.Peer) *Message {
+	return &Message{
+		Orig: orig,
+		Dest: dest,
+		Pex: &Pex{
+			Peers: peers,
+		},
+	}
+}
+
+// NewPexReply construct the answer to a peer exchange request
+func NewPexReply(request *Message, orig *structs.Peer, peers []*structs.Peer) *Message {
+	return &Message{
+		Orig: orig,
+		Dest: request.Orig,
+		Pex: &Pex{
+			Peers: peers,
+		},
+		RequestID: request.RequestID,
+		Reply:     true,
+	}
+}
+
+// NewProbe construct a request to dest to probe peer on behalf of orig
+func NewProbe(orig, dest, peer *structs.Peer) *Message {
+	return &Message{
+		Orig:  orig,
+		Dest:  dest,
+		Probe: peer,
+	}
+}
+
+// NewProbeReply construct the answer to a request to probe a peer
+func NewProbeReply(request *Message, orig *structs.Peer, alive bool) *Message {
+	return &Message{
+		Orig:      orig,
+		Dest:      request.Orig,
+		Probe:     request.Probe,
+		Alive:     alive,
+		RequestID: request.RequestID,
+		Reply:     true,
+	}
+}
+
 // -----------
 // - Methods -
 // -----------
 
-// Send sends a message to the Peer at dest (dest is NOT final destination)
-func (m *Message) Send(conn *net.UDPConn, peer *structs.Peer) {
-	b := EncodeMessage(m)
+// Send signs and encrypts a message within the session and sends it to the
+// Peer at addr (addr is NOT final destination) using conn
+func (m *Message) Send(conn *net.UDPConn, sessions *Sessions, session *Session, addr *structs.Peer) error {
+	envelope, err := sessions.Seal(m)
+	if err != nil {
+		return err
+	}
+
+	packet, err := session.Encrypt(envelope)
+	if err != nil {
+		return err
+	}
+
+	return SendPacket(conn, packet, addr)
+}
+
+// Requests
+
+// Add registers a request to dest, returning its RequestID and the channel on
+// which its answer will be delivered
+func (r *Requests) Add(dest *structs.Peer) (uint64, chan *Message) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	id := randomID()
+	for r.pending[id] != nil {
+		id = randomID()
+	}
+	answer := make(chan *Message, 1)
+	r.pending[id] = &pendingRequest{
+		dest:   dest,
+		answer: answer,
+	}
+	return id, answer
+}
 
-	dest := net.UDPAddr(*peer)
-	conn.WriteToUDP(b, &dest)
+// Remove forgets a request, answered or not
+func (r *Requests) Remove(id uint64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	delete(r.pending, id)
+}
+
+// Deliver hands an answer to the request waiting for it, it returns false if
+// no request from this peer waits for it
+func (r *Requests) Deliver(m *Message) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	// a peer known by its address only can answer from any address
+	p := r.pending[m.RequestID]
+	if p == nil || (p.dest.ID != "" && p.dest.ID != m.Orig.ID) {
+		return false
+	}
+	delete(r.pending, m.RequestID)
+	p.answer <- m
+	return true
+}
+
+// SendPacket sends a Packet to the Peer at addr using conn
+func SendPacket(conn *net.UDPConn, packet *Packet, addr *structs.Peer) error {
+	b, err := EncodePacket(packet)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.WriteToUDP(b, addr.Addr)
+	return err
+}
+
+// EncodeAnnounce serializes an Announce in order to multicast it
+func EncodeAnnounce(a *Announce) ([]byte, error) {
+	b := bytes.Buffer{}
+	e := gob.NewEncoder(&b)
+
+	err := e.Encode(a)
+	return b.Bytes(), err
+}
+
+// DecodeAnnounce deserializes a received Announce
+func DecodeAnnounce(b []byte) (*Announce, error) {
+	a := &Announce{}
+
+	bb := bytes.Buffer{}
+	bb.Write(b)
+
+	d := gob.NewDecoder(&bb)
+
+	err := d.Decode(a)
+	return a, err
 }
 
 // EncodeMessage serializes a Message in order to send it
-func EncodeMessage(m *Message) []byte {
+func EncodeMessage(m *Message) ([]byte, error) {
 	b := bytes.Buffer{}
 	e := gob.NewEncoder(&b)
 
 	err := e.Encode(m)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return b.Bytes()
+	return b.Bytes(), err
 }
 
 // DecodeMessage deserializes a Message in order to receive it
-func DecodeMessage(b []byte) *Message {
+func DecodeMessage(b []byte) (*Message, error) {
 	m := &Message{}
 
 	bb := bytes.Buffer{}
@@ -123,9 +382,5 @@ func DecodeMessage(b []byte) *Message {
 	d := gob.NewDecoder(&bb)
 
 	err := d.Decode(m)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return m
+	return m, err
 }
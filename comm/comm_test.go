@@ -0,0 +1,167 @@
+package comm
+
+import (
+	"testing"
+
+	"github.com/yaanst/W2P/structs"
+)
+
+// -----------
+// - Helpers -
+// -----------
+
+// exchange sends m from a to b within a new session and returns the Message
+// opened by b
+func exchange(t *testing.T, m *Message) *Message {
+	t.Helper()
+	a, b := newTestNode(t, 5001), newTestNode(t, 5002)
+	aSession, _, err := connect(t, a, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Orig, m.Dest = a.peer, b.peer
+	received, _, err := b.sessions.Open(seal(t, a, aSession, m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return received
+}
+
+// ---------
+// - Tests -
+// ---------
+
+func TestNatMessages(t *testing.T) {
+	relay := structs.ParsePeer("10.0.0.9:5000")
+	relay.ID = "relay"
+	peer := structs.ParsePeer("203.0.113.7:40000")
+	peer.ID = "peer"
+	peer.Relay = relay
+	request := NewRegister(nil, nil)
+	request.RequestID = 7
+
+	tests := []struct {
+		name    string
+		message *Message
+		want    Nat
+	}{
+		{"register", NewRegister(nil, nil), Nat{Register: true}},
+		{"accepted", NewRegisterAnswer(request, nil, true), Nat{Register: true, Answer: true, Accepted: true}},
+		{"refused", NewRegisterAnswer(request, nil, false), Nat{Register: true, Answer: true}},
+		{"introduce", NewIntroduce(nil, nil, peer), Nat{Introduce: peer}},
+		{"introduction", NewIntroduction(nil, nil, peer), Nat{Introduction: peer}},
+		{"punch", NewPunch(nil, nil), Nat{Punch: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nat := exchange(t, test.message).Nat
+			if nat == nil {
+				t.Fatal("Nat not received")
+			}
+			if nat.Register != test.want.Register || nat.Answer != test.want.Answer ||
+				nat.Accepted != test.want.Accepted || nat.Punch != test.want.Punch {
+				t.Errorf("Nat = %+v, want %+v", nat, test.want)
+			}
+
+			// the peer to reach is received with its relay
+			for _, p := range [][2]*structs.Peer{{nat.Introduce, test.want.Introduce}, {nat.Introduction, test.want.Introduction}} {
+				if (p[0] == nil) != (p[1] == nil) {
+					t.Fatalf("peer = %v, want %v", p[0], p[1])
+				}
+				if p[0] != nil && (p[0].Key() != "peer" || p[0].String() != peer.String() ||
+					p[0].Relay == nil || p[0].Relay.Key() != "relay") {
+					t.Errorf("peer = %+v, want %+v", p[0], peer)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestsDeliver(t *testing.T) {
+	known := structs.ParsePeer("10.0.0.1:5000")
+	known.ID = "known"
+	addrOnly := structs.ParsePeer("10.0.0.2:5000")
+	other := structs.ParsePeer("10.0.0.3:5000")
+	other.ID = "other"
+
+	tests := []struct {
+		name      string
+		dest      *structs.Peer
+		from      *structs.Peer
+		requestID func(id uint64) uint64
+		removed   bool
+		delivered []bool
+	}{
+		{"answer of the peer", known, known, nil, false, []bool{true}},
+		{"answer of another peer", known, other, nil, false, []bool{false}},
+		{"peer known by address only", addrOnly, other, nil, false, []bool{true}},
+		{"unknown request", known, known, func(id uint64) uint64 { return id + 1 }, false, []bool{false}},
+		{"removed request", known, known, nil, true, []bool{false}},
+		{"answered twice", known, known, nil, false, []bool{true, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := NewRequests()
+			id, answer := requests.Add(test.dest)
+			if test.removed {
+				requests.Remove(id)
+			}
+			if test.requestID != nil {
+				id = test.requestID(id)
+			}
+
+			for i, want := range test.delivered {
+				reply := NewHeartbeatReply(&Message{Orig: test.dest, RequestID: id}, test.from)
+				if got := requests.Deliver(reply); got != want {
+					t.Errorf("answer %v: Deliver() = %v, want %v", i, got, want)
+				}
+			}
+			select {
+			case <-answer:
+				if !test.delivered[0] {
+					t.Error("answer received by the wrong request")
+				}
+			default:
+				if test.delivered[0] {
+					t.Error("answer not received")
+				}
+			}
+		})
+	}
+}
+
+func TestPexMessages(t *testing.T) {
+	peer := structs.ParsePeer("[2001:db8::1]:5000")
+	peer.ID = "peer"
+	request := NewPex(nil, nil, []*structs.Peer{peer})
+	request.RequestID = 7
+
+	tests := []struct {
+		name    string
+		message *Message
+		reply   bool
+		peers   int
+	}{
+		{"request", NewPex(nil, nil, []*structs.Peer{peer}), false, 1},
+		{"reply", NewPexReply(request, nil, []*structs.Peer{peer}), true, 1},
+		{"empty reply", NewPexReply(request, nil, nil), true, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := exchange(t, test.message)
+			if m.Pex == nil || len(m.Pex.Peers) != test.peers || m.Reply != test.reply {
+				t.Fatalf("message = %+v", m)
+			}
+			if test.reply && m.RequestID != request.RequestID {
+				t.Errorf("RequestID = %v, want %v", m.RequestID, request.RequestID)
+			}
+			if test.peers > 0 && (m.Pex.Peers[0].Key() != "peer" || m.Pex.Peers[0].String() != peer.String()) {
+				t.Errorf("peer = %v, want %v", m.Pex.Peers[0], peer)
+			}
+		})
+	}
+}
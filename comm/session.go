@@ -0,0 +1,630 @@
+package comm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yaanst/W2P/structs"
+	"github.com/yaanst/W2P/w2pcrypto"
+)
+
+// -----------
+// - Structs -
+// -----------
+
+// Packet is what is actually sent in an UDP datagram: either one of the two
+// handshake messages or a Message encrypted within a Session
+type Packet struct {
+	Init *HandshakeInit
+	Resp *HandshakeResp
+
+	// Session is the id of the Session at the receiver's side
+	Session uint64
+	Counter uint64
+	Data    []byte
+}
+
+// HandshakeInit is sent by a node to open a Session with a peer, Static being
+// the node's identity key and Ephemeral a fresh X25519 public key. Timestamp
+// (unix time in nanoseconds) and Responder, the ID of the peer if the node
+// knows it, keep the HandshakeInit from being replayed
+type HandshakeInit struct {
+	InitID    uint64
+	Static    *w2pcrypto.PublicKey
+	Ephemeral []byte
+	Timestamp int64
+	Responder string
+	Signature string
+}
+
+// HandshakeResp is the answer of the peer to a HandshakeInit
+type HandshakeResp struct {
+	InitID    uint64
+	RespID    uint64
+	Static    *w2pcrypto.PublicKey
+	Ephemeral []byte
+	Signature string
+}
+
+// Envelope is the plaintext of an encrypted Packet: an encoded Message signed
+// by the identity key of its origin so it stays authenticated when forwarded
+type Envelope struct {
+	Body      []byte
+	OrigKey   *w2pcrypto.PublicKey
+	Signature string
+}
+
+// Session is an authenticated and encrypted channel with a peer
+type Session struct {
+	ID       uint64
+	RemoteID uint64
+	PeerKey  *w2pcrypto.PublicKey
+	Addr     *structs.Peer
+
+	mux     sync.Mutex
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	counter uint64
+	highest uint64
+	window  uint64
+
+	// last is when a packet was last received in the Session
+	last time.Time
+}
+
+// Sessions holds the Sessions of a node, indexed by local id and by the
+// address of the peer, and the handshakes in progress
+type Sessions struct {
+	mux      sync.RWMutex
+	Identity *w2pcrypto.PrivateKey
+	ByID     map[uint64]*Session
+	ByAddr   map[string]*Session
+	pending  map[uint64]*pendingHandshake
+	dialing  map[string]chan struct{}
+
+	// inits holds the Timestamp of the last HandshakeInit accepted from each
+	// identity, by ID, for initMaxAge
+	inits map[string]int64
+}
+
+// pendingHandshake is a handshake initiated by this node waiting for its
+// HandshakeResp
+type pendingHandshake struct {
+	addr      *structs.Peer
+	ephemeral *ecdh.PrivateKey
+	init      *HandshakeInit
+	done      chan *Session
+}
+
+// replayWindow is the number of out of order counters accepted by a Session
+const replayWindow uint64 = 64
+
+// initMaxAge is the difference between the Timestamp of a HandshakeInit and
+// the time it is received above which it is refused
+const initMaxAge time.Duration = 2 * time.Minute
+
+// ----------------
+// - Constructors -
+// ----------------
+
+// NewSessions constructs the Sessions of a node with the given identity key
+func NewSessions(identity *w2pcrypto.PrivateKey) *Sessions {
+	return &Sessions{
+		Identity: identity,
+		ByID:     make(map[uint64]*Session),
+		ByAddr:   make(map[string]*Session),
+		pending:  make(map[uint64]*pendingHandshake),
+		dialing:  make(map[string]chan struct{}),
+		inits:    make(map[string]int64),
+	}
+}
+
+// -----------
+// - Methods -
+// -----------
+
+// randomID returns a random non-zero session id
+func randomID() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		id := binary.BigEndian.Uint64(b[:])
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+// initMessage returns the message signed by the initiator of a handshake
+func initMessage(init *HandshakeInit) []byte {
+	return []byte("w2p-init|" + strconv.FormatUint(init.InitID, 10) + "|" +
+		strconv.FormatInt(init.Timestamp, 10) + "|" + init.Responder + "|" + string(init.Ephemeral))
+}
+
+// respMessage returns the message signed by the responder of a handshake, it
+// covers the whole transcript
+func respMessage(init *HandshakeInit, resp *HandshakeResp) []byte {
+	return []byte("w2p-resp|" + strconv.FormatUint(resp.InitID, 10) + "|" +
+		strconv.FormatUint(resp.RespID, 10) + "|" + init.Static.String() + "|" +
+		string(init.Ephemeral) + "|" + string(resp.Ephemeral))
+}
+
+// deriveCiphers derives the two directional AES-256-GCM ciphers of a Session
+// from the shared secret, the first one being used by the initiator to send
+func deriveCiphers(shared []byte, init *HandshakeInit, resp *HandshakeResp) (cipher.AEAD, cipher.AEAD, error) {
+	salt := append(append([]byte{}, init.Ephemeral...), resp.Ephemeral...)
+	keys, err := hkdf.Key(sha256.New, shared, salt, "w2p-session", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	i2r, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	r2i, err := aes.NewCipher(keys[32:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	i2rGCM, err := cipher.NewGCM(i2r)
+	if err != nil {
+		return nil, nil, err
+	}
+	r2iGCM, err := cipher.NewGCM(r2i)
+	if err != nil {
+		return nil, nil, err
+	}
+	return i2rGCM, r2iGCM, nil
+}
+
+// Sessions
+
+// Get returns the Session with the peer at addr or nil if there is none
+func (s *Sessions) Get(addr *structs.Peer) *Session {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.ByAddr[addr.String()]
+}
+
+// Remove forgets all the Sessions with peer, found by its ID or its address
+func (s *Sessions) Remove(peer *structs.Peer) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, session := range s.ByID {
+		if (peer.ID != "" && session.PeerKey.ID() == peer.ID) || session.Addr.String() == peer.String() {
+			s.remove(session)
+		}
+	}
+	delete(s.ByAddr, peer.String())
+}
+
+// add stores an established Session, which becomes the one used to send to
+// its peer. Previous Sessions with the peer are kept to receive as both sides
+// may have initiated a handshake at the same time
+func (s *Sessions) add(session *Session) {
+	session.last = time.Now()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.ByID[session.ID] = session
+	s.ByAddr[session.Addr.String()] = session
+}
+
+// remove forgets a Session, s.mux being held
+func (s *Sessions) remove(session *Session) {
+	delete(s.ByID, session.ID)
+	if s.ByAddr[session.Addr.String()] == session {
+		delete(s.ByAddr, session.Addr.String())
+	}
+}
+
+// Expire removes the Sessions in which nothing was received for idle, and
+// returns them
+func (s *Sessions) Expire(idle time.Duration) []*Session {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var expired []*Session
+	for _, session := range s.ByID {
+		if time.Since(session.lastSeen()) > idle {
+			s.remove(session)
+			expired = append(expired, session)
+		}
+	}
+	return expired
+}
+
+// Bound keeps at most max Sessions, evicting the ones of the peers with the
+// lowest score, the least recently active first, except the ones of the peers
+// to keep. It returns the evicted Sessions
+func (s *Sessions) Bound(max int, score func(*structs.Peer) float64, keep func(*structs.Peer) bool) []*Session {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var removed []*Session
+	for len(s.ByID) > max {
+		var worst *Session
+		worstScore := 0.0
+		for _, session := range s.ByID {
+			peer := session.Peer()
+			if keep(peer) {
+				continue
+			}
+			sc := score(peer)
+			if worst == nil || sc < worstScore ||
+				(sc == worstScore && session.lastSeen().Before(worst.lastSeen())) {
+				worst = session
+				worstScore = sc
+			}
+		}
+		if worst == nil {
+			break
+		}
+		s.remove(worst)
+		removed = append(removed, worst)
+	}
+	return removed
+}
+
+// Dial returns the Session with the peer at addr, doing the handshake with
+// the given send function if needed and waiting at most timeout for it
+func (s *Sessions) Dial(addr *structs.Peer, send func(*Packet), timeout time.Duration) (*Session, error) {
+	for {
+		if session := s.Get(addr); session != nil {
+			return session, nil
+		}
+
+		// only one handshake at a time with a peer, others wait for it
+		s.mux.Lock()
+		wait, dialing := s.dialing[addr.String()]
+		if !dialing {
+			s.dialing[addr.String()] = make(chan struct{})
+		}
+		s.mux.Unlock()
+
+		if dialing {
+			select {
+			case <-wait:
+				continue
+			case <-time.After(timeout):
+				return nil, errors.New("handshake timeout with " + addr.String())
+			}
+		}
+
+		session, err := s.handshake(addr, send, timeout)
+
+		s.mux.Lock()
+		close(s.dialing[addr.String()])
+		delete(s.dialing, addr.String())
+		s.mux.Unlock()
+
+		return session, err
+	}
+}
+
+// handshake sends a HandshakeInit to the peer at addr and waits for the
+// Session to be established by HandleResp
+func (s *Sessions) handshake(addr *structs.Peer, send func(*Packet), timeout time.Duration) (*Session, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	init := &HandshakeInit{
+		InitID:    randomID(),
+		Static:    s.Identity.Public(),
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Timestamp: time.Now().UnixNano(),
+		Responder: addr.ID,
+	}
+	init.Signature = s.Identity.SignMessage(initMessage(init))
+
+	p := &pendingHandshake{
+		addr:      addr,
+		ephemeral: ephemeral,
+		init:      init,
+		done:      make(chan *Session, 1),
+	}
+	s.mux.Lock()
+	s.pending[init.InitID] = p
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		delete(s.pending, init.InitID)
+		s.mux.Unlock()
+	}()
+
+	send(&Packet{Init: init})
+
+	select {
+	case session := <-p.done:
+		return session, nil
+	case <-time.After(timeout):
+		return nil, errors.New("handshake timeout with " + addr.String())
+	}
+}
+
+// HandleInit answers a HandshakeInit received from the peer at addr and
+// establishes the Session on the responder's side. A HandshakeInit meant for
+// another node, too old or not newer than the last one of its identity is
+// refused, like a replayed one
+func (s *Sessions) HandleInit(init *HandshakeInit, addr *structs.Peer) (*Packet, error) {
+	if init.Static == nil || !init.Static.VerifyAlgorithm(w2pcrypto.AlgEd25519, initMessage(init), init.Signature) {
+		return nil, errors.New("invalid handshake from " + addr.String())
+	}
+	if init.Responder != "" && init.Responder != s.Identity.Public().ID() {
+		return nil, errors.New("handshake from " + addr.String() + " meant for another node")
+	}
+	if !s.freshInit(init) {
+		return nil, errors.New("stale or replayed handshake from " + addr.String())
+	}
+
+	peerEphemeral, err := ecdh.X25519().NewPublicKey(init.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &HandshakeResp{
+		InitID:    init.InitID,
+		RespID:    randomID(),
+		Static:    s.Identity.Public(),
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+	}
+	resp.Signature = s.Identity.SignMessage(respMessage(init, resp))
+
+	i2r, r2i, err := deriveCiphers(shared, init, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	s.add(&Session{
+		ID:       resp.RespID,
+		RemoteID: init.InitID,
+		PeerKey:  init.Static,
+		Addr:     addr,
+		send:     r2i,
+		recv:     i2r,
+	})
+
+	return &Packet{Resp: resp}, nil
+}
+
+// freshInit checks that a HandshakeInit is recent and newer than the last one
+// accepted from its identity, which it then becomes
+func (s *Sessions) freshInit(init *HandshakeInit) bool {
+	now := time.Now()
+	if d := now.Sub(time.Unix(0, init.Timestamp)); d > initMaxAge || d < -initMaxAge {
+		return false
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	id := init.Static.ID()
+	if last, ok := s.inits[id]; ok && init.Timestamp <= last {
+		return false
+	}
+	s.inits[id] = init.Timestamp
+
+	// older timestamps are refused anyway
+	for key, last := range s.inits {
+		if now.Sub(time.Unix(0, last)) > initMaxAge {
+			delete(s.inits, key)
+		}
+	}
+	return true
+}
+
+// HandleResp completes a handshake initiated by this node
+func (s *Sessions) HandleResp(resp *HandshakeResp) error {
+	s.mux.RLock()
+	p := s.pending[resp.InitID]
+	s.mux.RUnlock()
+	if p == nil {
+		return errors.New("unexpected handshake response")
+	}
+
+	if resp.Static == nil || !resp.Static.VerifyAlgorithm(w2pcrypto.AlgEd25519, respMessage(p.init, resp), resp.Signature) {
+		return errors.New("invalid handshake response from " + p.addr.String())
+	}
+
+	peerEphemeral, err := ecdh.X25519().NewPublicKey(resp.Ephemeral)
+	if err != nil {
+		return err
+	}
+	shared, err := p.ephemeral.ECDH(peerEphemeral)
+	if err != nil {
+		return err
+	}
+
+	i2r, r2i, err := deriveCiphers(shared, p.init, resp)
+	if err != nil {
+		return err
+	}
+
+	session := &Session{
+		ID:       resp.InitID,
+		RemoteID: resp.RespID,
+		PeerKey:  resp.Static,
+		Addr:     p.addr,
+		send:     i2r,
+		recv:     r2i,
+	}
+	s.add(session)
+
+	select {
+	case p.done <- session:
+	default:
+	}
+	return nil
+}
+
+// Open decrypts a data Packet with the Session it was sent in and verifies
+// the Envelope, it returns the Message and the Session
+func (s *Sessions) Open(packet *Packet) (*Message, *Session, error) {
+	s.mux.RLock()
+	session := s.ByID[packet.Session]
+	s.mux.RUnlock()
+	if session == nil {
+		return nil, nil, errors.New("unknown session")
+	}
+
+	plaintext, err := session.decrypt(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	envelope := &Envelope{}
+	err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	if envelope.OrigKey == nil || !envelope.OrigKey.VerifyAlgorithm(w2pcrypto.AlgEd25519, envelope.Body, envelope.Signature) {
+		return nil, nil, errors.New("invalid message signature")
+	}
+
+	message, err := DecodeMessage(envelope.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if message.Orig == nil || message.Dest == nil {
+		return nil, nil, errors.New("message without origin or destination")
+	}
+
+	// Orig has to be the node whose key signed the message
+	if message.Orig.ID != envelope.OrigKey.ID() {
+		return nil, nil, errors.New("origin " + message.Orig.String() + " not matching its identity")
+	}
+	message.envelope = envelope
+
+	return message, session, nil
+}
+
+// Seal signs a Message with the node's identity key, messages being forwarded
+// keep the Envelope of their origin
+func (s *Sessions) Seal(m *Message) (*Envelope, error) {
+	if m.envelope != nil {
+		return m.envelope, nil
+	}
+
+	body, err := EncodeMessage(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		Body:      body,
+		OrigKey:   s.Identity.Public(),
+		Signature: s.Identity.SignMessage(body),
+	}, nil
+}
+
+// Session
+
+// Peer returns the peer of the Session, identified by its authenticated key
+func (session *Session) Peer() *structs.Peer {
+	return structs.NewPeer(session.PeerKey.ID(), session.Addr.Addr)
+}
+
+// lastSeen returns when a packet was last received in the Session
+func (session *Session) lastSeen() time.Time {
+	session.mux.Lock()
+	defer session.mux.Unlock()
+	return session.last
+}
+
+// Encrypt builds the data Packet carrying the Envelope within the Session
+func (session *Session) Encrypt(envelope *Envelope) (*Packet, error) {
+	b := bytes.Buffer{}
+	err := gob.NewEncoder(&b).Encode(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	session.mux.Lock()
+	session.counter++
+	counter := session.counter
+	session.mux.Unlock()
+
+	nonce := make([]byte, session.send.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+
+	return &Packet{
+		Session: session.RemoteID,
+		Counter: counter,
+		Data:    session.send.Seal(nil, nonce, b.Bytes(), nil),
+	}, nil
+}
+
+// decrypt opens a data Packet and checks its counter was not already received
+func (session *Session) decrypt(packet *Packet) ([]byte, error) {
+	nonce := make([]byte, session.recv.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], packet.Counter)
+
+	plaintext, err := session.recv.Open(nil, nonce, packet.Data, nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt packet")
+	}
+
+	session.mux.Lock()
+	defer session.mux.Unlock()
+
+	// sliding window over the last counters to drop replayed packets
+	c := packet.Counter
+	switch {
+	case c > session.highest:
+		shift := c - session.highest
+		if shift >= replayWindow {
+			session.window = 0
+		} else {
+			session.window <<= shift
+		}
+		session.window |= 1
+		session.highest = c
+	case session.highest-c >= replayWindow:
+		return nil, errors.New("packet too old")
+	default:
+		bit := uint64(1) << (session.highest - c)
+		if session.window&bit != 0 {
+			return nil, errors.New("replayed packet")
+		}
+		session.window |= bit
+	}
+	session.last = time.Now()
+
+	return plaintext, nil
+}
+
+// EncodePacket serializes a Packet in order to send it
+func EncodePacket(p *Packet) ([]byte, error) {
+	b := bytes.Buffer{}
+	err := gob.NewEncoder(&b).Encode(p)
+	return b.Bytes(), err
+}
+
+// DecodePacket deserializes a received Packet
+func DecodePacket(b []byte) (*Packet, error) {
+	p := &Packet{}
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(p)
+	return p, err
+}
@@ -0,0 +1,405 @@
+package comm
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yaanst/W2P/structs"
+	"github.com/yaanst/W2P/w2pcrypto"
+)
+
+// -----------
+// - Helpers -
+// -----------
+
+// testNode is a node whose packets are exchanged in memory
+type testNode struct {
+	sessions *Sessions
+	identity *w2pcrypto.PrivateKey
+	peer     *structs.Peer
+}
+
+// newTestNode returns a node with a new identity at the given port
+func newTestNode(t *testing.T, port int) *testNode {
+	t.Helper()
+	identity, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+	peer := structs.ParsePeer("127.0.0.1:" + strconv.Itoa(port))
+	peer.ID = identity.Public().ID()
+	return &testNode{NewSessions(identity), identity, peer}
+}
+
+// source returns the node as seen by the receiver of its packets, which only
+// knows its address
+func (node *testNode) source() *structs.Peer {
+	return structs.NewPeer("", node.peer.Addr)
+}
+
+// signedInit returns a new HandshakeInit of the given identity, for any
+// responder
+func signedInit(t *testing.T, identity *w2pcrypto.PrivateKey) *HandshakeInit {
+	t.Helper()
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	init := &HandshakeInit{
+		InitID:    randomID(),
+		Static:    identity.Public(),
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Timestamp: time.Now().UnixNano(),
+	}
+	init.Signature = identity.SignMessage(initMessage(init))
+	return init
+}
+
+// connect does the handshake from a to b, changing the HandshakeResp with
+// tamper if it is not nil, and returns the Session of each side
+func connect(t *testing.T, a, b *testNode, tamper func(*HandshakeResp)) (*Session, *Session, error) {
+	t.Helper()
+	session, err := a.sessions.Dial(b.peer, func(p *Packet) {
+		reply, err := b.sessions.HandleInit(p.Init, a.source())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if tamper != nil {
+			tamper(reply.Resp)
+		}
+		a.sessions.HandleResp(reply.Resp)
+	}, 100*time.Millisecond)
+	return session, b.sessions.Get(a.source()), err
+}
+
+// seal returns the data Packet carrying m from node within session
+func seal(t *testing.T, node *testNode, session *Session, m *Message) *Packet {
+	t.Helper()
+	envelope, err := node.sessions.Seal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := session.Encrypt(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+// ---------
+// - Tests -
+// ---------
+
+func TestHandshake(t *testing.T) {
+	a, b := newTestNode(t, 5001), newTestNode(t, 5002)
+
+	aSession, bSession, err := connect(t, a, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aSession.PeerKey.ID() != b.peer.ID || bSession.PeerKey.ID() != a.peer.ID {
+		t.Fatal("sessions not authenticated with the identity of the peer")
+	}
+
+	// both directions
+	for _, test := range []struct {
+		name     string
+		from, to *testNode
+		session  *Session
+	}{
+		{"initiator to responder", a, b, aSession},
+		{"responder to initiator", b, a, bSession},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			packet := seal(t, test.from, test.session, NewHeartbeat(test.from.peer, test.to.peer))
+			message, session, err := test.to.sessions.Open(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.Orig.ID != test.from.peer.ID || session.PeerKey.ID() != test.from.peer.ID {
+				t.Error("message not authenticated with the identity of its origin")
+			}
+		})
+	}
+}
+
+func TestHandshakeInvalid(t *testing.T) {
+	other, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+
+	t.Run("init", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			change func(init *HandshakeInit)
+		}{
+			{"signed by another key", func(init *HandshakeInit) {
+				init.Signature = other.SignMessage(initMessage(init))
+			}},
+			{"changed ephemeral key", func(init *HandshakeInit) {
+				init.Ephemeral = signedInit(t, other).Ephemeral
+			}},
+			{"no static key", func(init *HandshakeInit) {
+				init.Static = nil
+			}},
+			{"changed timestamp", func(init *HandshakeInit) {
+				init.Timestamp++
+			}},
+			{"changed responder", func(init *HandshakeInit) {
+				init.Responder = other.Public().ID()
+			}},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				a, b := newTestNode(t, 5001), newTestNode(t, 5002)
+				init := signedInit(t, a.identity)
+				test.change(init)
+
+				if _, err := b.sessions.HandleInit(init, a.source()); err == nil {
+					t.Error("HandleInit() accepted an invalid handshake")
+				}
+				if len(b.sessions.ByID) != 0 {
+					t.Error("session created for an invalid handshake")
+				}
+			})
+		}
+	})
+
+	t.Run("resp", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			tamper func(resp *HandshakeResp)
+		}{
+			{"signed by another key", func(resp *HandshakeResp) {
+				resp.Static = other.Public()
+			}},
+			{"changed ephemeral key", func(resp *HandshakeResp) {
+				resp.Ephemeral = signedInit(t, other).Ephemeral
+			}},
+			{"unknown handshake", func(resp *HandshakeResp) {
+				resp.InitID++
+			}},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				a, b := newTestNode(t, 5001), newTestNode(t, 5002)
+
+				if _, _, err := connect(t, a, b, test.tamper); err == nil {
+					t.Error("Dial() accepted an invalid handshake response")
+				}
+				if a.sessions.Get(b.peer) != nil {
+					t.Error("session created for an invalid handshake response")
+				}
+			})
+		}
+	})
+}
+
+func TestHandshakeInitReplay(t *testing.T) {
+	other, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+	now := time.Now()
+
+	// at returns a HandshakeInit of a for the responder at the given time
+	at := func(t *testing.T, a *testNode, responder string, timestamp time.Time) *HandshakeInit {
+		init := signedInit(t, a.identity)
+		init.Responder = responder
+		init.Timestamp = timestamp.UnixNano()
+		init.Signature = a.identity.SignMessage(initMessage(init))
+		return init
+	}
+
+	tests := []struct {
+		name  string
+		inits func(t *testing.T, a, b *testNode) []*HandshakeInit
+		valid []bool
+	}{
+		{"new handshakes", func(t *testing.T, a, b *testNode) []*HandshakeInit {
+			return []*HandshakeInit{at(t, a, "", now), at(t, a, b.peer.ID, now.Add(time.Second))}
+		}, []bool{true, true}},
+		{"replayed", func(t *testing.T, a, b *testNode) []*HandshakeInit {
+			init := at(t, a, b.peer.ID, now)
+			return []*HandshakeInit{init, init}
+		}, []bool{true, false}},
+		{"older than the last one", func(t *testing.T, a, b *testNode) []*HandshakeInit {
+			return []*HandshakeInit{at(t, a, "", now), at(t, a, "", now.Add(-time.Second))}
+		}, []bool{true, false}},
+		{"other identity at the same time", func(t *testing.T, a, b *testNode) []*HandshakeInit {
+			c := newTestNode(t, 5003)
+			return []*HandshakeInit{at(t, a, "", now), at(t, c, "", now)}
+		}, []bool{true, true}},
+		{"stale", func(t *testing.T, a, b *testNode) []*HandshakeInit {
+			return []*HandshakeInit{at(t, a, "", now.Add(-time.Hour))}
+		}, []bool{false}},
+		{"from the future", func(t *testing.T, a, b *testNode) []*HandshakeInit {
+			return []*HandshakeInit{at(t, a, "", now.Add(time.Hour))}
+		}, []bool{false}},
+		{"meant for another node", func(t *testing.T, a, b *testNode) []*HandshakeInit {
+			return []*HandshakeInit{at(t, a, other.Public().ID(), now)}
+		}, []bool{false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newTestNode(t, 5001), newTestNode(t, 5002)
+			for i, init := range test.inits(t, a, b) {
+				_, err := b.sessions.HandleInit(init, a.source())
+				if got := err == nil; got != test.valid[i] {
+					t.Errorf("init %v: accepted = %v, want %v (%v)", i, got, test.valid[i], err)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	a, b := newTestNode(t, 5001), newTestNode(t, 5002)
+	aSession, _, err := connect(t, a, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestNode(t, 5003)
+
+	tests := []struct {
+		name   string
+		packet func() *Packet
+	}{
+		{"origin not matching its identity", func() *Packet {
+			return seal(t, a, aSession, NewHeartbeat(other.peer, b.peer))
+		}},
+		{"envelope signed by another key", func() *Packet {
+			m := NewHeartbeat(other.peer, b.peer)
+			envelope, _ := other.sessions.Seal(m)
+			envelope.OrigKey = a.identity.Public()
+			packet, _ := aSession.Encrypt(envelope)
+			return packet
+		}},
+		{"tampered data", func() *Packet {
+			packet := seal(t, a, aSession, NewHeartbeat(a.peer, b.peer))
+			packet.Data[0] ^= 1
+			return packet
+		}},
+		{"unknown session", func() *Packet {
+			packet := seal(t, a, aSession, NewHeartbeat(a.peer, b.peer))
+			packet.Session++
+			return packet
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := b.sessions.Open(test.packet()); err == nil {
+				t.Error("Open() accepted an invalid packet")
+			}
+		})
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		counters []uint64
+		valid    []bool
+	}{
+		{"in order", []uint64{1, 2, 3}, []bool{true, true, true}},
+		{"duplicate", []uint64{1, 2, 2}, []bool{true, true, false}},
+		{"out of order", []uint64{3, 1, 2}, []bool{true, true, true}},
+		{"out of order duplicate", []uint64{3, 1, 1}, []bool{true, true, false}},
+		{"oldest in window", []uint64{100, 37}, []bool{true, true}},
+		{"too old", []uint64{100, 36}, []bool{true, false}},
+		{"jump beyond window", []uint64{1, 2, 200, 2, 199}, []bool{true, true, true, false, true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newTestNode(t, 5001), newTestNode(t, 5002)
+			aSession, _, err := connect(t, a, b, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			packets := make(map[uint64]*Packet)
+			for i := 0; i < 200; i++ {
+				packet := seal(t, a, aSession, NewHeartbeat(a.peer, b.peer))
+				packets[packet.Counter] = packet
+			}
+
+			for i, c := range test.counters {
+				_, _, err := b.sessions.Open(packets[c])
+				if got := err == nil; got != test.valid[i] {
+					t.Errorf("packet %v: accepted = %v, want %v (%v)", c, got, test.valid[i], err)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionsBound(t *testing.T) {
+	b := newTestNode(t, 5000)
+	var nodes []*testNode
+	for i := 0; i < 5; i++ {
+		node := newTestNode(t, 5001+i)
+		if _, err := b.sessions.HandleInit(signedInit(t, node.identity), node.source()); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	// the last two have the same score, the least recently active goes first
+	scores := map[string]float64{
+		nodes[0].peer.ID: 0.5,
+		nodes[1].peer.ID: 0.1,
+		nodes[2].peer.ID: 2,
+		nodes[3].peer.ID: 1,
+		nodes[4].peer.ID: 1,
+	}
+	b.sessions.Get(nodes[3].source()).last = time.Now().Add(-time.Minute)
+	score := func(p *structs.Peer) float64 { return scores[p.ID] }
+	keep := func(p *structs.Peer) bool { return p.ID == nodes[1].peer.ID }
+
+	tests := []struct {
+		max  int
+		kept []bool
+	}{
+		{5, []bool{true, true, true, true, true}},
+		{4, []bool{false, true, true, true, true}},
+		{3, []bool{false, true, true, false, true}},
+		{1, []bool{false, true, false, false, false}},
+		{0, []bool{false, true, false, false, false}},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.max), func(t *testing.T) {
+			b.sessions.Bound(test.max, score, keep)
+			for i, node := range nodes {
+				if got := b.sessions.Get(node.source()) != nil; got != test.kept[i] {
+					t.Errorf("session %v kept = %v, want %v", i, got, test.kept[i])
+				}
+			}
+			if len(b.sessions.ByID) != len(b.sessions.ByAddr) {
+				t.Errorf("%v sessions by id, %v by address", len(b.sessions.ByID), len(b.sessions.ByAddr))
+			}
+		})
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	a, b, c := newTestNode(t, 5001), newTestNode(t, 5002), newTestNode(t, 5003)
+	aSession, bSession, err := connect(t, a, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := connect(t, c, b, nil); err != nil {
+		t.Fatal(err)
+	}
+	bSession.last = time.Now().Add(-time.Hour)
+
+	expired := b.sessions.Expire(time.Minute)
+	if len(expired) != 1 || expired[0] != bSession {
+		t.Fatalf("Expire() = %v, want the idle session", expired)
+	}
+	if b.sessions.Get(a.source()) != nil || b.sessions.Get(c.source()) == nil {
+		t.Error("wrong session expired")
+	}
+
+	// packets of an expired session are dropped
+	if _, _, err := b.sessions.Open(seal(t, a, aSession, NewHeartbeat(a.peer, b.peer))); err == nil {
+		t.Error("packet accepted in an expired session")
+	}
+}
@@ -0,0 +1,486 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/yaanst/W2P/utils"
+	"github.com/yaanst/W2P/w2pcrypto"
+)
+
+// -----------
+// - Structs -
+// -----------
+
+// Config holds all the settings of a node. Each field can be set in the JSON
+// config file under its name, by the environment variable W2P_ followed by its
+// name in upper snake case (e.g. W2P_UI_PORT), and by the flag of its name in
+// lower camel case (e.g. -uiPort), in increasing order of precedence
+type Config struct {
+	// Node
+	Name     string `usage:"Name of the node"`
+	Addr     string `usage:"Address of the node format IP:PORT"`
+	Peers    string `usage:"Comma-separated list of peers in the form of IP:PORT"`
+	UIPort   string `usage:"Port for the browser based UI"`
+	UIListen string `usage:"Additional address (IP:PORT) serving the UI over TLS to other machines"`
+	UICert   string `usage:"TLS certificate file of the UI served on uiListen"`
+	UIKey    string `usage:"TLS private key file of the UI served on uiListen"`
+	Relay    bool   `usage:"Forward traffic for nodes behind a NAT"`
+	UseRelay string `usage:"Relay (IP:PORT) forwarding traffic for this node if it is behind a NAT"`
+	LAN      bool   `usage:"Find other nodes on the local network with multicast announces"`
+
+	// Directories, the relative ones being in Datadir except UIDir
+	Datadir      string `usage:"Directory containing all the state of the node"`
+	UIDir        string `usage:"Directory overriding the UI embedded in the binary, for development"`
+	WebsiteDir   string `usage:"Directory containing the websites"`
+	MetadataDir  string `usage:"Directory containing the metadata of the websites"`
+	SeedDir      string `usage:"Directory containing the archives of the seeded websites"`
+	KeyDir       string `usage:"Directory containing the keys of the websites"`
+	IdentityFile string `usage:"File containing the identity key of the node"`
+	TokenFile    string `usage:"File containing the token authenticating the clients of the control API"`
+
+	// Pieces
+	PieceLength     int      `usage:"Length in bytes of the pieces of new websites"`
+	Upload          int      `usage:"Upload rate cap in KB/s, 0 for no cap"`
+	Download        int      `usage:"Download rate cap in KB/s, 0 for no cap"`
+	DataReqTimeout  Duration `usage:"Timeout of a request for a piece"`
+	RetrieveTimeout Duration `usage:"Timeout of the retrieval of a website"`
+	MaxBadPieces    int      `usage:"Number of bad pieces after which a peer is banned"`
+	MaxBundleSize   int64    `usage:"Maximum size in bytes of an imported identity bundle"`
+	MaxUploadSize   int64    `usage:"Maximum size in bytes of a website uploaded from the UI, once unpacked"`
+	MaxUploadFiles  int      `usage:"Maximum number of files of a website uploaded from the UI"`
+
+	// Network
+	ListenBufferSize    int      `usage:"Size in bytes of the buffer holding incoming messages"`
+	ConnBufferSize      int      `usage:"OS buffer size in bytes to receive and send UDP packets"`
+	HandshakeTimeout    Duration `usage:"Timeout for establishing a session with a peer"`
+	MaxSessions         int      `usage:"Maximum number of sessions, the ones of the peers with the lowest score being evicted"`
+	SessionTimeout      Duration `usage:"Time after which a session in which nothing was received is closed"`
+	AntiEntropyInterval Duration `usage:"Interval at which the WebsiteMap is sent to the peers"`
+
+	// Peers
+	MaxPeers          int      `usage:"Maximum number of peers, the ones with the lowest score being evicted"`
+	MaxSeeders        int      `usage:"Maximum number of seeders kept for a website"`
+	HeartBeatTimeout  Duration `usage:"Timeout for an answer from a peer"`
+	ProbeInterval     Duration `usage:"Interval at which a peer is probed"`
+	IndirectProbes    int      `usage:"Number of peers asked to probe a peer which does not answer"`
+	SuspicionTimeout  Duration `usage:"Time a suspect peer has to show it is alive"`
+	DeadMemberTimeout Duration `usage:"Time a dead peer is remembered to notice its rejoin"`
+	PexInterval       Duration `usage:"Interval at which peers are exchanged with a peer"`
+	PexSize           int      `usage:"Maximum number of peers sent in a peer exchange"`
+	LANGroup          string   `usage:"Multicast group (IP:PORT) of the announces on the local network"`
+	LANInterval       Duration `usage:"Interval at which the node announces itself on the local network"`
+
+	// Abuse protection
+	PeerRate      float64  `usage:"Number of requests per second a peer can send"`
+	PeerBurst     float64  `usage:"Number of requests a peer can send at once"`
+	Workers       int      `usage:"Number of goroutines handling the requests of other nodes"`
+	WorkQueueSize int      `usage:"Number of waiting requests beyond which new ones are dropped"`
+	BanDuration   Duration `usage:"Time a peer which sent invalid data is banned for"`
+
+	// NAT traversal
+	RelayKeepAlive       Duration `usage:"Interval at which a node registers again with its relay"`
+	IntroductionInterval Duration `usage:"Minimum interval between two introductions to the same peer"`
+	PunchAttempts        int      `usage:"Number of handshakes tried to punch a path through NATs"`
+	PunchTimeout         Duration `usage:"Timeout of each handshake when punching"`
+}
+
+// Duration is a time.Duration written as a string (e.g. "1m30s") in the
+// config file, the environment and the flags
+type Duration struct {
+	time.Duration
+}
+
+// field is a flag.Value setting a field of a Config
+type field struct {
+	value reflect.Value
+}
+
+// positive are the numeric settings which have to be above 0, the others
+// only having to be positive or 0
+var positive = []string{
+	"PieceLength", "MaxBadPieces", "MaxBundleSize", "MaxUploadSize", "MaxUploadFiles",
+	"ListenBufferSize", "ConnBufferSize", "MaxSessions", "MaxPeers",
+	"MaxSeeders", "PexSize", "PeerRate", "PeerBurst", "Workers", "PunchAttempts",
+}
+
+// ----------------
+// - Constructors -
+// ----------------
+
+// Default constructs the Config with the default settings of utils
+func Default() *Config {
+	return &Config{
+		Name:   "test",
+		UIPort: "8000",
+
+		Datadir:      ".",
+		UIDir:        utils.UIDir,
+		WebsiteDir:   utils.WebsiteDir,
+		MetadataDir:  utils.MetadataDir,
+		SeedDir:      utils.SeedDir,
+		KeyDir:       utils.KeyDir,
+		IdentityFile: utils.IdentityFile,
+		TokenFile:    utils.TokenFile,
+
+		PieceLength:     utils.DefaultPieceLength,
+		Upload:          utils.DefaultUploadRate / 1000,
+		Download:        utils.DefaultDownloadRate / 1000,
+		DataReqTimeout:  Duration{utils.DataReqTimeout},
+		RetrieveTimeout: Duration{utils.RetrieveTimeout},
+		MaxBadPieces:    utils.MaxBadPieces,
+		MaxBundleSize:   utils.MaxBundleSize,
+		MaxUploadSize:   utils.MaxUploadSize,
+		MaxUploadFiles:  utils.MaxUploadFiles,
+
+		ListenBufferSize:    utils.ListenBufferSize,
+		ConnBufferSize:      utils.ConnBufferSize,
+		HandshakeTimeout:    Duration{utils.HandshakeTimeout},
+		MaxSessions:         utils.MaxSessions,
+		SessionTimeout:      Duration{utils.SessionTimeout},
+		AntiEntropyInterval: Duration{utils.AntiEntropyInterval},
+
+		MaxPeers:          utils.MaxPeers,
+		MaxSeeders:        utils.MaxSeeders,
+		HeartBeatTimeout:  Duration{utils.HeartBeatTimeout},
+		ProbeInterval:     Duration{utils.ProbeInterval},
+		IndirectProbes:    utils.IndirectProbes,
+		SuspicionTimeout:  Duration{utils.SuspicionTimeout},
+		DeadMemberTimeout: Duration{utils.DeadMemberTimeout},
+		PexInterval:       Duration{utils.PexInterval},
+		PexSize:           utils.PexSize,
+		LANGroup:          utils.LANGroup,
+		LANInterval:       Duration{utils.LANInterval},
+
+		PeerRate:      utils.PeerRate,
+		PeerBurst:     utils.PeerBurst,
+		Workers:       utils.Workers,
+		WorkQueueSize: utils.WorkQueueSize,
+		BanDuration:   Duration{utils.BanDuration},
+
+		RelayKeepAlive:       Duration{utils.RelayKeepAlive},
+		IntroductionInterval: Duration{utils.IntroductionInterval},
+		PunchAttempts:        utils.PunchAttempts,
+		PunchTimeout:         Duration{utils.PunchTimeout},
+	}
+}
+
+// Load builds the Config from the defaults, overridden by the JSON file at
+// path if it is not empty, then by the environment, then by the flags of fs
+// (registered with Flags) which were set
+func Load(path string, fs *flag.FlagSet) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, c)
+		if err == nil {
+			err = c.Validate()
+		}
+		if err != nil {
+			return nil, errors.New("Invalid config file " + path + ": " + err.Error())
+		}
+	}
+
+	err := c.loadEnv()
+	if err != nil {
+		return nil, err
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, errors.New("Invalid environment: " + err.Error())
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := c.fields()[f.Name]; ok && err == nil {
+			err = v.Set(f.Value.String())
+		}
+	})
+	if err == nil {
+		err = c.Validate()
+	}
+	if err != nil {
+		return nil, errors.New("Invalid flags: " + err.Error())
+	}
+	return c, nil
+}
+
+// Flags registers a flag in fs for each field of the Config, or only for the
+// given ones, their values being read by Load
+func Flags(fs *flag.FlagSet, names ...string) {
+	c := Default()
+	t := reflect.TypeOf(c).Elem()
+	for name, v := range c.fields() {
+		if len(names) > 0 && !utils.Contains(names, name) {
+			continue
+		}
+		sf, _ := t.FieldByName(fieldName(t, name))
+		fs.Var(v, name, sf.Tag.Get("usage"))
+	}
+}
+
+// -----------
+// - Methods -
+// -----------
+
+// Apply sets the directories used by the packages which have no Config
+func (c *Config) Apply() {
+	utils.UIDir = c.UIDir
+	utils.WebsiteDir = dir(c.inDatadir(c.WebsiteDir))
+	utils.MetadataDir = dir(c.inDatadir(c.MetadataDir))
+	utils.SeedDir = dir(c.inDatadir(c.SeedDir))
+	utils.KeyDir = dir(c.inDatadir(c.KeyDir))
+	utils.IdentityFile = c.inDatadir(c.IdentityFile)
+	utils.TokenFile = c.inDatadir(c.TokenFile)
+	w2pcrypto.KeyFolder = utils.KeyDir
+}
+
+// Validate checks the numeric settings, durations and addresses of the
+// Config, the error naming the first invalid field by its flag name
+func (c *Config) Validate() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := v.Field(i)
+
+		var x float64
+		switch value.Kind() {
+		case reflect.Int, reflect.Int64:
+			x = float64(value.Int())
+		case reflect.Float64:
+			x = value.Float()
+		case reflect.Struct:
+			// tickers and timeouts need positive durations
+			if value.Interface().(Duration).Duration <= 0 {
+				return errors.New(camelCase(name) + " must be a positive duration")
+			}
+			continue
+		default:
+			continue
+		}
+
+		if utils.Contains(positive, name) && !(x > 0) {
+			return errors.New(camelCase(name) + " must be above 0")
+		} else if !(x >= 0) {
+			return errors.New(camelCase(name) + " cannot be negative")
+		}
+	}
+
+	if err := validPort(c.UIPort, 1); err != nil {
+		return errors.New("uiPort " + err.Error())
+	}
+	// the node can listen on the port 0, chosen by the system
+	if err := validAddr(c.Addr, 0); err != nil {
+		return errors.New("addr " + err.Error())
+	}
+	addrs := map[string]string{
+		"uiListen": c.UIListen,
+		"useRelay": c.UseRelay,
+		"lanGroup": c.LANGroup,
+	}
+	for name, addr := range addrs {
+		if err := validAddr(addr, 1); err != nil {
+			return errors.New(name + " " + err.Error())
+		}
+	}
+	for _, addr := range strings.Split(c.Peers, ",") {
+		if err := validAddr(addr, 1); err != nil {
+			return errors.New("peers " + err.Error())
+		}
+	}
+	return nil
+}
+
+// inDatadir returns the path of a file of the node, relative paths being in
+// the Datadir
+func (c *Config) inDatadir(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.Datadir, path)
+}
+
+// loadEnv overrides the fields set in the environment
+func (c *Config) loadEnv() error {
+	t := reflect.TypeOf(c).Elem()
+	for name, v := range c.fields() {
+		env := "W2P_" + snakeCase(fieldName(t, name))
+		if value, ok := os.LookupEnv(env); ok {
+			err := v.Set(value)
+			if err != nil {
+				return errors.New("Invalid " + env + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// fields returns the fields of the Config indexed by their flag name
+func (c *Config) fields() map[string]*field {
+	fields := make(map[string]*field)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		fields[camelCase(v.Type().Field(i).Name)] = &field{v.Field(i)}
+	}
+	return fields
+}
+
+// Duration
+
+// MarshalText writes the Duration as a string (e.g. "1m30s")
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText reads a Duration written as a string (e.g. "1m30s")
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// field
+
+// String returns the value of the field as written in the flags
+func (f *field) String() string {
+	if f == nil || !f.value.IsValid() {
+		return ""
+	}
+	switch f.value.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(f.value.Bool())
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(f.value.Int(), 10)
+	case reflect.Float64:
+		return strconv.FormatFloat(f.value.Float(), 'g', -1, 64)
+	case reflect.Struct:
+		return f.value.Interface().(Duration).String()
+	}
+	return f.value.String()
+}
+
+// Set parses the value of the field as written in the flags or environment
+func (f *field) Set(s string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(i)
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.value.SetFloat(x)
+	case reflect.Struct:
+		return f.value.Addr().Interface().(*Duration).UnmarshalText([]byte(s))
+	}
+	return nil
+}
+
+// IsBoolFlag lets boolean flags be given without a value
+func (f *field) IsBoolFlag() bool {
+	return f.value.Kind() == reflect.Bool
+}
+
+// -----------
+// - Helpers -
+// -----------
+
+// camelCase converts a field name to lower camel case, "UIPort" being "uiPort"
+func camelCase(name string) string {
+	runes := []rune(name)
+	for i := range runes {
+		// the last capital of an acronym starts the next word
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		if !unicode.IsUpper(runes[i]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// snakeCase converts a field name to upper snake case, "UIPort" being "UI_PORT"
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		wordStart := unicode.IsUpper(r) && i > 0 &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])))
+		if wordStart {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// fieldName returns the name of the field of t with the given flag name
+func fieldName(t reflect.Type, flagName string) string {
+	for i := 0; i < t.NumField(); i++ {
+		if camelCase(t.Field(i).Name) == flagName {
+			return t.Field(i).Name
+		}
+	}
+	return ""
+}
+
+// validPort checks that port is a port number of at least min
+func validPort(port string, min int) error {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < min || p > 65535 {
+		return errors.New("has an invalid port '" + port + "'")
+	}
+	return nil
+}
+
+// validAddr checks that addr is empty or in the form IP:PORT, with a port of
+// at least minPort
+func validAddr(addr string, minPort int) error {
+	if addr == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New("'" + addr + "' is not in the form IP:PORT")
+	}
+	return validPort(port, minPort)
+}
+
+// dir makes sure a directory path ends with a separator, as the paths of
+// files are built by appending their name
+func dir(path string) string {
+	if path != "" && !strings.HasSuffix(path, "/") {
+		return path + "/"
+	}
+	return path
+}
@@ -0,0 +1,305 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yaanst/W2P/utils"
+	"github.com/yaanst/W2P/w2pcrypto"
+)
+
+// -----------
+// - Helpers -
+// -----------
+
+// writeConfig writes data to a config file in a temporary directory and
+// returns its path
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// restoreDirs restores the directories set by Apply at the end of the test
+func restoreDirs(t *testing.T) {
+	t.Helper()
+	websiteDir, metadataDir, seedDir, keyDir := utils.WebsiteDir, utils.MetadataDir, utils.SeedDir, utils.KeyDir
+	uiDir, identityFile, tokenFile, keyFolder := utils.UIDir, utils.IdentityFile, utils.TokenFile, w2pcrypto.KeyFolder
+	t.Cleanup(func() {
+		utils.WebsiteDir, utils.MetadataDir, utils.SeedDir, utils.KeyDir = websiteDir, metadataDir, seedDir, keyDir
+		utils.UIDir, utils.IdentityFile, utils.TokenFile, w2pcrypto.KeyFolder = uiDir, identityFile, tokenFile, keyFolder
+	})
+}
+
+// ---------
+// - Tests -
+// ---------
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		args  []string
+		check func(c *Config) bool
+	}{
+		{"defaults", "", nil, nil, func(c *Config) bool {
+			return c.UIPort == "8000" && c.PexSize == Default().PexSize
+		}},
+		{"file over defaults", `{"UIPort": "8001", "PexInterval": "3s"}`, nil, nil, func(c *Config) bool {
+			return c.UIPort == "8001" && c.PexInterval.Duration == 3*time.Second
+		}},
+		{"env over file", `{"UIPort": "8001"}`, map[string]string{"W2P_UI_PORT": "8002"}, nil, func(c *Config) bool {
+			return c.UIPort == "8002"
+		}},
+		{"flags over env", `{"UIPort": "8001"}`, map[string]string{"W2P_UI_PORT": "8002"}, []string{"-uiPort", "8003"}, func(c *Config) bool {
+			return c.UIPort == "8003"
+		}},
+		{"unset flags keep env", "", map[string]string{"W2P_MAX_PEERS": "7"}, []string{"-uiPort", "8003"}, func(c *Config) bool {
+			return c.MaxPeers == 7 && c.UIPort == "8003"
+		}},
+		{"env of every type", "", map[string]string{"W2P_LAN": "true", "W2P_PEER_RATE": "2.5", "W2P_MAX_BUNDLE_SIZE": "10", "W2P_HEART_BEAT_TIMEOUT": "1m"}, nil, func(c *Config) bool {
+			return c.LAN && c.PeerRate == 2.5 && c.MaxBundleSize == 10 && c.HeartBeatTimeout.Duration == time.Minute
+		}},
+		{"boolean flag without value", "", nil, []string{"-relay"}, func(c *Config) bool {
+			return c.Relay
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for env, value := range test.env {
+				t.Setenv(env, value)
+			}
+			path := ""
+			if test.file != "" {
+				path = writeConfig(t, test.file)
+			}
+			fs := flag.NewFlagSet("w2p", flag.ContinueOnError)
+			Flags(fs)
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := Load(path, fs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(c) {
+				t.Errorf("Config = %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{"missing file", "-", nil, nil, "no such file"},
+		{"malformed file", `{"UIPort": 8001}`, nil, nil, "Invalid config file"},
+		{"invalid file value", `{"MaxPeers": 0}`, nil, nil, "maxPeers must be above 0"},
+		{"malformed env", "", map[string]string{"W2P_MAX_PEERS": "many"}, nil, "Invalid W2P_MAX_PEERS"},
+		{"invalid env value", "", map[string]string{"W2P_PEX_INTERVAL": "0s"}, nil, "Invalid environment: pexInterval"},
+		{"invalid flag value", "", nil, []string{"-uiPort", "0"}, "Invalid flags: uiPort"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for env, value := range test.env {
+				t.Setenv(env, value)
+			}
+			path := ""
+			if test.file == "-" {
+				path = filepath.Join(t.TempDir(), "missing.json")
+			} else if test.file != "" {
+				path = writeConfig(t, test.file)
+			}
+			fs := flag.NewFlagSet("w2p", flag.ContinueOnError)
+			Flags(fs)
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := Load(path, fs)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Load() = %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		err    string
+	}{
+		{"default", func(c *Config) {}, ""},
+		{"zero where positive", func(c *Config) { c.PieceLength = 0 }, "pieceLength must be above 0"},
+		{"negative float", func(c *Config) { c.PeerBurst = -1 }, "peerBurst must be above 0"},
+		{"zero allowed", func(c *Config) { c.Upload = 0; c.IndirectProbes = 0 }, ""},
+		{"negative", func(c *Config) { c.Download = -1 }, "download cannot be negative"},
+		{"zero duration", func(c *Config) { c.ProbeInterval = Duration{} }, "probeInterval must be a positive duration"},
+		{"UI port 0", func(c *Config) { c.UIPort = "0" }, "uiPort has an invalid port"},
+		{"UI port too high", func(c *Config) { c.UIPort = "65536" }, "uiPort has an invalid port"},
+		{"node port 0", func(c *Config) { c.Addr = "127.0.0.1:0" }, ""},
+		{"address without port", func(c *Config) { c.Addr = "127.0.0.1" }, "addr '127.0.0.1' is not in the form IP:PORT"},
+		{"relay port 0", func(c *Config) { c.UseRelay = "10.0.0.1:0" }, "useRelay has an invalid port"},
+		{"peers", func(c *Config) { c.Peers = "10.0.0.1:5000,[::1]:5001" }, ""},
+		{"invalid peer", func(c *Config) { c.Peers = "10.0.0.1:5000,10.0.0.2" }, "peers '10.0.0.2'"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := Default()
+			test.change(c)
+			err := c.Validate()
+			if test.err == "" && err != nil {
+				t.Errorf("Validate() = %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Duration
+		ok   bool
+	}{
+		{"1m30s", 90 * time.Second, true},
+		{"250ms", 250 * time.Millisecond, true},
+		{"10", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			var d Duration
+			err := d.UnmarshalText([]byte(test.text))
+			if (err == nil) != test.ok || d.Duration != test.want {
+				t.Fatalf("UnmarshalText() = %v, %v, want %v", d.Duration, err, test.want)
+			}
+			if !test.ok {
+				return
+			}
+			text, _ := d.MarshalText()
+			if d2 := (Duration{}); d2.UnmarshalText(text) != nil || d2.Duration != test.want {
+				t.Errorf("MarshalText() = %s, not read back", text)
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		camel string
+		snake string
+	}{
+		{"Name", "name", "NAME"},
+		{"UIPort", "uiPort", "UI_PORT"},
+		{"LAN", "lan", "LAN"},
+		{"LANGroup", "lanGroup", "LAN_GROUP"},
+		{"HeartBeatTimeout", "heartBeatTimeout", "HEART_BEAT_TIMEOUT"},
+		{"Datadir", "datadir", "DATADIR"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if camel := camelCase(test.name); camel != test.camel {
+				t.Errorf("camelCase() = %v, want %v", camel, test.camel)
+			}
+			if snake := snakeCase(test.name); snake != test.snake {
+				t.Errorf("snakeCase() = %v, want %v", snake, test.snake)
+			}
+		})
+	}
+
+	// every field has its own flag
+	if n, want := len(Default().fields()), reflect.TypeOf(Config{}).NumField(); n != want {
+		t.Errorf("%v flags, want %v", n, want)
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		datadir string
+		change  func(c *Config)
+		want    []string
+	}{
+		{"default", ".", func(c *Config) {},
+			[]string{"website/", "metadata/", "seed/", "keys/", "identity.key", "control.token", ""}},
+		{"datadir", "/var/w2p/a", func(c *Config) {},
+			[]string{"/var/w2p/a/website/", "/var/w2p/a/metadata/", "/var/w2p/a/seed/", "/var/w2p/a/keys/",
+				"/var/w2p/a/identity.key", "/var/w2p/a/control.token", ""}},
+		{"relative datadir", "node2", func(c *Config) {},
+			[]string{"node2/website/", "node2/metadata/", "node2/seed/", "node2/keys/", "node2/identity.key", "node2/control.token", ""}},
+		{"absolute paths kept", "/var/w2p/a", func(c *Config) {
+			c.SeedDir = "/srv/seed"
+			c.IdentityFile = "/etc/w2p/identity.key"
+		}, []string{"/var/w2p/a/website/", "/var/w2p/a/metadata/", "/srv/seed/", "/var/w2p/a/keys/",
+			"/etc/w2p/identity.key", "/var/w2p/a/control.token", ""}},
+		{"UI directory not in the datadir", "/var/w2p/a", func(c *Config) { c.UIDir = "ui/webpage" },
+			[]string{"/var/w2p/a/website/", "/var/w2p/a/metadata/", "/var/w2p/a/seed/", "/var/w2p/a/keys/",
+				"/var/w2p/a/identity.key", "/var/w2p/a/control.token", "ui/webpage"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			restoreDirs(t)
+			c := Default()
+			c.Datadir = test.datadir
+			test.change(c)
+			c.Apply()
+
+			got := []string{utils.WebsiteDir, utils.MetadataDir, utils.SeedDir, utils.KeyDir,
+				utils.IdentityFile, utils.TokenFile, utils.UIDir}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("directories = %v, want %v", got, test.want)
+					break
+				}
+			}
+			if w2pcrypto.KeyFolder != utils.KeyDir {
+				t.Errorf("KeyFolder = %v, want %v", w2pcrypto.KeyFolder, utils.KeyDir)
+			}
+		})
+	}
+}
+
+func TestDatadirFlag(t *testing.T) {
+	restoreDirs(t)
+	fs := flag.NewFlagSet("w2p", flag.ContinueOnError)
+	Flags(fs)
+	if err := fs.Parse([]string{"-datadir", "/var/w2p/b"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("W2P_DATADIR", "/var/w2p/a")
+	t.Setenv("W2P_KEY_DIR", "k")
+
+	c, err := Load("", fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Apply()
+	if utils.KeyDir != "/var/w2p/b/k/" || utils.WebsiteDir != "/var/w2p/b/website/" {
+		t.Errorf("directories in %v and %v, want them in /var/w2p/b", utils.KeyDir, utils.WebsiteDir)
+	}
+}
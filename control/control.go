@@ -0,0 +1,398 @@
+package control
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// --------------
+// - API schema -
+// --------------
+
+// The control API of a node is served with its UI under APIPrefix. Clients
+// are authenticated by the token of the node, sent in an "Authorization:
+// Bearer <token>" header or, for the browser, in the SessionCookie set when
+// opening the UI with the token in the "token" query parameter. The requests
+// of the browser changing anything also carry the value of the CSRFCookie in
+// the CSRFHeader. Requests and answers are JSON documents, an error being
+// answered with its HTTP status and an ErrorBody:
+//
+//	GET    /status                    Status
+//	GET    /peers                     []Peer
+//	GET    /folders                   []string, the folders in the WebsiteDir
+//	GET    /sites?q=keywords          []Site, all or matching the keywords
+//	POST   /sites                     PublishRequest -> 201 Site, or a multipart
+//	                                  form with its fields and the website as
+//	                                  an "archive" file (zip, tar or tar.gz) or
+//	                                  as "files" with their relative "paths"
+//	GET    /sites/{name}              Site
+//	PUT    /sites/{name}              UpdateRequest -> Site, needs to be unlocked
+//	POST   /sites/{name}/unlock       UnlockRequest -> 204
+//	POST   /sites/{name}/lock         204
+//	POST   /sites/{name}/fetch        Site, once retrieved from the seeders, 409
+//	                                  if owned, up to date or being retrieved
+//	POST   /sites/{name}/export       ExportRequest -> the identity bundle
+//	POST   /sites/{name}/editor-key   EditorKeyRequest -> EditorKey
+//	POST   /sites/{name}/delegations  DelegationRequest -> 204
+//	DELETE /sites/{name}/delegations  DelegationRequest -> 204
+//	POST   /sites/{name}/rotate       RotateRequest -> 204
+//	POST   /sites/{name}/revocations  RevocationRequest -> 204
+//	POST   /identities                multipart form with the "bundle" file,
+//	                                  "passphrase" and "key_passphrase" -> 201 Imported
+//	GET    /bandwidth                 Bandwidth
+//	PUT    /bandwidth                 BandwidthRequest -> Bandwidth
+//
+// Fields may be added to the documents within a version, any other change
+// making a new version
+
+// APIVersion is the version of the control API
+const APIVersion string = "v1"
+
+// APIPrefix is the path under which the control API is served
+const APIPrefix string = "/api/" + APIVersion
+
+// SessionCookie is the cookie authenticating the browser, holding the token
+const SessionCookie string = "w2p_session"
+
+// CSRFCookie is the cookie holding the value the browser sends in CSRFHeader
+const CSRFCookie string = "w2p_csrf"
+
+// CSRFHeader is the header proving a request of the browser comes from the UI
+const CSRFHeader string = "X-CSRF-Token"
+
+// tokenSize is the number of random bytes in a token
+const tokenSize int = 32
+
+// The codes of the errors, each matching an HTTP status
+const (
+	CodeBadRequest   = "bad_request"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeTooLarge     = "too_large"
+	CodeInternal     = "internal"
+)
+
+// ErrorBody is the answer of the control API to a failed request
+type ErrorBody struct {
+	Error Error `json:"error"`
+}
+
+// Error tells why a request failed, Code being one of the Code constants
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Status is what the control API tells about the node, rates being in KB/s
+type Status struct {
+	API      string `json:"api"`
+	Name     string `json:"name"`
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	Peers    int    `json:"peers"`
+	Websites int    `json:"websites"`
+	Upload   int    `json:"upload"`
+	Download int    `json:"download"`
+}
+
+// Site is what the control API tells about a known website
+type Site struct {
+	Name      string   `json:"name"`
+	Version   int      `json:"version"`
+	Keywords  []string `json:"keywords"`
+	Algorithm string   `json:"algorithm"`
+	Seeders   int      `json:"seeders"`
+	Owned     bool     `json:"owned"`
+	Unlocked  bool     `json:"unlocked"`
+}
+
+// Peer is what the control API tells about a known peer
+type Peer struct {
+	ID         string  `json:"id"`
+	Addr       string  `json:"addr"`
+	State      string  `json:"state"`
+	Score      float64 `json:"score"`
+	Reputation float64 `json:"reputation"`
+}
+
+// PublishRequest shares a new website, copying the folder Dir (an absolute
+// path on the node's machine, only accepted from it) in the WebsiteDir if it
+// is given, the folder Name already being there otherwise. Its key is created
+// with Algorithm (the default one if empty) and encrypted with Passphrase
+type PublishRequest struct {
+	Name       string   `json:"name"`
+	Dir        string   `json:"dir,omitempty"`
+	Keywords   []string `json:"keywords"`
+	Algorithm  string   `json:"algorithm,omitempty"`
+	Passphrase string   `json:"passphrase"`
+}
+
+// UpdateRequest publishes a new version of a website, with the contents of
+// the folder Dir (only accepted from the node's machine) if it is given and
+// the Keywords if they are not null
+type UpdateRequest struct {
+	Dir      string   `json:"dir,omitempty"`
+	Keywords []string `json:"keywords"`
+}
+
+// UnlockRequest decrypts the key of a website so that it can be updated
+type UnlockRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// ExportRequest seals the identity of an unlocked website with Passphrase
+type ExportRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// EditorKeyRequest creates the key with which the node will edit a website
+type EditorKeyRequest struct {
+	Algorithm  string `json:"algorithm,omitempty"`
+	Passphrase string `json:"passphrase"`
+}
+
+// EditorKey is the public key created by an EditorKeyRequest, to be sent to
+// the owner of the website
+type EditorKey struct {
+	Key string `json:"key"`
+}
+
+// DelegationRequest allows an editor key to update an unlocked website until
+// an optional Expiry formatted as YYYY-MM-DD, or removes that permission
+type DelegationRequest struct {
+	EditorKey string `json:"editor_key"`
+	Expiry    string `json:"expiry,omitempty"`
+}
+
+// RotateRequest moves an unlocked website to a new key, created with
+// Algorithm and encrypted with Passphrase, revoking the old one if Revoke is
+// set
+type RotateRequest struct {
+	Algorithm  string `json:"algorithm,omitempty"`
+	Passphrase string `json:"passphrase"`
+	Revoke     bool   `json:"revoke"`
+}
+
+// RevocationRequest revokes a former owner key or an editor key of an
+// unlocked website
+type RevocationRequest struct {
+	Key string `json:"key"`
+}
+
+// Imported is the name of the website whose identity bundle was imported
+type Imported struct {
+	Name string `json:"name"`
+}
+
+// Bandwidth holds the upload and download caps in KB/s by website name, the
+// global caps being under the empty name and 0 meaning no cap
+type Bandwidth struct {
+	Upload   map[string]int `json:"upload"`
+	Download map[string]int `json:"download"`
+}
+
+// BandwidthRequest changes the caps in KB/s of the website Name, or the global
+// ones if it is empty, a null cap being left unchanged and 0 removing the cap
+type BandwidthRequest struct {
+	Name     string `json:"name,omitempty"`
+	Upload   *int   `json:"upload"`
+	Download *int   `json:"download"`
+}
+
+// -----------
+// - Structs -
+// -----------
+
+// Client talks to the control API of a running node, authenticated by the
+// node's Token
+type Client struct {
+	URL   string
+	Token string
+	HTTP  *http.Client
+}
+
+// ----------------
+// - Constructors -
+// ----------------
+
+// NewClient constructs a Client for the node whose UI listens on addr
+// (IP:PORT) with its token
+func NewClient(addr, token string) *Client {
+	return &Client{
+		URL:   "http://" + addr,
+		Token: token,
+		HTTP:  &http.Client{},
+	}
+}
+
+// LoadToken reads the token of a node from the file at path
+func LoadToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("empty token in " + path)
+	}
+	return token, nil
+}
+
+// LoadOrCreateToken reads the token of a node from the file at path, creating
+// a random one readable only by the user if it does not exist
+func LoadOrCreateToken(path string) (string, error) {
+	token, err := LoadToken(path)
+	if err == nil || !os.IsNotExist(err) {
+		return token, err
+	}
+
+	token, err = NewToken()
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(path, []byte(token+"\n"), 0600)
+	return token, err
+}
+
+// NewToken returns a random token as a hex string
+func NewToken() (string, error) {
+	b := make([]byte, tokenSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// -----------
+// - Methods -
+// -----------
+
+// Status returns the status of the node
+func (c *Client) Status() (*Status, error) {
+	status := &Status{}
+	err := c.do("GET", "/status", nil, status)
+	return status, err
+}
+
+// Sites lists the websites known by the node
+func (c *Client) Sites() ([]Site, error) {
+	var sites []Site
+	err := c.do("GET", "/sites", nil, &sites)
+	return sites, err
+}
+
+// Search returns the websites matching the keywords
+func (c *Client) Search(keywords string) ([]Site, error) {
+	var sites []Site
+	err := c.do("GET", "/sites?q="+url.QueryEscape(keywords), nil, &sites)
+	return sites, err
+}
+
+// Peers lists the peers known by the node
+func (c *Client) Peers() ([]Peer, error) {
+	var peers []Peer
+	err := c.do("GET", "/peers", nil, &peers)
+	return peers, err
+}
+
+// Publish shares a new website
+func (c *Client) Publish(req *PublishRequest) (*Site, error) {
+	site := &Site{}
+	err := c.do("POST", "/sites", req, site)
+	return site, err
+}
+
+// Update unlocks the key of a website with passphrase, publishes a new
+// version and locks the key again, a key which was already unlocked being
+// left unlocked
+func (c *Client) Update(name string, req *UpdateRequest, passphrase []byte) (site *Site, err error) {
+	path := "/sites/" + url.PathEscape(name)
+	site = &Site{}
+	err = c.do("GET", path, nil, site)
+	if err != nil {
+		return nil, err
+	}
+
+	if !site.Unlocked {
+		err = c.do("POST", path+"/unlock", &UnlockRequest{string(passphrase)}, nil)
+		if err != nil {
+			return nil, err
+		}
+		// the key is not left unlocked on the node
+		defer func() {
+			lockErr := c.do("POST", path+"/lock", nil, nil)
+			if err == nil && lockErr != nil {
+				err = errors.New("website updated but its key was not locked again: " + lockErr.Error())
+			}
+		}()
+	}
+
+	err = c.do("PUT", path, req, site)
+	return site, err
+}
+
+// Fetch retrieves a website from its seeders and waits for it to be available
+// on the node
+func (c *Client) Fetch(name string) (*Site, error) {
+	site := &Site{}
+	err := c.do("POST", "/sites/"+url.PathEscape(name)+"/fetch", nil, site)
+	return site, err
+}
+
+// do sends a request with the JSON document in to the path of the control API
+// and decodes the answer into out if it is not nil
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequest(method, c.URL+APIPrefix+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Header.Set("Authorization", "Bearer "+c.Token)
+
+	resp, err := c.HTTP.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var e ErrorBody
+		if json.Unmarshal(data, &e) != nil || e.Error.Message == "" {
+			return errors.New(resp.Status)
+		}
+		return errors.New(e.Error.Message)
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,65 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// ---------
+// - Tests -
+// ---------
+
+func TestClientUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		unlocked bool
+		failing  string
+		calls    []string
+		err      string
+	}{
+		{"locked key", false, "", []string{"GET", "POST unlock", "PUT", "POST lock"}, ""},
+		{"unlocked key", true, "", []string{"GET", "PUT"}, ""},
+		{"wrong passphrase", false, "unlock", []string{"GET", "POST unlock"}, "unlock failed"},
+		{"failed update", false, "PUT", []string{"GET", "POST unlock", "PUT", "POST lock"}, "PUT failed"},
+		{"failed lock", false, "lock", []string{"GET", "POST unlock", "PUT", "POST lock"}, "not locked again: lock failed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls []string
+			server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				call := request.Method
+				if request.Method == "POST" {
+					call += " " + request.URL.Path[strings.LastIndex(request.URL.Path, "/")+1:]
+				}
+				calls = append(calls, call)
+
+				if failing := strings.TrimPrefix(call, "POST "); failing == test.failing {
+					writer.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(writer).Encode(ErrorBody{Error: Error{Message: failing + " failed"}})
+					return
+				}
+				if call == "GET" || call == "PUT" {
+					json.NewEncoder(writer).Encode(Site{Name: "site", Unlocked: test.unlocked})
+					return
+				}
+				writer.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+
+			client := &Client{URL: server.URL, HTTP: server.Client()}
+			_, err := client.Update("site", &UpdateRequest{}, []byte("secret"))
+			if test.err == "" && err != nil {
+				t.Errorf("Update() = %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("Update() = %v, want an error containing %q", err, test.err)
+			}
+			if strings.Join(calls, ", ") != strings.Join(test.calls, ", ") {
+				t.Errorf("calls = %v, want %v", calls, test.calls)
+			}
+		})
+	}
+}
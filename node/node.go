@@ -3,17 +3,23 @@ package node
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"io/ioutil"
+	"errors"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/yaanst/W2P/comm"
+	"github.com/yaanst/W2P/config"
 	"github.com/yaanst/W2P/structs"
 	"github.com/yaanst/W2P/utils"
+	"github.com/yaanst/W2P/w2pcrypto"
 )
 
 // -----------
@@ -24,73 +30,148 @@ import (
 // send messages etc...
 type Node struct {
 	Name         string
+	Config       *config.Config
+	ID           string
 	Addr         *structs.Peer
 	Conn         *net.UDPConn
 	Peers        *structs.Peers
-	HBCounter    *structs.Counter
+	Members      *structs.Membership
 	RoutingTable *structs.RoutingTable
 	WebsiteMap   *structs.WebsiteMap
+	Keyring      *w2pcrypto.Keyring
+	Identity     *w2pcrypto.PrivateKey
+	Sessions     *comm.Sessions
+	Requests     *comm.Requests
+
+	// Relaying is set when the node forwards traffic for nodes behind a NAT,
+	// which are in Relayed
+	Relaying bool
+	Relayed  *structs.Peers
+
+	// Limits are the rate limits of the requests of each peer, and Bans the
+	// peers which sent invalid data
+	Limits *structs.TokenBuckets
+	Bans   *structs.Bans
+
+	// Upload and Download cap the transfer rates of pieces
+	Upload   *structs.Bandwidth
+	Download *structs.Bandwidth
+
+	introductions sync.Map
+	retrieving    sync.Map
+	work          chan func()
 }
 
 // ----------------
 // - Constructors -
 // ----------------
 
-// NewNode construct a fresh new Node (enmpty rt and no wm)
-func NewNode(name, addrString, peersString string) *Node {
-	addr := structs.ParsePeer(addrString)
-	peers := structs.ParsePeers(peersString)
+// NewNode construct a fresh new Node (enmpty rt and no wm) from its Config
+func NewNode(cfg *config.Config) *Node {
+	addr := structs.ParsePeer(cfg.Addr)
+	peers := structs.ParsePeers(cfg.Peers)
 	rt := structs.NewRoutingTable()
 	wm := structs.NewWebsiteMap()
-	hbCounter := structs.NewCounter()
 
-	connAddr := net.UDPAddr(*addr)
-	conn, err := net.ListenUDP("udp4", &connAddr)
+	// the identity is created before the other files of the node
+	err := os.MkdirAll(filepath.Dir(utils.IdentityFile), 0700)
 	utils.CheckError(err)
 
-	conn.SetReadBuffer(utils.ConnBufferSize)
-	conn.SetWriteBuffer(utils.ConnBufferSize)
+	identity, err := w2pcrypto.LoadOrCreateIdentity(utils.IdentityFile)
+	utils.CheckError(err)
+	addr.ID = identity.Public().ID()
+
+	// listening on an unspecified address ("0.0.0.0" or "::") is dual-stack
+	conn, err := net.ListenUDP("udp", addr.Addr)
+	utils.CheckError(err)
+
+	conn.SetReadBuffer(cfg.ConnBufferSize)
+	conn.SetWriteBuffer(cfg.ConnBufferSize)
 
 	return &Node{
-		Name:         name,
+		Name:         cfg.Name,
+		Config:       cfg,
+		ID:           addr.ID,
 		Addr:         addr,
 		Conn:         conn,
 		Peers:        peers,
-		HBCounter:    hbCounter,
+		Members:      structs.NewMembership(),
 		RoutingTable: rt,
 		WebsiteMap:   wm,
+		Keyring:      w2pcrypto.NewKeyring(),
+		Identity:     identity,
+		Sessions:     comm.NewSessions(identity),
+		Requests:     comm.NewRequests(),
+		Relayed:      structs.NewPeers(),
+		Limits:       structs.NewTokenBuckets(cfg.PeerRate, cfg.PeerBurst),
+		Bans:         structs.NewBans(),
+		Upload:       structs.NewBandwidth(cfg.Upload * 1000),
+		Download:     structs.NewBandwidth(cfg.Download * 1000),
+		Relaying:     cfg.Relay,
+		work:         make(chan func(), cfg.WorkQueueSize),
 	}
 }
 
-// NewConnAndPeer creates a new connection on a free port in the range given
-// as well as the peer for this connection
-func NewConnAndPeer(ip net.IP, port, maxPort int) (*net.UDPConn, *structs.Peer) {
-	// to avoid conflict when creating a new node on same machine
-	minPort := port + 100
+// -----------
+// - Methods -
+// -----------
 
-	tempPeer := &structs.Peer{
-		IP:   ip,
-		Port: minPort,
+// Send sends a message to the Peer at via (via is NOT final destination),
+// establishing a session with via first if needed
+func (n *Node) Send(message *comm.Message, via *structs.Peer) error {
+	session, err := n.dial(via, n.Config.HandshakeTimeout.Duration)
+	if err != nil {
+		return err
 	}
-	lAddr := net.UDPAddr(*tempPeer)
 
-	conn, err := net.ListenUDP("udp4", &lAddr)
+	return message.Send(n.Conn, n.Sessions, session, via)
+}
 
-	for err != nil {
-		tempPeer.Port++
-		if tempPeer.Port > maxPort {
-			tempPeer.Port = minPort
-		}
-		lAddr := net.UDPAddr(*tempPeer)
-		conn, err = net.ListenUDP("udp4", &lAddr)
+// Request sends a request to the Peer at via and waits at most timeout for
+// the answer, which Listen delivers
+func (n *Node) Request(message *comm.Message, via *structs.Peer, timeout time.Duration) (*comm.Message, error) {
+	id, answer := n.Requests.Add(message.Dest)
+	defer n.Requests.Remove(id)
+	message.RequestID = id
+
+	err := n.Send(message, via)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-answer:
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, errors.New("no answer from " + message.Dest.String())
 	}
+}
 
-	return conn, tempPeer
+// dial returns the session with the Peer at via, doing the handshake if needed
+func (n *Node) dial(via *structs.Peer, timeout time.Duration) (*comm.Session, error) {
+	session, err := n.Sessions.Dial(via, func(p *comm.Packet) {
+		comm.SendPacket(n.Conn, p, via)
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// whoever answers at the address has to be the node we expect there
+	if via.ID != "" && session.PeerKey.ID() != via.ID {
+		return nil, errors.New(via.String() + " is not the expected node")
+	}
+	return session, nil
 }
 
-// -----------
-// - Methods -
-// -----------
+// route returns the Peer through which to send to dest, at the latest address
+// known for it
+func (n *Node) route(dest *structs.Peer) *structs.Peer {
+	via := n.RoutingTable.Get(dest)
+	if known := n.Peers.Get(via); known != nil {
+		via = known
+	}
+	return via
+}
 
 // Init initialize a Node adding website already present on disk and checking
 // wether we have their metadata, also checking every dir is present
@@ -131,143 +212,725 @@ func (n *Node) AddWebsite(name string) {
 	log.Println("[WEBSITES]\tLoading website '" + name + "'")
 	website := structs.LoadWebsite(name)
 
+	// Metadata written before algorithm agility: record the legacy algorithm
+	if website.KeyAlgorithm == "" {
+		log.Println("[WEBSITES]\t\tUpgrading metadata of legacy website '" + name + "'")
+		website.KeyAlgorithm = website.Algorithm()
+		website.SaveMetadata()
+	}
+
+	// the node may have restarted on another address
+	if website.Seeders.Contains(n.Addr) {
+		website.AddSeeder(n.Addr)
+	}
+
 	n.WebsiteMap.Set(website)
 	log.Println("[WEBSITES]\tSuccesfully loaded website '" + name + "' !")
 }
 
 // AddNewWebsite constructs a new website that has no metadatafile and adds
-// it to the WebsiteMap
-func (n *Node) AddNewWebsite(name string, keywords []string) {
+// it to the WebsiteMap, its key pair being created with the given algorithm
+// and stored encrypted with the passphrase
+func (n *Node) AddNewWebsite(name string, keywords []string, alg w2pcrypto.Algorithm, passphrase []byte) error {
 	log.Println("[WEBSITES]\tAdding new website '" + name + "'")
-	website := structs.NewWebsite(name, keywords)
 
-	if website != nil && website.Owned() {
-		log.Println("[WEBSITES]\t\tSigning website '" + name + "'")
-		website.Sign()
+	// the folder is checked before a key is created for it, which never
+	// replaces an existing one such as an editor key
+	if info, err := os.Stat(utils.WebsiteDir + name); err != nil || !info.IsDir() {
+		return errors.New("no folder '" + name + "' in the websites")
+	}
+	if _, err := os.Stat(utils.KeyDir + name); err == nil {
+		return errors.New("a key already exists for website '" + name + "'")
+	}
+
+	privKey, pubKey := w2pcrypto.CreateKey(alg)
+	err := privKey.Save(name, passphrase)
+	if err != nil {
+		return err
+	}
+	n.Keyring.Set(name, privKey)
+
+	website := structs.NewWebsite(name, keywords, pubKey)
+	err = n.bundleWebsite(website, privKey)
+	if err != nil {
+		n.Keyring.Lock(name)
+		os.Remove(utils.KeyDir + name)
+		return err
+	}
+	website.SignUpdate(privKey)
+	website.Seeders.Add(n.Addr)
+
+	log.Println("[WEBSITES]\t\tSaving Metadata for website '" + name + "'")
+	website.SaveMetadata()
+
+	n.WebsiteMap.Set(website)
+	log.Println("[WEBSITES]\tSuccesfully added website '" + name + "' !")
 
-		log.Println("[WEBSITES]\t\tBundling website '" + name + "'")
-		website.Bundle()
+	return nil
+}
 
-		log.Println("[WEBSITES]\t\tGenerating pieces for website '" + name + "'")
-		website.GenPieces(utils.DefaultPieceLength)
-		website.Seeders.Add(n.Addr)
+// bundleWebsite signs the manifest of a website with privKey, then bundles
+// it and generates its pieces
+func (n *Node) bundleWebsite(website *structs.Website, privKey *w2pcrypto.PrivateKey) error {
+	log.Println("[WEBSITES]\t\tSigning website '" + website.Name + "'")
+	err := website.Sign(privKey)
+	if err != nil {
+		return err
+	}
 
-		log.Println("[WEBSITES]\t\tSaving Metadata for website '" + name + "'")
+	log.Println("[WEBSITES]\t\tBundling website '" + website.Name + "'")
+	err = website.Bundle()
+	if err != nil {
+		return err
+	}
+
+	log.Println("[WEBSITES]\t\tGenerating pieces for website '" + website.Name + "'")
+	return website.GenPieces(n.Config.PieceLength)
+}
+
+// PublishWebsite copies the folder dir in the WebsiteDir as the website name
+// and adds it as a new website with AddNewWebsite
+func (n *Node) PublishWebsite(dir, name string, keywords []string, alg w2pcrypto.Algorithm, passphrase []byte) error {
+	if !utils.ValidName(name) {
+		return errors.New("invalid website name '" + name + "'")
+	}
+	if n.WebsiteMap.Get(name) != nil {
+		return errors.New("website '" + name + "' already exists")
+	}
+	if _, err := os.Stat(utils.KeyDir + name); err == nil {
+		return errors.New("a key already exists for website '" + name + "'")
+	}
+
+	target := utils.WebsiteDir + name
+	if !samePath(dir, target) {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return errors.New("'" + dir + "' is not a folder")
+		}
+		if _, err := os.Stat(target); err == nil {
+			return errors.New("folder '" + name + "' already exists in the websites")
+		}
+
+		log.Println("[WEBSITES]\tCopying '" + dir + "' to website '" + name + "'")
+		err := utils.CopyDir(dir, target)
+		if err != nil {
+			os.RemoveAll(target)
+			return err
+		}
+	}
+
+	return n.AddNewWebsite(name, keywords, alg, passphrase)
+}
+
+// UnlockWebsite decrypts the private key (owner's or delegated editor's) of a
+// website with the passphrase so that it can be updated
+func (n *Node) UnlockWebsite(name string, passphrase []byte) error {
+	website := n.WebsiteMap.Get(name)
+	if website == nil || !website.Owned() {
+		return errors.New("website '" + name + "' is not owned")
+	}
+
+	// the key is checked before a legacy key file is encrypted again
+	err := n.Keyring.Unlock(name, passphrase, func(pubKey *w2pcrypto.PublicKey) error {
+		if pubKey.String() != website.PubKey.String() && !website.Delegated(pubKey) {
+			return errors.New("key is neither the owner's nor delegated for website '" + name + "'")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// websites published before versions were signed are refused by other
+	// nodes until their owner signs them
+	privKey := n.Keyring.Get(name)
+	if website.Signer == nil && privKey.Public().String() == website.PubKey.String() {
+		log.Println("[WEBSITES]\t\tSigning current version of website '" + name + "'")
+		website.SignUpdate(privKey)
 		website.SaveMetadata()
+	}
 
-		n.WebsiteMap.Set(website)
-		log.Println("[WEBSITES]\tSuccesfully added website '" + name + "' !")
+	log.Println("[WEBSITES]\tUnlocked website '" + name + "'")
+	return nil
+}
+
+// LockWebsite forgets the decrypted private key of a website
+func (n *Node) LockWebsite(name string) {
+	n.Keyring.Lock(name)
+	log.Println("[WEBSITES]\tLocked website '" + name + "'")
+}
+
+// CreateEditorKey creates the key with which this node will edit a website
+// once the owner delegates it, the key is stored encrypted with passphrase
+func (n *Node) CreateEditorKey(name string, alg w2pcrypto.Algorithm, passphrase []byte) (*w2pcrypto.PublicKey, error) {
+	if !utils.ValidName(name) {
+		return nil, errors.New("invalid website name '" + name + "'")
 	}
+	if _, err := os.Stat(utils.KeyDir + name); err == nil {
+		return nil, errors.New("a key already exists for website '" + name + "'")
+	}
+
+	privKey, pubKey := w2pcrypto.CreateKey(alg)
+	err := privKey.Save(name, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	n.Keyring.Set(name, privKey)
+
+	log.Println("[WEBSITES]\tCreated editor key for website '" + name + "'")
+	return pubKey, nil
+}
+
+// DelegateWebsite allows an editor key to update an unlocked website owned by
+// this node until expiry (0 for no expiry) and publishes the delegation
+func (n *Node) DelegateWebsite(name string, editorKey *w2pcrypto.PublicKey, expiry int64) error {
+	website := n.WebsiteMap.Get(name)
+	privKey := n.Keyring.Get(name)
+	if website == nil || privKey == nil {
+		return errors.New("website '" + name + "' is unknown or locked")
+	}
+
+	err := website.Delegate(privKey, editorKey, expiry)
+	if err != nil {
+		return err
+	}
+
+	log.Println("[WEBSITES]\tDelegated website '" + name + "' to a new editor")
+	err = n.UpdateWebsite(name, website.GetKeywords())
+	if err != nil {
+		return errors.New("could not publish delegation for website '" + name + "': " + err.Error())
+	}
+	return nil
+}
+
+// UndelegateWebsite removes the delegation of an editor key for an unlocked
+// website owned by this node and publishes the change
+func (n *Node) UndelegateWebsite(name string, editorKey *w2pcrypto.PublicKey) error {
+	website := n.WebsiteMap.Get(name)
+	privKey := n.Keyring.Get(name)
+	if website == nil || privKey == nil {
+		return errors.New("website '" + name + "' is unknown or locked")
+	}
+
+	err := website.Undelegate(privKey, editorKey)
+	if err != nil {
+		return err
+	}
+
+	log.Println("[WEBSITES]\tRemoved an editor of website '" + name + "'")
+	err = n.UpdateWebsite(name, website.GetKeywords())
+	if err != nil {
+		return errors.New("could not publish delegation for website '" + name + "': " + err.Error())
+	}
+	return nil
 }
 
 // UpdateWebsite update a Website in the WebsiteMap when user modified
-// his website
-func (n *Node) UpdateWebsite(name string, keywords []string) bool {
+// his website, the website needs to be unlocked
+func (n *Node) UpdateWebsite(name string, keywords []string) error {
 	log.Println("[WEBSITES]\tUpdating website '" + name + "'")
 	website := n.WebsiteMap.Get(name)
+	privKey := n.Keyring.Get(name)
+	if website == nil || privKey == nil {
+		return errors.New("website '" + name + "' is unknown or locked")
+	}
 
-	if website != nil && website.Owned() {
-		log.Println("[WEBSITES]\t\tClearing seeders and adding self for website '" + name + "'")
-        website.ClearSeeders()
-        website.AddSeeder(n.Addr)
+	err := n.bundleWebsite(website, privKey)
+	if err != nil {
+		return err
+	}
 
-		log.Println("[WEBSITES]\t\tRe-signing website '" + name + "'")
-		website.Sign()
+	log.Println("[WEBSITES]\t\tClearing seeders and adding self for website '" + name + "'")
+	website.ClearSeeders()
+	website.AddSeeder(n.Addr)
 
-		log.Println("[WEBSITES]\t\tOverwritting bundle of website '" + name + "'")
-		website.Bundle()
+	website.SetKeywords(keywords)
+	website.IncVersion()
+	website.SignUpdate(privKey)
 
-		website.SetKeywords(keywords)
+	log.Println("[WEBSITES]\t\tSaving new Metadata for website '" + name + "'")
+	website.SaveMetadata()
 
-		log.Println("[WEBSITES]\t\tGenerating new pieces for website '" + name + "'")
-		website.GenPieces(utils.DefaultPieceLength)
-		website.IncVersion()
+	log.Println("[WEBSITES]\tSuccesfully updated website '" + name + "' !")
+	return nil
+}
 
-		log.Println("[WEBSITES]\t\tSaving new Metadata for website '" + name + "'")
-		website.SaveMetadata()
+// CopyWebsite replaces the files of an unlocked website by the contents of
+// the folder dir, to be published with UpdateWebsite
+func (n *Node) CopyWebsite(name, dir string) error {
+	if n.WebsiteMap.Get(name) == nil || n.Keyring.Get(name) == nil {
+		return errors.New("website '" + name + "' is not unlocked")
+	}
+
+	target := utils.WebsiteDir + name
+	if samePath(dir, target) {
+		return nil
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return errors.New("'" + dir + "' is not a folder")
+	}
+
+	log.Println("[WEBSITES]\tCopying '" + dir + "' to website '" + name + "'")
+	err := os.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+	return utils.CopyDir(dir, target)
+}
+
+// RotateWebsite moves an unlocked website owned by this node to a new key of
+// the given algorithm, stored encrypted with passphrase, and publishes the
+// rotation. If revokeOld is set the old key is revoked as well
+func (n *Node) RotateWebsite(name string, alg w2pcrypto.Algorithm, passphrase []byte, revokeOld bool) error {
+	log.Println("[WEBSITES]\tRotating key of website '" + name + "' to " + string(alg))
+	website := n.WebsiteMap.Get(name)
+	oldPrivKey := n.Keyring.Get(name)
+	if website == nil || oldPrivKey == nil {
+		return errors.New("website '" + name + "' is unknown or locked")
+	}
+
+	if len(passphrase) == 0 {
+		return w2pcrypto.ErrEmptyPassphrase
+	}
+
+	// the new key is saved aside and only replaces the current one once the
+	// rotation is published, the website being restored on any error
+	newPrivKey, _ := w2pcrypto.CreateKey(alg)
+	tmpName := "." + name + ".new"
+	err := newPrivKey.Save(tmpName, passphrase)
+	if err != nil {
+		os.Remove(utils.KeyDir + tmpName)
+		return err
+	}
+
+	saved := *website
+	restore := func(err error) error {
+		*website = saved
+		n.Keyring.Set(name, oldPrivKey)
+		os.Remove(utils.KeyDir + tmpName)
+		return err
+	}
+
+	err = website.RotateKey(oldPrivKey, newPrivKey)
+	if err != nil {
+		return restore(err)
+	}
+	if revokeOld {
+		err = website.Revoke(newPrivKey, oldPrivKey.Public())
+		if err != nil {
+			return restore(err)
+		}
+	}
+
+	n.Keyring.Set(name, newPrivKey)
+	err = n.UpdateWebsite(name, website.GetKeywords())
+	if err != nil {
+		return restore(errors.New("could not publish rotation for website '" + name + "': " + err.Error()))
+	}
+
+	err = os.Rename(utils.KeyDir+tmpName, utils.KeyDir+name)
+	if err != nil {
+		return errors.New("rotated website '" + name + "' but its new key is left in '" + utils.KeyDir + tmpName + "': " + err.Error())
+	}
+	return nil
+}
+
+// RevokeKey revokes a former owner key or an editor key of an unlocked website
+// owned by this node and publishes the revocation
+func (n *Node) RevokeKey(name string, key *w2pcrypto.PublicKey) error {
+	website := n.WebsiteMap.Get(name)
+	privKey := n.Keyring.Get(name)
+	if website == nil || privKey == nil {
+		return errors.New("website '" + name + "' is unknown or locked")
+	}
+
+	err := website.Revoke(privKey, key)
+	if err != nil {
+		return err
+	}
+
+	log.Println("[WEBSITES]\tRevoked a key of website '" + name + "'")
+	err = n.UpdateWebsite(name, website.GetKeywords())
+	if err != nil {
+		return errors.New("could not publish revocation for website '" + name + "': " + err.Error())
+	}
+	return nil
+}
+
+// ExportWebsite seals the identity (metadata and key) of an unlocked website
+// into a bundle encrypted with passphrase
+func (n *Node) ExportWebsite(name string, passphrase []byte) ([]byte, error) {
+	website := n.WebsiteMap.Get(name)
+	privKey := n.Keyring.Get(name)
+	if website == nil || privKey == nil {
+		return nil, errors.New("website '" + name + "' is unknown or locked")
+	}
+
+	id, err := structs.NewIdentity(website, privKey)
+	if err != nil {
+		return nil, err
+	}
 
-		log.Println("[WEBSITES]\tSuccesfully updated website '" + name + "' !")
+	log.Println("[WEBSITES]\tExporting identity of website '" + name + "'")
+	return id.Seal(passphrase)
+}
+
+// ImportWebsite opens an identity bundle encrypted with passphrase, stores
+// the website's key encrypted with keyPassphrase so this node can update the
+// website, and retrieves the website if it is not known yet
+func (n *Node) ImportWebsite(bundle, passphrase, keyPassphrase []byte) (string, error) {
+	id, err := structs.OpenIdentity(bundle, passphrase)
+	if err != nil {
+		return "", err
+	}
 
-		return true
+	website := id.Website
+	name := website.Name
+	if !utils.ValidName(name) {
+		return "", errors.New("invalid website name '" + name + "'")
 	}
-	return false
+
+	local := n.WebsiteMap.Get(name)
+	if local != nil && local.PubKey.String() != website.PubKey.String() {
+		return "", errors.New("another website named '" + name + "' exists")
+	}
+
+	log.Println("[WEBSITES]\tImporting identity of website '" + name + "'")
+	err = id.PrivKey.Save(name, keyPassphrase)
+	if err != nil {
+		return "", err
+	}
+	n.Keyring.Set(name, id.PrivKey)
+
+	if local == nil {
+		website.KeyAlgorithm = website.Algorithm()
+		n.WebsiteMap.Set(website)
+		go n.RetrieveWebsite(name, nil)
+	}
+
+	return name, nil
 }
 
 // SendWebsiteMap shares the node's WebsiteMap with other nodes
 func (n *Node) SendWebsiteMap() {
 	for _, p := range n.Peers.GetAll() {
 		message := comm.NewMeta(n.Addr, &p, n.WebsiteMap)
-		via := n.RoutingTable.Get(p.String())
-		message.Send(n.Conn, via)
-		log.Println("[SENT]\tWebsiteMap to", p.String())
-		n.CheckPeer(&p, nil)
+		via := n.route(&p)
+
+		// still going through the relay of a peer behind a NAT: try to
+		// punch a direct path
+		if p.Relay != nil && structs.PeerEquals(via, p.Relay) && !structs.PeerEquals(p.Relay, n.Addr) {
+			go n.Introduce(&p)
+		}
+		err := n.Send(message, via)
+		if err != nil {
+			log.Println("[SENT]\tCannot send WebsiteMap to", p.String(), ":", err)
+		} else {
+			log.Println("[SENT]\tWebsiteMap to", p.String())
+		}
 	}
 }
 
-// HeartBeat sends a hearbeat message to peer and waits for an answer or timeout
-func (n *Node) HeartBeat(peer *structs.Peer, reachable chan bool) {
-	// Create a random local address for a new connection
-	conn, _ := NewConnAndPeer(n.Addr.IP, n.Addr.Port, n.Addr.Port+10000)
-	defer conn.Close()
-
+// HeartBeat sends a hearbeat message to peer and waits for an answer or
+// timeout, returning whether peer answered
+func (n *Node) HeartBeat(peer *structs.Peer) bool {
 	message := comm.NewHeartbeat(n.Addr, peer)
-	buffer := make([]byte, utils.HeartBeatBufferSize)
 
-	// Set Read timeout
-	conn.SetReadDeadline(time.Now().Add(utils.HeartBeatTimeout))
-
-	message.Send(conn, peer)
+	// peers behind a NAT are only reachable through their relay or a
+	// punched path
+	via := peer
+	if peer.Relay != nil {
+		via = n.route(peer)
+	}
 
 	log.Println("[SENT]\tHeartbeat to", peer.String())
 
-	size, err := conn.Read(buffer)
+	start := time.Now()
+	_, err := n.Request(message, via, n.Config.HeartBeatTimeout.Duration)
 	if err != nil {
-		reachable <- false
-	} else if size > 0 {
-		reachable <- true
+		return false
 	}
-	return
+	n.Members.SetRTT(peer, time.Since(start))
+	return true
 }
 
-// CheckPeer checks if peer is up and removes it from every location if not
-func (n *Node) CheckPeer(peer *structs.Peer, website *structs.Website) {
-	for n.HBCounter.Read() >= utils.HeartBeatLimit {
-		time.Sleep(100 * time.Millisecond)
+// FailureDetector probes a peer at every interval, asking other peers to
+// probe it if it does not answer, and removes the peers suspected for too long
+func (n *Node) FailureDetector(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		if peer := n.Members.Next(n.Peers); peer != nil {
+			go n.Probe(peer)
+		}
+
+		for _, peer := range n.Members.Expire(n.Config.SuspicionTimeout.Duration, n.Config.DeadMemberTimeout.Duration) {
+			log.Println("[MEMBERS]\tPeer", peer, "is dead")
+			n.RemovePeer(peer)
+		}
+
+		for _, session := range n.Sessions.Expire(n.Config.SessionTimeout.Duration) {
+			log.Println("[SESSION]\tClosing idle session with", session.Peer())
+		}
 	}
-	n.HBCounter.Inc()
-	defer n.HBCounter.Dec()
+}
 
-	c := make(chan bool)
-	go n.HeartBeat(peer, c)
+// Probe checks if peer is alive, directly then through other peers, and
+// suspects it if none of them could reach it
+func (n *Node) Probe(peer *structs.Peer) {
+	// seeders lists may hold an old address of a known peer
+	if known := n.Peers.Get(peer); known != nil {
+		peer = known
+	}
 
-	reachable := <-c
-	if !reachable {
-		log.Println("[HEARTBEAT]\tPeer", peer, "is down")
-		n.Peers.Remove(peer)
-		n.WebsiteMap.RemovePeer(peer)
-	} else {
-		log.Println("[HEARTBEAT]\tPeer", peer, "is up")
-		if !n.Peers.Contains(peer) {
-			n.Peers.Add(peer)
-			if website != nil {
-				website.AddSeeder(peer)
-			}
+	if !n.Members.StartProbe(peer) {
+		return
+	}
+	defer n.Members.EndProbe(peer)
+
+	if n.HeartBeat(peer) {
+		return
+	}
+
+	// the path between the two nodes may be the one failing
+	helpers := n.Members.Sample(n.Peers, n.Config.IndirectProbes, peer, n.Addr)
+	alive := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper *structs.Peer) {
+			message := comm.NewProbe(n.Addr, helper, peer)
+			log.Println("[SENT]\tProbe of", peer.String(), "to", helper.String())
+
+			// the helper waits for a heartbeat itself
+			reply, err := n.Request(message, n.route(helper), 2*n.Config.HeartBeatTimeout.Duration)
+			alive <- err == nil && reply.Alive
+		}(helper)
+	}
+
+	for range helpers {
+		if <-alive {
+			log.Println("[MEMBERS]\tPeer", peer, "is only reachable indirectly")
+			n.Seen(peer)
+			return
 		}
-		n.RoutingTable.Set(peer.String(), peer) // Reset RoutingTable entry
 	}
+
+	if n.Members.Suspect(peer) {
+		log.Println("[MEMBERS]\tPeer", peer, "is suspect")
+	}
+}
+
+// HandleProbe probes a peer on behalf of the node which asked for it, and
+// answers within the session the request came in
+func (n *Node) HandleProbe(request *comm.Message, session *comm.Session, sender *structs.Peer) {
+	peer := request.Probe
+	if known := n.Peers.Get(peer); known != nil {
+		peer = known
+	}
+
+	alive := structs.PeerEquals(peer, n.Addr) || n.HeartBeat(peer)
+	reply := comm.NewProbeReply(request, n.Addr, alive)
+	reply.Send(n.Conn, n.Sessions, session, sender)
 }
 
-// DiscoverPeers checks for any unknown peer in the WM in order to add them
+// Seen marks peer alive, a peer rejoining being added back to the known peers
+func (n *Node) Seen(peer *structs.Peer) {
+	if structs.PeerEquals(peer, n.Addr) {
+		return
+	}
+
+	switch n.Members.Seen(peer) {
+	case structs.PeerDead:
+		log.Println("[MEMBERS]\tPeer", peer, "joined")
+		n.AddPeer(peer)
+	case structs.PeerSuspect:
+		log.Println("[MEMBERS]\tPeer", peer, "is alive again")
+	}
+}
+
+// AddPeer adds peer to the known peers or updates it, the peers with the
+// lowest score being evicted beyond the MaxPeers of the Config, and returns false if peer
+// itself was not kept
+func (n *Node) AddPeer(peer *structs.Peer) bool {
+	if n.Bans.Banned(peer) {
+		return false
+	}
+	n.Peers.Add(peer)
+
+	kept := true
+	for _, p := range n.Peers.Bound(n.Config.MaxPeers, n.Members.Score, n.keepPeer) {
+		if structs.PeerEquals(p, peer) {
+			kept = false
+			continue
+		}
+		log.Println("[MEMBERS]\tEvicting peer", p)
+		n.Members.Forget(p)
+	}
+	return kept
+}
+
+// keepPeer tells if peer must never be evicted: the relay of the node and the
+// nodes it relays for
+func (n *Node) keepPeer(peer *structs.Peer) bool {
+	return (n.Addr.Relay != nil && structs.PeerEquals(peer, n.Addr.Relay)) || n.Relayed.Contains(peer)
+}
+
+// BoundSeeders keeps at most the MaxSeeders of the Config as seeders for website, evicting
+// the ones with the lowest score, the node itself being always kept
+func (n *Node) BoundSeeders(website *structs.Website) {
+	website.Seeders.Bound(n.Config.MaxSeeders, n.Members.Score, func(p *structs.Peer) bool {
+		return structs.PeerEquals(p, n.Addr)
+	})
+}
+
+// BoundSessions keeps at most the MaxSessions of the Config, evicting the ones
+// of the peers with the lowest score
+func (n *Node) BoundSessions() {
+	for _, session := range n.Sessions.Bound(n.Config.MaxSessions, n.Members.Score, n.keepPeer) {
+		log.Println("[SESSION]\tEvicting session with", session.Peer())
+	}
+}
+
+// RemovePeer removes a dead peer from every location
+func (n *Node) RemovePeer(peer *structs.Peer) {
+	n.Sessions.Remove(peer)
+	n.Peers.Remove(peer)
+	n.WebsiteMap.RemovePeer(peer)
+}
+
+// ExchangePeers exchanges a sample of the known live peers with a random peer
+// at every interval, starting right away to bootstrap the peer set
+func (n *Node) ExchangePeers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for ; true; <-ticker.C {
+		sample := n.Members.Sample(n.Peers, 1, n.Addr)
+		if len(sample) == 0 {
+			continue
+		}
+		peer := sample[0]
+
+		message := comm.NewPex(n.Addr, peer, n.PeerSample(peer))
+		reply, err := n.Request(message, n.route(peer), n.Config.HeartBeatTimeout.Duration)
+		if err != nil || reply.Pex == nil {
+			log.Println("[PEX]\tNo peers from " + peer.String())
+			continue
+		}
+		log.Println("[PEX]\tPeers from " + peer.String())
+		n.MergePeers(reply.Pex.Peers)
+	}
+}
+
+// PeerSample returns a sample of the known live peers to send to peer
+func (n *Node) PeerSample(peer *structs.Peer) []*structs.Peer {
+	var sample []*structs.Peer
+	for _, p := range n.Members.Sample(n.Peers, n.Config.PexSize, peer, n.Addr) {
+		// peers known by their address only might be anything
+		if p.ID != "" {
+			sample = append(sample, p)
+		}
+	}
+	return sample
+}
+
+// MergePeers adds the unknown peers received in a peer exchange, the
+// addresses of known peers being only learnt from the peers themselves
+func (n *Node) MergePeers(peers []*structs.Peer) {
+	for _, p := range peers {
+		if p == nil || p.ID == "" || p.Addr == nil || structs.PeerEquals(p, n.Addr) {
+			continue
+		}
+		if !n.Peers.Contains(p) && n.Members.State(p) != structs.PeerDead && n.AddPeer(p) {
+			log.Println("[PEX]\tNew peer " + p.String())
+		}
+	}
+}
+
+// DiscoverLAN announces the node on the local network at every interval and
+// adds the nodes announcing themselves there to the peers
+func (n *Node) DiscoverLAN(interval time.Duration) {
+	group, err := net.ResolveUDPAddr("udp4", n.Config.LANGroup)
+	utils.CheckError(err)
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Println("[LAN]\tCannot join " + n.Config.LANGroup + ": " + err.Error())
+		return
+	}
+	defer conn.Close()
+
+	go n.announce(group, interval)
+
+	buffer := make([]byte, n.Config.ListenBufferSize)
+	for {
+		size, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			log.Println("[LAN]\tStopped listening: " + err.Error())
+			return
+		}
+		n.handleAnnounce(buffer[:size], from)
+	}
+}
+
+// handleAnnounce adds the node which multicast the Announce b, received from
+// the address from, to the peers
+func (n *Node) handleAnnounce(b []byte, from *net.UDPAddr) {
+	announce, err := comm.DecodeAnnounce(b)
+	if err != nil || announce.Network != utils.LANNetwork || announce.ID == n.ID {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", announce.Addr)
+	if err != nil {
+		return
+	}
+	// a node listening on all its addresses is where the announce came from
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = from.IP
+	}
+
+	// the session handshake checks the ID
+	peer := structs.NewPeer(announce.ID, addr)
+	if !n.Peers.Contains(peer) && n.Members.State(peer) != structs.PeerDead && n.AddPeer(peer) {
+		log.Println("[LAN]\tNew peer " + peer.String())
+	}
+}
+
+// announce multicasts the node's Announce to group at every interval
+func (n *Node) announce(group *net.UDPAddr, interval time.Duration) {
+	conn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		log.Println("[LAN]\tCannot announce on " + group.String() + ": " + err.Error())
+		return
+	}
+	defer conn.Close()
+
+	b, err := comm.EncodeAnnounce(&comm.Announce{
+		Network: utils.LANNetwork,
+		ID:      n.ID,
+		Addr:    n.Addr.String(),
+	})
+	utils.CheckError(err)
+
+	ticker := time.NewTicker(interval)
+	for ; true; <-ticker.C {
+		_, err := conn.Write(b)
+		if err != nil {
+			log.Println("[LAN]\tCannot announce on " + group.String() + ": " + err.Error())
+		}
+	}
+}
+
+// DiscoverPeers checks for any unknown peer in the WM in order to add them,
+// dead peers being only added back when they rejoin
 func (n *Node) DiscoverPeers(w *structs.Website) {
 	for _, s := range w.GetSeeders() {
-		if !n.Peers.Contains(&s) && !structs.PeerEquals(&s, n.Addr) {
-			n.Peers.Add(&s)
+		if !n.Peers.Contains(&s) && !structs.PeerEquals(&s, n.Addr) && n.Members.State(&s) != structs.PeerDead {
+			n.AddPeer(&s)
 		}
 	}
 }
 
-// MergeWebsiteMap merges a WebsiteMap into the local one
-func (n *Node) MergeWebsiteMap(remoteWM *structs.WebsiteMap) {
+// MergeWebsiteMap merges a WebsiteMap sent by orig into the local one, orig
+// being banned if it sent invalid websites
+func (n *Node) MergeWebsiteMap(remoteWM *structs.WebsiteMap, orig *structs.Peer) {
 	localWM := n.WebsiteMap
 
 	rIndices := remoteWM.GetIndices()
@@ -277,27 +940,71 @@ func (n *Node) MergeWebsiteMap(remoteWM *structs.WebsiteMap) {
 		go n.DiscoverPeers(rWeb)
 
 		if lWeb == nil {
+			// websites published before versions were signed are refused
+			// too, anyone could have made them up
+			if !rWeb.VerifyUpdate() {
+				log.Printf("[WEBSITEMAP]\tRejecting badly signed website '%v'\n", rWeb.Name)
+				n.Ban(orig)
+				continue
+			}
+
 			log.Printf("[WEBSITEMAP]\tAdding website '%v'\n", rWeb.Name)
+			n.BoundSeeders(rWeb)
 			localWM.Set(rWeb)
-			n.RetrieveWebsite(rWeb.Name)
-		} else if lWeb.PubKey.String() != rWeb.PubKey.String() {
-			log.Fatalf("[WEBSITEMAP]\tPublic keys not matching for local/remote website %v\n", lWeb.Name)
+			go n.RetrieveWebsite(rWeb.Name, orig)
 		} else {
+			if rWeb.PubKey == nil || lWeb.PubKey.String() != rWeb.PubKey.String() {
+				// a rotation is only adopted with a valid new version
+				if !lWeb.VerifyNewVersion(rWeb) {
+					log.Printf("[WEBSITEMAP]\tPublic keys not matching for local/remote website %v\n", lWeb.Name)
+					continue
+				}
+
+				log.Printf("[WEBSITEMAP]\tWebsite '%v' rotated to a new %v key\n", lWeb.Name, rWeb.KeyAlgorithm)
+				lWeb.PubKey = rWeb.PubKey
+				lWeb.KeyAlgorithm = rWeb.KeyAlgorithm
+				lWeb.Rotations = rWeb.Rotations
+				lWeb.Revocations = rWeb.Revocations
+			} else if lWeb.MergeRevocations(rWeb.Revocations) {
+				// revocations spread even without a new version, and are
+				// merged first so that the new version is checked against
+				// them
+				log.Printf("[WEBSITEMAP]\tNew revoked keys for website '%v'\n", lWeb.Name)
+				lWeb.SaveMetadata()
+			}
 
-			// make a diff function
+			// seeders known remotely only, unless they are known to be dead
 			diffSeeders := lWeb.DiffSeeders(rWeb)
 			for _, s := range diffSeeders {
-				go n.CheckPeer(s, lWeb)
+				if !lWeb.Seeders.Contains(s) && n.Members.State(s) != structs.PeerDead {
+					lWeb.AddSeeder(s)
+				}
 			}
+			n.BoundSeeders(lWeb)
 
 			if rWeb.Version > lWeb.Version {
+				// only the owner or a delegated editor can publish a version,
+				// with the latest delegations
+				if !lWeb.VerifyNewVersion(rWeb) {
+					log.Printf("[WEBSITEMAP]\tRejecting invalid update of website '%v'\n", lWeb.Name)
+					n.Ban(orig)
+					continue
+				}
+
 				log.Print("[WEBSITEMAP]\tUpdating website '" + lWeb.Name + "'")
 				lWeb.Version = rWeb.Version
 				lWeb.SetKeywords(rWeb.GetKeywords())
 				lWeb.Pieces = rWeb.Pieces
-                lWeb.Seeders = rWeb.Seeders
-
-				n.RetrieveWebsite(rWeb.Name)
+				lWeb.PieceLength = rWeb.PieceLength
+				lWeb.Seeders = rWeb.Seeders
+				n.BoundSeeders(lWeb)
+				lWeb.Delegations = rWeb.Delegations
+				lWeb.DelegationSeq = rWeb.DelegationSeq
+				lWeb.DelegationSignature = rWeb.DelegationSignature
+				lWeb.Signer = rWeb.Signer
+				lWeb.Signature = rWeb.Signature
+
+				go n.RetrieveWebsite(rWeb.Name, orig)
 			}
 		}
 	}
@@ -305,47 +1012,139 @@ func (n *Node) MergeWebsiteMap(remoteWM *structs.WebsiteMap) {
 
 // Listen listens for messages from other peers and acts on them
 func (n *Node) Listen() {
-	buffer := make([]byte, utils.ListenBufferSize)
+	buffer := make([]byte, n.Config.ListenBufferSize)
 
 	log.Println("[LISTENING]\ton", n.Addr.String())
 
+	for i := 0; i < n.Config.Workers; i++ {
+		go n.worker()
+	}
+
 	for {
-		_, senderAddr, err := n.Conn.ReadFromUDP(buffer)
-		sender := structs.ParsePeer(senderAddr.String())
+		size, senderAddr, err := n.Conn.ReadFromUDP(buffer)
 		utils.CheckError(err)
+		sender := structs.NewPeer("", senderAddr)
+
+		if n.Bans.Banned(sender) {
+			continue
+		}
+
+		packet, err := comm.DecodePacket(buffer[:size])
+		if err != nil {
+			log.Println("[DROP]\tMalformed packet from " + sender.String())
+			continue
+		}
+
+		// handshakes are limited by the address they come from, their peer
+		// being authenticated only once they are done
+		if (packet.Init != nil || packet.Resp != nil) && !n.Limits.Allow(sender.Key()) {
+			log.Println("[DROP]\tToo many handshakes from " + sender.String())
+			continue
+		}
 
-		message := comm.DecodeMessage(buffer)
+		// Handshakes
+		if packet.Init != nil {
+			reply, err := n.Sessions.HandleInit(packet.Init, sender)
+			if err != nil {
+				log.Println("[DROP]\tHandshake from " + sender.String() + ": " + err.Error())
+				continue
+			}
+			comm.SendPacket(n.Conn, reply, sender)
+			log.Println("[SESSION]\tEstablished with " + sender.String())
+			n.BoundSessions()
+			continue
+		} else if packet.Resp != nil {
+			err := n.Sessions.HandleResp(packet.Resp)
+			if err != nil {
+				log.Println("[DROP]\tHandshake from " + sender.String() + ": " + err.Error())
+			}
+			continue
+		}
+
+		message, session, err := n.Sessions.Open(packet)
+		if err != nil {
+			log.Println("[DROP]\tPacket from " + sender.String() + ": " + err.Error())
+			continue
+		}
+		sender.ID = session.PeerKey.ID()
 		orig := message.Orig
 		dest := message.Dest
 
-		if !n.Peers.Contains(orig) {
-			n.Peers.Add(orig)
+		if n.Bans.Banned(sender) || n.Bans.Banned(orig) {
+			continue
 		}
 
-		// Forward message
-		if !structs.PeerEquals(dest, n.Addr) {
-			via := n.RoutingTable.Get(dest.String())
-			message.Send(n.Conn, via)
+		// answers are limited by the requests of this node
+		if !message.Reply && !n.Limits.Allow(sender.Key()) {
+			log.Println("[DROP]\tToo many requests from " + sender.String())
+			continue
 		}
 
-		// Update RoutingTable
-		if !structs.PeerEquals(orig, sender) && n.Peers.Contains(sender) {
-			n.RoutingTable.Set(orig.String(), sender)
+		// the hop's main connection, seen at its public address if it is
+		// behind a NAT
+		hop := structs.NewPeer(sender.ID, session.Addr.Addr)
+
+		// also updates the address of a known peer
+		if structs.PeerEquals(orig, sender) {
+			n.AddPeer(&structs.Peer{ID: orig.ID, Addr: hop.Addr, Relay: orig.Relay})
 		} else {
-			n.RoutingTable.Set(orig.String(), orig)
+			n.AddPeer(orig)
+		}
+
+		// any authenticated message shows that its origin is alive
+		if n.Peers.Contains(orig) {
+			n.Seen(orig)
 		}
 
-		// HeartBeat
-		if message.Meta == nil && message.Data == nil {
+		// Update RoutingTable
+		n.RoutingTable.Set(orig, hop)
+
+		// Forward message (no ID: the sender only knew our address)
+		if dest.ID != "" && !structs.PeerEquals(dest, n.Addr) {
+			via := n.route(dest)
+			n.handle(func() { n.Send(message, via) })
+			continue
+		}
+
+		// NAT traversal
+		if message.Nat != nil {
+			n.handle(func() { n.HandleNat(message, hop) })
+
+			// Answer to a request of this node
+		} else if message.Reply {
+			if !n.Requests.Deliver(message) {
+				log.Println("[DROP]\tUnexpected or late answer from " + orig.String())
+			}
+
+			// Peer exchange
+		} else if message.Pex != nil {
+			log.Println("[RECEIVE]\tPeers from " + orig.String())
+			n.MergePeers(message.Pex.Peers)
+			reply := comm.NewPexReply(message, n.Addr, n.PeerSample(orig))
+			reply.Send(n.Conn, n.Sessions, session, sender)
+
+			// Indirect probe
+		} else if message.Probe != nil {
+			log.Println("[RECEIVE]\tProbe of " + message.Probe.String() + " from " + orig.String())
+			n.handle(func() { n.HandleProbe(message, session, sender) })
+
+			// HeartBeat
+		} else if message.Meta == nil && message.Data == nil {
 			log.Println("[RECEIVE]\tHeartbeat from " + orig.String() + " (" + sender.String() + ")")
-			heartbeat := comm.NewHeartbeat(n.Addr, orig)
+			heartbeat := comm.NewHeartbeatReply(message, n.Addr)
 			log.Println("[REPLY]\tHeartbeat to " + orig.String() + " (" + sender.String() + ")")
-			heartbeat.Send(n.Conn, sender)
+			heartbeat.Send(n.Conn, n.Sessions, session, sender)
 
 			// WebsiteMapUpdate
 		} else if message.Meta != nil {
 			log.Println("[RECEIVE]\tWebsiteMap from " + orig.String())
-			go n.MergeWebsiteMap(message.Meta.WebsiteMap)
+
+			// the address of orig is only known if it sent the message itself
+			from := structs.NewPeer(orig.ID, nil)
+			if structs.PeerEquals(orig, sender) {
+				from.Addr = sender.Addr
+			}
+			n.handle(func() { n.MergeWebsiteMap(message.Meta.WebsiteMap, from) })
 
 			// Data
 		} else if message.Data != nil {
@@ -355,12 +1154,43 @@ func (n *Node) Listen() {
 			if msgData.Data == nil {
 				log.Println("[RECEIVE]\tDataRequest: '" + msgData.Piece + "' for '" +
 					msgData.Website + "' from " + orig.String())
-				go n.SendPiece(message, sender, msgData.Website, msgData.Piece)
+				n.handle(func() { n.SendPiece(message, session, sender, msgData.Website, msgData.Piece) })
 			}
 		}
 	}
 }
 
+// handle hands a task to the workers, dropping it if too many are waiting
+func (n *Node) handle(task func()) {
+	select {
+	case n.work <- task:
+	default:
+		log.Println("[DROP]\tToo many requests waiting")
+	}
+}
+
+// worker runs the tasks handed by Listen
+func (n *Node) worker() {
+	for task := range n.work {
+		task()
+	}
+}
+
+// Ban bans a peer which sent invalid data for the BanDuration of the Config,
+// forgetting it. peer only holds what was authenticated: its ID, and the
+// address the data was received from if the peer sent it itself, as any
+// other address it claims could be the one of another node
+func (n *Node) Ban(peer *structs.Peer) {
+	if peer.ID == "" && peer.Addr == nil {
+		return
+	}
+
+	log.Println("[BAN]\tBanning", peer.Key(), "for", n.Config.BanDuration.Duration)
+	n.Bans.Ban(peer, n.Config.BanDuration.Duration)
+	n.RemovePeer(peer)
+	n.Members.Forget(peer)
+}
+
 // Search search for keywords match among all the websites on the network
 func (n *Node) Search(search string) []string {
 	terms := strings.Split(search, " ")
@@ -378,101 +1208,170 @@ func (n *Node) Search(search string) []string {
 	return results
 }
 
-// RetrieveWebsite retrieve the archive of a website in order to display it itself
-func (n *Node) RetrieveWebsite(name string) {
-	log.Println("[PIECES]\tRetrieving pieces for website '" + name + "'")
+// ErrWebsiteOwned, ErrWebsiteSeeded and ErrRetrieving are returned by
+// RetrieveWebsite for a website whose copy on the node is kept
+var (
+	ErrWebsiteOwned  = errors.New("website owned by this node")
+	ErrWebsiteSeeded = errors.New("website already up to date")
+	ErrRetrieving    = errors.New("website already being retrieved")
+)
+
+// RetrieveWebsite retrieve the archive of a website in order to display it
+// itself. A website which does not verify is discarded and from, the peer
+// which sent it (nil if it did not come from a peer), is banned. The archive
+// is downloaded aside and only replaces the current one once complete, the
+// retrieval failing when a piece could not be retrieved from any seeder or
+// after the RetrieveTimeout of the Config
+func (n *Node) RetrieveWebsite(name string, from *structs.Peer) error {
 	website := n.WebsiteMap.Get(name)
+	if website == nil {
+		return errors.New("unknown website '" + name + "'")
+	}
+
+	// the sources of an owned website are only replaced when it was imported
+	// without them, and an archive being seeded is never retrieved again
+	var err error
+	if _, statErr := os.Stat(utils.WebsiteDir + name); website.Owned() && statErr == nil {
+		err = ErrWebsiteOwned
+	} else if website.Seeded() {
+		err = ErrWebsiteSeeded
+	} else if _, retrieving := n.retrieving.LoadOrStore(name, true); retrieving {
+		err = ErrRetrieving
+	}
+	if err != nil {
+		log.Println("[PIECES]\tNot retrieving website '" + name + "': " + err.Error())
+		return err
+	}
+	defer n.retrieving.Delete(name)
 
+	log.Println("[PIECES]\tRetrieving pieces for website '" + name + "'")
 	pieces := website.Pieces
+	pieceLength := website.PieceLength
 	numPieces := len(pieces) / utils.HashSize
-	chans := make([]chan []byte, numPieces)
 
-	archive, err := os.Create(utils.SeedDir + website.Name)
-	defer archive.Close()
+	tmpPath := utils.SeedDir + "." + name + ".part"
+	archive, err := os.Create(tmpPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer os.Remove(tmpPath)
+	defer archive.Close()
+
+	type result struct {
+		index int
+		data  []byte
+	}
+	results := make(chan result, numPieces)
+	stop := make(chan struct{})
+	defer close(stop)
 
 	for i := 0; i < numPieces; i++ {
 		piece := pieces[i*utils.HashSize : (i+1)*utils.HashSize]
-		chans[i] = make(chan []byte)
-		go n.RetrievePiece(website, piece, chans[i])
+		go func(i int) {
+			// pieces are requested at the download rate
+			n.Download.Wait(website.Name, pieceLength)
+			select {
+			case <-stop:
+				return
+			default:
+			}
 
-		// pause every 8 packets for 1/4 sec => ~250KB/sec
-		if (i+1)%15 == 0 {
-			time.Sleep(250 * time.Millisecond)
-		}
+			c := make(chan []byte, 1)
+			n.RetrievePiece(website, piece, c)
+			results <- result{i, <-c}
+		}(i)
 	}
 
 	// write all pieces in archive at correct pos once retrieven
-	var mutex sync.Mutex
-	ok := make(chan int, numPieces)
-	for idx, c := range chans {
-		go func(i int, ch chan []byte) {
-			data := <-ch
-			mutex.Lock()
-			archive.WriteAt(data[:], int64(i*utils.DefaultPieceLength))
-			mutex.Unlock()
-			ok <- 1
-		}(idx, c)
+	deadline := time.NewTimer(n.Config.RetrieveTimeout.Duration)
+	defer deadline.Stop()
+	for okPiece := 0; okPiece < numPieces; okPiece++ {
+		select {
+		case r := <-results:
+			if r.data == nil {
+				err = errors.New("no seeder sent a piece of website '" + name + "'")
+			} else {
+				_, err = archive.WriteAt(r.data, int64(r.index*pieceLength))
+			}
+		case <-deadline.C:
+			err = errors.New("retrieval of website '" + name + "' timed out")
+		}
+		if err != nil {
+			log.Println("[PIECES]\tFailed retrieval of website '" + name + "': " + err.Error())
+			return err
+		}
 	}
 
-	// wait for all pieces to be written in archive
-	for okPiece := 0; okPiece < numPieces; {
-		okPiece += <-ok
+	err = archive.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, utils.SeedDir+name)
+	}
+	if err != nil {
+		return err
 	}
 
 	log.Println("[PIECES]\tSuccessful retrieval of website '" + name + "'")
 
 	// archive is now complete we can unbundle it and seed it
-	// TODO need to checksum this !
+	log.Println("[WEBSITES]\tUnbundling website '" + name + "'")
+	err = website.Unbundle()
+	if err == nil && !website.Verify() {
+		err = errors.New("verification failed for website '" + name + "'")
+	}
+	if err != nil {
+		log.Println("[WEBSITES]\tDiscarding website '" + name + "': " + err.Error())
+		n.discardWebsite(website)
+		if from != nil {
+			n.Ban(from)
+		}
+		return err
+	}
 
 	website.AddSeeder(n.Addr)
 
-	log.Println("[WEBSITES]\tUnbundling website '" + name + "'")
-	website.Unbundle()
-    if !website.Verify() {
-		log.Fatalf("[UNBUNDLE] Verfication failed for website %v\n", website.Name)
-    }
-
 	log.Println("[WEBSITES]\tSaving metadata for '" + name + "'")
 	website.SaveMetadata()
+	return nil
+}
+
+// discardWebsite forgets a retrieved website which did not verify, removing
+// its archive, files and metadata so that it can be retrieved again
+func (n *Node) discardWebsite(website *structs.Website) {
+	n.WebsiteMap.Remove(website.Name)
+	os.Remove(utils.SeedDir + website.Name)
+	os.Remove(utils.MetadataDir + website.Name)
+	os.RemoveAll(utils.WebsiteDir + website.Name)
 }
 
-// RetrievePiece retrieves a piece from a website archive and input it in a channel
+// RetrievePiece retrieves a piece from a website archive and input it in a
+// channel, nil if no seeder sent it
 func (n *Node) RetrievePiece(website *structs.Website, piece string, c chan []byte) {
 	log.Println("[PIECES]\tRetrieving piece '" + piece + "'")
 
-	// try 4 times for each seeders
-	seeders := website.GetSeeders()
+	// try 4 times for each seeders, the most reliable first
+	seeders := n.RankSeeders(website)
 	seeders = append(seeders, seeders[:]...)
 	seeders = append(seeders, seeders[:]...)
 
 	for _, seeder := range seeders {
-
-		conn, _ := NewConnAndPeer(n.Addr.IP, n.Addr.Port, n.Addr.Port+10000)
-		defer conn.Close()
-
-		conn.SetReadDeadline(time.Now().Add(utils.DataReqTimeout))
-
+		// the node itself does not have the piece
+		if n.Bans.Banned(&seeder) || (n.ID != "" && seeder.ID == n.ID) ||
+			seeder.String() == n.Addr.String() {
+			continue
+		}
 		message := comm.NewDataRequest(n.Addr, &seeder, website.Name, piece)
-
-		via := n.RoutingTable.Get(seeder.String())
-		message.Send(conn, via)
+		via := n.route(&seeder)
 
 		log.Println("[SENT]\t\tDatarequest: '" + piece + "' for website '" +
 			website.Name + "' to " + seeder.String())
 
-		// Maybe make a const for buffer size
-		buf := make([]byte, 65507)
-		_, err := conn.Read(buf)
-		if err != nil {
+		reply, err := n.Request(message, via, n.Config.DataReqTimeout.Duration)
+		if err != nil || reply.Data == nil {
 			log.Println("[PIECES]\t\tNo response for piece '" + piece + "' for website '" +
 				website.Name + "' by " + seeder.String())
-			go n.CheckPeer(&seeder, website)
+			n.Members.AddTimeout(&seeder)
+			go n.Probe(&seeder)
 		} else {
-			reply := comm.DecodeMessage(buf)
-			// do some validity checks here
 			data := reply.Data.Data
 
 			sum := sha256.Sum256(data)
@@ -481,43 +1380,90 @@ func (n *Node) RetrievePiece(website *structs.Website, piece string, c chan []by
 			if hash != piece {
 				log.Println("[PIECES]\t\tBad piece '" + piece + "' for website '" +
 					website.Name + "' by " + seeder.String())
+				// the seeder is banned by the ID which signed the reply, which
+				// may have been forwarded from another address
+				if n.Members.AddBad(&seeder) >= n.Config.MaxBadPieces {
+					n.Ban(structs.NewPeer(reply.Orig.ID, nil))
+				}
 			} else {
 				log.Println("[PIECES]\t\tGood piece '" + piece + "' for website '" +
 					website.Name + "' by " + seeder.String())
+				n.Members.AddGood(&seeder)
 				c <- data
 				return
 			}
 		}
 	}
+
+	log.Println("[PIECES]\t\tNo seeder sent piece '" + piece + "' for website '" + website.Name + "'")
+	c <- nil
+}
+
+// RankSeeders returns the seeders of website at their latest known address,
+// sorted by reputation, the seeders with the same one in a random order
+func (n *Node) RankSeeders(website *structs.Website) []structs.Peer {
+	seeders := website.GetSeeders()
+	for i := range seeders {
+		if known := n.Peers.Get(&seeders[i]); known != nil {
+			seeders[i] = *known
+		}
+	}
+
+	rand.Shuffle(len(seeders), func(i, j int) {
+		seeders[i], seeders[j] = seeders[j], seeders[i]
+	})
+	reputations := make([]float64, len(seeders))
+	for i := range seeders {
+		reputations[i] = n.Members.Reputation(&seeders[i])
+	}
+	sort.Stable(byReputation{seeders, reputations})
+	return seeders
+}
+
+// byReputation sorts peers by decreasing reputation
+type byReputation struct {
+	peers       []structs.Peer
+	reputations []float64
+}
+
+func (r byReputation) Len() int           { return len(r.peers) }
+func (r byReputation) Less(i, j int) bool { return r.reputations[i] > r.reputations[j] }
+func (r byReputation) Swap(i, j int) {
+	r.peers[i], r.peers[j] = r.peers[j], r.peers[i]
+	r.reputations[i], r.reputations[j] = r.reputations[j], r.reputations[i]
 }
 
-// SendPiece sends a data reply with the data for the requested piece
-func (n *Node) SendPiece(request *comm.Message, sender *structs.Peer, name, pieceToSend string) {
+// SendPiece sends a data reply with the data for the requested piece within
+// the session the request came in
+func (n *Node) SendPiece(request *comm.Message, session *comm.Session, sender *structs.Peer, name, pieceToSend string) {
 	website := n.WebsiteMap.Get(name)
+	if website == nil {
+		return
+	}
 
-	archiveData, err := ioutil.ReadFile(utils.SeedDir + website.Name)
+	archive, err := os.Open(utils.SeedDir + website.Name)
     if err != nil {
         return
     }
+	defer archive.Close()
 
-	archiveSize := len(archiveData)
 	pieces := website.Pieces
 	numPieces := len(pieces) / utils.HashSize
 
-	var data []byte
 	for i := 0; i < numPieces; i++ {
 		piece := pieces[i*utils.HashSize : (i+1)*utils.HashSize]
 		if piece == pieceToSend {
-			offsetStart := i * website.PieceLength
-			offsetEnd := (i + 1) * website.PieceLength
-			if offsetEnd >= archiveSize {
-				offsetEnd = archiveSize
+			// only the piece is read, the last one being shorter
+			data := make([]byte, website.PieceLength)
+			size, err := archive.ReadAt(data, int64(i*website.PieceLength))
+			if err != nil && err != io.EOF {
+				return
 			}
-
-			data = archiveData[offsetStart:offsetEnd]
+			data = data[:size]
+			n.Upload.Wait(website.Name, size)
 			// need to check for checksum here
 			reply := comm.NewDataReply(request, data)
-			reply.Send(n.Conn, sender)
+			reply.Send(n.Conn, n.Sessions, session, sender)
 			log.Println("[SENT]\tPiece '" + piece + "' for website '" +
 				website.Name + "' to " + reply.Dest.String())
 			return
@@ -535,3 +1481,120 @@ func (n *Node) AntiEntropy(timeout time.Duration) {
 		}
 	}
 }
+
+// UseRelay registers the node with a relay which forwards traffic for it, the
+// registration being repeated to keep the NAT mapping open
+func (n *Node) UseRelay(relay *structs.Peer) {
+	ticker := time.NewTicker(n.Config.RelayKeepAlive.Duration)
+
+	for ; true; <-ticker.C {
+		message := comm.NewRegister(n.Addr, relay)
+		err := n.Send(message, relay)
+		if err != nil {
+			log.Println("[NAT]\tCannot reach relay " + relay.String() + ": " + err.Error())
+		}
+	}
+}
+
+// HandleNat acts on the messages used to reach nodes behind a NAT, hop being
+// the node the message came from
+func (n *Node) HandleNat(message *comm.Message, hop *structs.Peer) {
+	nat := message.Nat
+	orig := message.Orig
+
+	switch {
+	case nat.Register && !nat.Answer:
+		// only a direct peer can be relayed
+		if !structs.PeerEquals(orig, hop) {
+			return
+		}
+		if n.Relaying && !n.Relayed.Contains(hop) {
+			log.Println("[NAT]\tRelaying for " + hop.String())
+		}
+		if n.Relaying {
+			n.Relayed.Add(hop)
+		}
+		answer := comm.NewRegisterAnswer(message, n.Addr, n.Relaying)
+		n.Send(answer, hop)
+
+	case nat.Register:
+		if !nat.Accepted {
+			log.Println("[NAT]\t" + hop.String() + " refused to relay")
+		} else if n.Addr.Relay == nil || !structs.PeerEquals(n.Addr.Relay, hop) {
+			log.Println("[NAT]\tRelayed by " + hop.String())
+			n.Addr.Relay = hop
+			n.WebsiteMap.UpdatePeer(n.Addr)
+		}
+
+	case nat.Introduce != nil:
+		n.introduce(orig, nat.Introduce)
+
+	case nat.Introduction != nil:
+		n.Punch(nat.Introduction)
+
+	case nat.Punch:
+		log.Println("[NAT]\tPunched path from " + hop.String())
+	}
+}
+
+// Introduce asks the relay of a peer behind a NAT to introduce this node to
+// the peer, at most every IntroductionInterval
+func (n *Node) Introduce(peer *structs.Peer) {
+	last, ok := n.introductions.Load(peer.Key())
+	if ok && time.Since(last.(time.Time)) < n.Config.IntroductionInterval.Duration {
+		return
+	}
+	n.introductions.Store(peer.Key(), time.Now())
+
+	log.Println("[NAT]\tAsking " + peer.Relay.String() + " for an introduction to " + peer.String())
+	message := comm.NewIntroduce(n.Addr, peer.Relay, peer)
+	n.Send(message, n.route(peer.Relay))
+}
+
+// introduce sends to two peers the public address of each other so that they
+// punch a direct path through their NATs
+func (n *Node) introduce(orig, target *structs.Peer) {
+	a := n.Peers.Get(orig)
+	b := n.Peers.Get(target)
+	if a == nil || b == nil {
+		return
+	}
+
+	log.Println("[NAT]\tIntroducing " + a.String() + " and " + b.String())
+	a.Relay = nil
+	b.Relay = nil
+	n.Send(comm.NewIntroduction(n.Addr, a, b), n.route(a))
+	n.Send(comm.NewIntroduction(n.Addr, b, a), n.route(b))
+}
+
+// Punch opens a direct path to a peer behind a NAT, the peer doing the same
+// at the same time so that both NATs let the handshakes through
+func (n *Node) Punch(peer *structs.Peer) {
+	for i := 0; i < n.Config.PunchAttempts; i++ {
+		session, err := n.dial(peer, n.Config.PunchTimeout.Duration)
+		if err == nil {
+			punch := comm.NewPunch(n.Addr, peer)
+			punch.Send(n.Conn, n.Sessions, session, peer)
+			log.Println("[NAT]\tPunched path to " + peer.String())
+			return
+		}
+	}
+	log.Println("[NAT]\tCannot punch a path to " + peer.String())
+}
+
+// -----------
+// - Helpers -
+// -----------
+
+// samePath checks if two paths are the same file
+func samePath(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
@@ -0,0 +1,426 @@
+package node
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yaanst/W2P/comm"
+	"github.com/yaanst/W2P/config"
+	"github.com/yaanst/W2P/structs"
+	"github.com/yaanst/W2P/utils"
+	"github.com/yaanst/W2P/w2pcrypto"
+)
+
+// -----------
+// - Helpers -
+// -----------
+
+// newTestNode returns a node with a new identity which does not listen on
+// the network
+func newTestNode(t *testing.T) *Node {
+	t.Helper()
+	cfg := config.Default()
+	identity, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+	addr := peerAt(t, identity.Public().ID(), "127.0.0.1:5000")
+
+	return &Node{
+		Config:       cfg,
+		ID:           addr.ID,
+		Addr:         addr,
+		Peers:        structs.NewPeers(),
+		Members:      structs.NewMembership(),
+		RoutingTable: structs.NewRoutingTable(),
+		WebsiteMap:   structs.NewWebsiteMap(),
+		Keyring:      w2pcrypto.NewKeyring(),
+		Identity:     identity,
+		Sessions:     comm.NewSessions(identity),
+		Requests:     comm.NewRequests(),
+		Relayed:      structs.NewPeers(),
+		Limits:       structs.NewTokenBuckets(cfg.PeerRate, cfg.PeerBurst),
+		Bans:         structs.NewBans(),
+		Upload:       structs.NewBandwidth(0),
+		Download:     structs.NewBandwidth(0),
+	}
+}
+
+// peerAt returns the Peer with the given ID at addr
+func peerAt(t *testing.T, id, addr string) *structs.Peer {
+	t.Helper()
+	p := structs.ParsePeer(addr)
+	p.ID = id
+	return p
+}
+
+// ---------
+// - Tests -
+// ---------
+
+func TestRoute(t *testing.T) {
+	n := newTestNode(t)
+	relay := peerAt(t, "relay", "10.0.0.9:5000")
+	n.Peers.Add(peerAt(t, "relay", "10.0.0.19:5000"))
+	n.Peers.Add(peerAt(t, "moved", "10.0.0.12:5000"))
+	n.RoutingTable.Set(peerAt(t, "routed", "10.0.0.3:5000"), peerAt(t, "via", "10.0.0.8:5000"))
+
+	natted := peerAt(t, "natted", "203.0.113.7:40000")
+	natted.Relay = relay
+
+	tests := []struct {
+		name string
+		dest *structs.Peer
+		via  string
+	}{
+		{"unknown peer", peerAt(t, "new", "10.0.0.1:5000"), "10.0.0.1:5000"},
+		{"peer at its latest address", peerAt(t, "moved", "10.0.0.2:5000"), "10.0.0.12:5000"},
+		{"through the routing table", peerAt(t, "routed", "10.0.0.3:5000"), "10.0.0.8:5000"},
+		{"behind a NAT, through its relay", natted, "10.0.0.19:5000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if via := n.route(test.dest); via.String() != test.via {
+				t.Errorf("route() = %v, want %v", via, test.via)
+			}
+		})
+	}
+}
+
+func TestPeerSample(t *testing.T) {
+	n := newTestNode(t)
+	n.Config.PexSize = 10
+	dest := peerAt(t, "dest", "10.0.0.1:5000")
+	for _, p := range []*structs.Peer{
+		dest,
+		peerAt(t, "alive", "10.0.0.2:5000"),
+		peerAt(t, "suspect", "10.0.0.3:5000"),
+		peerAt(t, "", "10.0.0.4:5000"),
+		n.Addr,
+	} {
+		n.Peers.Add(p)
+	}
+	n.Members.Suspect(peerAt(t, "suspect", "10.0.0.3:5000"))
+
+	sample := n.PeerSample(dest)
+	if len(sample) != 1 || sample[0].Key() != "alive" {
+		t.Errorf("PeerSample() = %v, want the alive peer only", sample)
+	}
+
+	n.Config.PexSize = 0
+	if sample := n.PeerSample(dest); len(sample) != 0 {
+		t.Errorf("PeerSample() = %v, want at most PexSize peers", sample)
+	}
+}
+
+func TestMergePeers(t *testing.T) {
+	tests := []struct {
+		name  string
+		peer  *structs.Peer
+		known bool
+		addr  string
+	}{
+		{"new peer", peerAt(t, "new", "10.0.0.1:5000"), true, "10.0.0.1:5000"},
+		{"no ID", peerAt(t, "", "10.0.0.1:5000"), false, ""},
+		{"no address", structs.NewPeer("new", nil), false, ""},
+		{"known peer at another address", peerAt(t, "known", "10.0.0.1:5000"), true, "10.0.0.2:5000"},
+		{"dead peer", peerAt(t, "dead", "10.0.0.1:5000"), false, ""},
+		{"banned peer", peerAt(t, "banned", "10.0.0.1:5000"), false, ""},
+		{"the node itself", nil, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t)
+			n.Peers.Add(peerAt(t, "known", "10.0.0.2:5000"))
+			dead := peerAt(t, "dead", "10.0.0.3:5000")
+			n.Members.Suspect(dead)
+			n.Members.M[dead.Key()].Since = time.Now().Add(-time.Hour)
+			n.Members.Expire(time.Minute, time.Hour)
+			n.Bans.Ban(structs.NewPeer("banned", nil), time.Hour)
+
+			peer := test.peer
+			if peer == nil {
+				peer = n.Addr
+			}
+			n.MergePeers([]*structs.Peer{nil, peer})
+
+			known := n.Peers.Get(peer)
+			if (known != nil) != test.known {
+				t.Fatalf("peer known = %v, want %v", known != nil, test.known)
+			}
+			if known != nil && known.String() != test.addr {
+				t.Errorf("peer at %v, want %v", known, test.addr)
+			}
+		})
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 40000}
+
+	tests := []struct {
+		name     string
+		announce *comm.Announce
+		data     []byte
+		addr     string
+	}{
+		{"node on the LAN", &comm.Announce{Network: utils.LANNetwork, ID: "lan", Addr: "192.168.1.20:5000"}, nil, "192.168.1.20:5000"},
+		{"listening on all addresses", &comm.Announce{Network: utils.LANNetwork, ID: "lan", Addr: "0.0.0.0:5000"}, nil, "192.168.1.20:5000"},
+		{"listening on all IPv6 addresses", &comm.Announce{Network: utils.LANNetwork, ID: "lan", Addr: "[::]:5000"}, nil, "192.168.1.20:5000"},
+		{"other network", &comm.Announce{Network: "other", ID: "lan", Addr: "192.168.1.20:5000"}, nil, ""},
+		{"invalid address", &comm.Announce{Network: utils.LANNetwork, ID: "lan", Addr: "nowhere"}, nil, ""},
+		{"the node itself", &comm.Announce{Network: utils.LANNetwork, ID: "self", Addr: "192.168.1.20:5000"}, nil, ""},
+		{"dead node", &comm.Announce{Network: utils.LANNetwork, ID: "dead", Addr: "192.168.1.20:5000"}, nil, ""},
+		{"not an announce", nil, []byte("W2P"), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t)
+			n.Members.Suspect(structs.NewPeer("dead", nil))
+			n.Members.Expire(-time.Second, time.Hour)
+
+			data := test.data
+			if test.announce != nil {
+				// its own announce comes back to the node
+				if test.announce.ID == "self" {
+					test.announce.ID = n.ID
+				}
+				var err error
+				if data, err = comm.EncodeAnnounce(test.announce); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n.handleAnnounce(data, from)
+
+			peers := n.Peers.GetAll()
+			if test.addr == "" {
+				if len(peers) != 0 {
+					t.Errorf("peers = %v, want none", peers)
+				}
+				return
+			}
+			if len(peers) != 1 || peers[0].ID != test.announce.ID || peers[0].String() != test.addr {
+				t.Errorf("peers = %v, want %v at %v", peers, test.announce.ID, test.addr)
+			}
+		})
+	}
+}
+
+func TestAddPeer(t *testing.T) {
+	tests := []struct {
+		name string
+		// the weakest peer relays for the node or is relayed by it
+		relay, relayed bool
+		peers          []string
+	}{
+		{"weakest peer evicted", false, false, []string{"new", "old"}},
+		{"relay of the node", true, false, []string{"new", "weak"}},
+		{"node relayed", false, true, []string{"new", "weak"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t)
+			n.Config.MaxPeers = 2
+			old, weak := peerAt(t, "old", "10.0.0.1:5000"), peerAt(t, "weak", "10.0.0.2:5000")
+			for _, p := range []*structs.Peer{old, weak} {
+				n.AddPeer(p)
+				n.Members.Seen(p)
+			}
+			n.Members.M["old"].Since = time.Now().Add(-time.Hour)
+			n.Members.AddTimeout(weak)
+			if test.relay {
+				n.Addr.Relay = weak
+			} else if test.relayed {
+				n.Relayed.Add(weak)
+			}
+			if test.relay || test.relayed {
+				n.Members.Suspect(old)
+			}
+
+			// an unknown peer scores as much as a peer just seen
+			if !n.AddPeer(peerAt(t, "new", "10.0.0.3:5000")) {
+				t.Error("AddPeer() did not keep the new peer")
+			}
+			var peers []string
+			for _, p := range n.Peers.GetAll() {
+				peers = append(peers, p.ID)
+			}
+			sort.Strings(peers)
+			if strings.Join(peers, ",") != strings.Join(test.peers, ",") {
+				t.Errorf("peers = %v, want %v", peers, test.peers)
+			}
+			for _, evicted := range []*structs.Peer{old, weak} {
+				if !n.Peers.Contains(evicted) && n.Members.M[evicted.ID] != nil {
+					t.Errorf("evicted peer %v not forgotten", evicted.ID)
+				}
+			}
+		})
+	}
+
+	n := newTestNode(t)
+	n.Config.MaxPeers = 1
+	n.AddPeer(peerAt(t, "old", "10.0.0.1:5000"))
+	n.Members.Seen(peerAt(t, "old", "10.0.0.1:5000"))
+	n.Members.M["old"].Since = time.Now().Add(-time.Hour)
+	if n.AddPeer(peerAt(t, "new", "10.0.0.3:5000")) || n.Peers.Count() != 1 {
+		t.Error("AddPeer() kept a peer with a lower score than the others")
+	}
+	n.Bans.Ban(structs.NewPeer("banned", nil), time.Hour)
+	if n.AddPeer(peerAt(t, "banned", "10.0.0.4:5000")) {
+		t.Error("AddPeer() added a banned peer")
+	}
+}
+
+func TestBoundSeeders(t *testing.T) {
+	n := newTestNode(t)
+	n.Config.MaxSeeders = 2
+	website := structs.NewWebsite("site", nil, n.Identity.Public())
+	website.AddSeeder(n.Addr)
+	for i, id := range []string{"a", "b", "c"} {
+		p := peerAt(t, id, "10.0.0."+strconv.Itoa(i+1)+":5000")
+		website.AddSeeder(p)
+		n.Members.Seen(p)
+	}
+	n.Members.Suspect(structs.NewPeer("a", nil))
+	n.Members.M["c"].Since = time.Now().Add(-time.Hour)
+
+	// the node is kept whatever its score
+	n.BoundSeeders(website)
+	if !website.Seeders.Contains(n.Addr) || !website.Seeders.Contains(structs.NewPeer("c", nil)) ||
+		website.Seeders.Count() != 2 {
+		t.Errorf("seeders = %v, want the node and the best seeder", website.GetSeeders())
+	}
+}
+
+func TestBan(t *testing.T) {
+	tests := []struct {
+		name   string
+		peer   *structs.Peer
+		banned []*structs.Peer
+		free   []*structs.Peer
+	}{
+		{"authenticated peer at its address", peerAt(t, "bad", "10.0.0.1:5000"),
+			[]*structs.Peer{structs.NewPeer("bad", nil), peerAt(t, "", "10.0.0.1:5000")},
+			[]*structs.Peer{peerAt(t, "good", "10.0.0.2:5000")}},
+		{"peer known by its ID only", structs.NewPeer("bad", nil),
+			[]*structs.Peer{peerAt(t, "bad", "10.0.0.3:5000")},
+			[]*structs.Peer{peerAt(t, "", "10.0.0.1:5000"), peerAt(t, "good", "10.0.0.2:5000")}},
+		{"nothing authenticated", structs.NewPeer("", nil),
+			nil,
+			[]*structs.Peer{peerAt(t, "bad", "10.0.0.1:5000"), peerAt(t, "good", "10.0.0.2:5000")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t)
+			website := structs.NewWebsite("site", nil, n.Identity.Public())
+			n.WebsiteMap.Set(website)
+			for _, p := range []*structs.Peer{peerAt(t, "bad", "10.0.0.1:5000"), peerAt(t, "good", "10.0.0.2:5000")} {
+				n.AddPeer(p)
+				n.Members.Seen(p)
+				website.AddSeeder(p)
+			}
+
+			n.Ban(test.peer)
+			for _, p := range test.banned {
+				if !n.Bans.Banned(p) {
+					t.Errorf("%v not banned", p.Key())
+				}
+			}
+			for _, p := range test.free {
+				if n.Bans.Banned(p) {
+					t.Errorf("%v banned", p.Key())
+				}
+			}
+
+			// the banned peer is forgotten
+			bad := structs.NewPeer("bad", nil)
+			forgotten := test.banned != nil
+			if n.Peers.Contains(bad) == forgotten || website.Seeders.Contains(bad) == forgotten ||
+				(n.Members.M["bad"] == nil) != forgotten {
+				t.Errorf("banned peer forgotten = %v", !n.Peers.Contains(bad))
+			}
+		})
+	}
+}
+
+func TestHandle(t *testing.T) {
+	n := newTestNode(t)
+	n.work = make(chan func(), 2)
+
+	ran := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		n.handle(func() { ran <- i })
+	}
+
+	// the task beyond the queue is dropped
+	close(n.work)
+	n.worker()
+	close(ran)
+	var tasks []int
+	for i := range ran {
+		tasks = append(tasks, i)
+	}
+	if len(tasks) != 2 || tasks[0] != 0 || tasks[1] != 1 {
+		t.Errorf("tasks run = %v, want the first two", tasks)
+	}
+}
+
+func TestRankSeeders(t *testing.T) {
+	tests := []struct {
+		name  string
+		good  map[string]int
+		bad   map[string]int
+		want  []string
+		moved bool
+	}{
+		{"reliable first", map[string]int{"a": 1, "b": 5}, nil, []string{"b", "a", "c"}, false},
+		{"unknown before unreliable", nil, map[string]int{"a": 1}, []string{"b", "c", "a"}, false},
+		{"bad pieces last", map[string]int{"a": 5}, map[string]int{"b": 1}, []string{"a", "c", "b"}, false},
+		{"known peer at its latest address", map[string]int{"c": 1}, nil, []string{"c", "a", "b"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t)
+			known := func(id string) bool { return test.good[id]+test.bad[id] > 0 }
+			website := structs.NewWebsite("site", nil, n.Identity.Public())
+			for i, id := range []string{"a", "b", "c"} {
+				seeder := peerAt(t, id, "10.0.0."+strconv.Itoa(i+1)+":5000")
+				website.AddSeeder(seeder)
+				if known(id) {
+					n.Members.Seen(seeder)
+				}
+				for j := 0; j < test.good[id]; j++ {
+					n.Members.AddGood(seeder)
+				}
+				for j := 0; j < test.bad[id]; j++ {
+					n.Members.AddBad(seeder)
+				}
+			}
+			if test.moved {
+				n.Peers.Add(peerAt(t, "c", "10.0.0.13:5000"))
+			}
+
+			seeders := n.RankSeeders(website)
+			if len(seeders) != len(test.want) {
+				t.Fatalf("RankSeeders() = %v, want %v", seeders, test.want)
+			}
+			for i, id := range test.want {
+				// the unknown seeders are shuffled among themselves
+				if seeders[i].ID != id && (known(id) || known(seeders[i].ID)) {
+					t.Errorf("RankSeeders() = %v, want %v", seeders, test.want)
+				}
+			}
+			if test.moved && seeders[0].String() != "10.0.0.13:5000" {
+				t.Errorf("seeder at %v, want 10.0.0.13:5000", seeders[0].String())
+			}
+		})
+	}
+}
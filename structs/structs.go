@@ -2,20 +2,26 @@ package structs
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/yaanst/W2P/utils"
 	"github.com/yaanst/W2P/w2pcrypto"
@@ -25,13 +31,20 @@ import (
 // - Structs -
 // -----------
 
-// Peer is a peer represented by a pointer to a UDP address
-type Peer net.UDPAddr
+// Peer is a node of the network identified by its ID (derived from the node's
+// identity key), Addr being the UDP address it was last seen at. Peers given
+// on the command line have no ID until they are contacted. Relay is the node
+// forwarding traffic for the Peer when it is behind a NAT
+type Peer struct {
+	ID    string
+	Addr  *net.UDPAddr
+	Relay *Peer
+}
 
-// Peers is a collection of Peer
+// Peers is a collection of Peer indexed by their Key
 type Peers struct {
 	mux sync.RWMutex
-	P   []*Peer
+	P   map[string]*Peer
 }
 
 // WebsiteMap is a map from a Website PubKey to the Website
@@ -49,31 +62,196 @@ type Website struct {
 	PieceLength int
 	Pieces      string
 	Version     int
+
+	KeyAlgorithm w2pcrypto.Algorithm
+	Rotations    []*KeyRotation
+	Revocations  []*Revocation
+	Delegations  []*Delegation
+
+	// DelegationSeq numbers the versions of the Delegations, which the owner
+	// signs as a whole so that a removed delegation cannot be added back
+	DelegationSeq       int
+	DelegationSignature string
+
+	// Signer is the owner's or an editor's key which signed this version
+	Signer    *w2pcrypto.PublicKey
+	Signature string
+}
+
+// Delegation is a certificate signed by the owner of a website allowing an
+// editor key to publish new versions of the website until Expiry (unix time,
+// 0 meaning no expiry)
+type Delegation struct {
+	EditorKey *w2pcrypto.PublicKey
+	Expiry    int64
+	Signature string
+}
+
+// KeyRotation moves a website from an owner key to a new one, it is signed by
+// the old key so nodes knowing only the old key can follow the rotations
+type KeyRotation struct {
+	OldPubKey    *w2pcrypto.PublicKey
+	OldAlgorithm w2pcrypto.Algorithm
+	NewPubKey    *w2pcrypto.PublicKey
+	Signature    string
+}
+
+// Revocation is a record signed by the current owner key of a website stating
+// that a (former owner or editor) key must not be trusted anymore
+type Revocation struct {
+	Key       *w2pcrypto.PublicKey
+	Signature string
+}
+
+// Identity is what a node needs to publish a website: its metadata and its
+// private key. It is exported as an encrypted bundle to move a website to
+// another node
+type Identity struct {
+	Website *Website
+	PrivKey *w2pcrypto.PrivateKey
+}
+
+// identityPEMType is the PEM type of an encrypted Identity bundle
+const identityPEMType string = "W2P WEBSITE IDENTITY"
+
+// Manifest is the canonical description of a website's files, independent
+// of where the website is stored on disk. It is what the owner signs
+type Manifest struct {
+	Files     []ManifestEntry
+	Signer    *w2pcrypto.PublicKey
+	Signature string
+}
+
+// ManifestEntry describes a single file of a website, Path being relative to
+// the website's root and always slash-separated
+type ManifestEntry struct {
+	Path string
+	Size int64
+	Hash string
 }
 
 // RoutingTable is a table which keeps in memory possible route for a dest
-// if a Peer is not directly reachable
+// if a Peer is not directly reachable, indexed by the Key of the dest
 type RoutingTable struct {
 	mux sync.Mutex
 	R   map[string]*Peer
 }
 
-// Counter is a simple async counter
-type Counter struct {
-	mux sync.RWMutex
-	C   int
+// PeerState is the liveness of a Peer as seen by the failure detector
+type PeerState int
+
+// The states of a Peer: a peer which does not answer probes is suspected, and
+// becomes dead if it does not show it is alive before a timeout
+const (
+	PeerAlive PeerState = iota
+	PeerSuspect
+	PeerDead
+)
+
+// Member is what the failure detector knows about a Peer, Since being when
+// it entered its State
+type Member struct {
+	Peer     *Peer
+	State    PeerState
+	Since    time.Time
+	LastSeen time.Time
+
+	// RTT is the round trip time of the last heartbeat, Good, Bad and
+	// Timeouts count the answers of the Peer to the requests for pieces
+	RTT      time.Duration
+	Good     int
+	Bad      int
+	Timeouts int
+}
+
+// Membership keeps the liveness of the peers, indexed by their Key, and the
+// order in which to probe them
+type Membership struct {
+	mux     sync.Mutex
+	M       map[string]*Member
+	round   []Peer
+	probing map[string]bool
+}
+
+// TokenBuckets limit the rate of events per key, the bucket of each key
+// holding at most Burst tokens and being refilled at Rate tokens per second
+type TokenBuckets struct {
+	mux   sync.Mutex
+	Rate  float64
+	Burst float64
+	B     map[string]*tokenBucket
+
+	// size of B at which to forget the full buckets
+	prune int
+}
+
+// tokenBucket is the bucket of a key, holding tokens at time last
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Throttle caps a rate in bytes per second, no cap being set if Rate is 0
+type Throttle struct {
+	mux    sync.Mutex
+	Rate   int
+	tokens float64
+	last   time.Time
+}
+
+// Bandwidth caps the upload or download rate of the node, in total and for
+// each website
+type Bandwidth struct {
+	mux    sync.Mutex
+	Global *Throttle
+	Sites  map[string]*Throttle
 }
 
+// Bans are the peers banned until a given time, indexed by their Key and by
+// their address
+type Bans struct {
+	mux sync.Mutex
+	B   map[string]time.Time
+}
+
+// Unpacker writes the files of a website uploaded as an archive or as
+// separate files in Dir, refusing paths outside of it, more than MaxSize
+// bytes in total and more than MaxFiles files
+type Unpacker struct {
+	Dir      string
+	MaxSize  int64
+	MaxFiles int
+	size     int64
+	files    int
+}
+
+// ErrTooLarge is returned when an Unpacker would write more than its MaxSize
+var ErrTooLarge = errors.New("website too large")
+
+// ErrTooManyFiles is returned when an Unpacker would write more than its
+// MaxFiles
+var ErrTooManyFiles = errors.New("website with too many files")
+
 // ----------------
 // - Constructors -
 // ----------------
 
-// ParsePeer construct a Peer from a string of format "addr:port"
+// ParsePeer construct a Peer of unknown ID from a string of format "addr:port",
+// IPv6 addresses being written in brackets: "[addr]:port"
 func ParsePeer(peerString string) *Peer {
-	udpAddr, err := net.ResolveUDPAddr("udp4", peerString)
+	udpAddr, err := net.ResolveUDPAddr("udp", peerString)
 	utils.CheckError(err)
-	peer := Peer(*udpAddr)
-	return &peer
+	return &Peer{
+		Addr: udpAddr,
+	}
+}
+
+// NewPeer constructs the Peer with the given ID at the given UDP address
+func NewPeer(id string, addr *net.UDPAddr) *Peer {
+	return &Peer{
+		ID:   id,
+		Addr: addr,
+	}
 }
 
 // ParsePeers construct a collection of type Peers from a string
@@ -93,10 +271,10 @@ func ParsePeers(peersString string) *Peers {
 	return NewPeers()
 }
 
-// NewPeers constructs a new Peers object (list of peer with a mutex)
+// NewPeers constructs a new Peers object (map of peer with a mutex)
 func NewPeers() *Peers {
 	return &Peers{
-		P: make([]*Peer, 0, 5),
+		P: make(map[string]*Peer),
 	}
 }
 
@@ -107,19 +285,17 @@ func NewWebsiteMap() *WebsiteMap {
 	}
 }
 
-// NewWebsite constructs a new Website data structure
-func NewWebsite(name string, keywords []string) *Website {
-	privKey, pubKey := w2pcrypto.CreateKey()
-	privKey.Save(name)
-
+// NewWebsite constructs a new Website data structure owned by the given key
+func NewWebsite(name string, keywords []string, pubKey *w2pcrypto.PublicKey) *Website {
 	seeders := NewPeers()
 
 	return &Website{
-		Name:     name,
-		Seeders:  seeders,
-		Keywords: keywords,
-		PubKey:   pubKey,
-		Version:  1,
+		Name:         name,
+		Seeders:      seeders,
+		Keywords:     keywords,
+		PubKey:       pubKey,
+		Version:      1,
+		KeyAlgorithm: pubKey.Algorithm(),
 	}
 }
 
@@ -135,6 +311,102 @@ func LoadWebsite(name string) *Website {
 	return website
 }
 
+// NewIdentity constructs the Identity of a website from its private key
+func NewIdentity(website *Website, privKey *w2pcrypto.PrivateKey) (*Identity, error) {
+	if privKey.Public().String() != website.PubKey.String() {
+		return nil, errors.New("key does not match website '" + website.Name + "'")
+	}
+
+	return &Identity{
+		Website: website,
+		PrivKey: privKey,
+	}, nil
+}
+
+// OpenIdentity decrypts an Identity bundle with the passphrase used to seal it
+func OpenIdentity(bundle, passphrase []byte) (*Identity, error) {
+	data, err := w2pcrypto.DecryptPEM(identityPEMType, bundle, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &Identity{}
+	err = json.Unmarshal(data, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if id.Website == nil || id.PrivKey == nil || id.Website.PubKey == nil {
+		return nil, errors.New("incomplete website identity")
+	}
+	if id.Website.Seeders == nil {
+		id.Website.Seeders = NewPeers()
+	}
+
+	return NewIdentity(id.Website, id.PrivKey)
+}
+
+// BuildManifest scans the website folder at root and constructs its
+// (unsigned) Manifest, with files sorted by path
+func BuildManifest(root string) (*Manifest, error) {
+	var files []ManifestEntry
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == utils.ManifestFile {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		files = append(files, ManifestEntry{
+			Path: rel,
+			Size: info.Size(),
+			Hash: hex.EncodeToString(hash[:]),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return &Manifest{Files: files}, nil
+}
+
+// LoadManifest reads the manifest stored at the root of a website folder
+func LoadManifest(root string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, utils.ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
 // NewRoutingTable constructs a RoutingTable object
 func NewRoutingTable() *RoutingTable {
 	return &RoutingTable{
@@ -142,10 +414,47 @@ func NewRoutingTable() *RoutingTable {
 	}
 }
 
-// NewCounter constructs a Counter object
-func NewCounter() *Counter {
-	return &Counter{
-		C: 0,
+// NewMembership constructs an empty Membership object
+func NewMembership() *Membership {
+	return &Membership{
+		M:       make(map[string]*Member),
+		probing: make(map[string]bool),
+	}
+}
+
+// NewTokenBuckets constructs TokenBuckets refilled at rate tokens per second
+// up to burst tokens
+func NewTokenBuckets(rate, burst float64) *TokenBuckets {
+	return &TokenBuckets{
+		Rate:  rate,
+		Burst: burst,
+		B:     make(map[string]*tokenBucket),
+		prune: 64,
+	}
+}
+
+// NewBandwidth constructs a Bandwidth capped at rate bytes per second in
+// total, and not capped for any website
+func NewBandwidth(rate int) *Bandwidth {
+	return &Bandwidth{
+		Global: &Throttle{Rate: rate},
+		Sites:  make(map[string]*Throttle),
+	}
+}
+
+// NewBans constructs an empty Bans object
+func NewBans() *Bans {
+	return &Bans{
+		B: make(map[string]time.Time),
+	}
+}
+
+// NewUnpacker constructs an Unpacker writing in dir, which must exist
+func NewUnpacker(dir string, maxSize int64, maxFiles int) *Unpacker {
+	return &Unpacker{
+		Dir:      dir,
+		MaxSize:  maxSize,
+		MaxFiles: maxFiles,
 	}
 }
 
@@ -155,60 +464,135 @@ func NewCounter() *Counter {
 
 // Peer
 
-// PeerEquals compare two peers
+// PeerEquals compare two peers, by ID if both are known, by address otherwise
 func PeerEquals(p1, p2 *Peer) bool {
+	if p1.ID != "" && p2.ID != "" {
+		return p1.ID == p2.ID
+	}
 	return p1.String() == p2.String()
 }
 
+// String returns the address of the Peer in the format "addr:port", or
+// "[addr]:port" for IPv6 addresses
 func (p *Peer) String() string {
-	return fmt.Sprintf("%v:%v", p.IP.String(), p.Port)
+	if p.Addr == nil {
+		return "<nil>"
+	}
+	return p.Addr.String()
+}
+
+// Key returns the string identifying the Peer: its ID or its address if the
+// ID is unknown
+func (p *Peer) Key() string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return p.String()
+}
+
+// UnmarshalJSON decodes a Peer, accepting the bare UDP address of metadata
+// written before peers had an ID
+func (p *Peer) UnmarshalJSON(data []byte) error {
+	aux := &struct {
+		ID    string
+		Addr  *net.UDPAddr
+		Relay *Peer
+		IP    net.IP
+		Port  int
+		Zone  string
+	}{}
+	err := json.Unmarshal(data, aux)
+	if err != nil {
+		return err
+	}
+
+	p.ID = aux.ID
+	p.Addr = aux.Addr
+	p.Relay = aux.Relay
+	if p.Addr == nil && aux.IP != nil {
+		p.Addr = &net.UDPAddr{IP: aux.IP, Port: aux.Port, Zone: aux.Zone}
+	}
+	return nil
 }
 
 // Peers
 
-// Contains check if the Peers slice contains a Peer
-func (peers *Peers) Contains(peer *Peer) bool {
-	peers.mux.RLock()
-	defer peers.mux.RUnlock()
-	for _, p := range peers.P {
+// find returns the key and entry matching peer, a Peer known by its address
+// only being looked up among all the entries
+func (peers *Peers) find(peer *Peer) (string, *Peer) {
+	if p := peers.P[peer.Key()]; p != nil {
+		return peer.Key(), p
+	}
+	if peer.ID != "" {
+		if p := peers.P[peer.String()]; p != nil && p.ID == "" {
+			return peer.String(), p
+		}
+		return "", nil
+	}
+	for key, p := range peers.P {
 		if PeerEquals(p, peer) {
-			return true
+			return key, p
 		}
 	}
-	return false
+	return "", nil
 }
 
-// Add adds a Peer to the Peers if not already present
-func (peers *Peers) Add(peer *Peer) {
-	set := make(map[string]bool)
-	var newPeers []*Peer
+// Contains check if the Peers contain a Peer
+func (peers *Peers) Contains(peer *Peer) bool {
+	peers.mux.RLock()
+	defer peers.mux.RUnlock()
+	_, p := peers.find(peer)
+	return p != nil
+}
 
+// Add adds a Peer to the Peers if not already present, otherwise it updates
+// the address and relay of the Peer and its ID if it was unknown
+func (peers *Peers) Add(peer *Peer) {
 	peers.mux.Lock()
 	defer peers.mux.Unlock()
 
-	// remove duplicates
-	for _, p := range peers.P {
-		set[p.String()] = true
+	key, p := peers.find(peer)
+	if p == nil {
+		newPeer := *peer
+		peers.P[newPeer.Key()] = &newPeer
+		return
+	}
+
+	updated := *p
+	if peer.ID != "" {
+		updated.ID = peer.ID
+	}
+	if peer.Addr != nil {
+		updated.Addr = peer.Addr
+		updated.Relay = peer.Relay
+	}
+	delete(peers.P, key)
+
+	// the entry of the Peer when its ID was not known yet
+	if old := peers.P[updated.String()]; old != nil && old.ID == "" {
+		delete(peers.P, updated.String())
 	}
-	set[peer.String()] = true
+	peers.P[updated.Key()] = &updated
+}
 
-	// rebuild slice
-	for p := range set {
-		newPeers = append(newPeers, ParsePeer(p))
+// Get returns a copy of the known entry matching peer, which has its latest
+// address, or nil if the Peer is unknown
+func (peers *Peers) Get(peer *Peer) *Peer {
+	peers.mux.RLock()
+	defer peers.mux.RUnlock()
+	if _, p := peers.find(peer); p != nil {
+		known := *p
+		return &known
 	}
-	peers.P = newPeers
+	return nil
 }
 
 // Remove removes a Peer from the Peers
 func (peers *Peers) Remove(peer *Peer) {
 	peers.mux.Lock()
 	defer peers.mux.Unlock()
-	for i, p := range peers.P {
-		if PeerEquals(p, peer) {
-			// cut slice in 2 part and append without i-th element inbetween
-			peers.P = append(peers.P[:i], peers.P[i+1:]...)
-			break
-		}
+	if key, p := peers.find(peer); p != nil {
+		delete(peers.P, key)
 	}
 }
 
@@ -231,6 +615,69 @@ func (peers *Peers) Count() int {
 	return len(peers.P)
 }
 
+// Bound removes the peers with the lowest score until there are at most max
+// of them, the peers to keep being never removed, and returns the removed ones
+func (peers *Peers) Bound(max int, score func(*Peer) float64, keep func(*Peer) bool) []*Peer {
+	peers.mux.Lock()
+	defer peers.mux.Unlock()
+
+	var removed []*Peer
+	for len(peers.P) > max {
+		worstKey := ""
+		worstScore := 0.0
+		for key, p := range peers.P {
+			if keep(p) {
+				continue
+			}
+			if s := score(p); worstKey == "" || s < worstScore {
+				worstKey = key
+				worstScore = s
+			}
+		}
+		if worstKey == "" {
+			break
+		}
+		removed = append(removed, peers.P[worstKey])
+		delete(peers.P, worstKey)
+	}
+	return removed
+}
+
+// MarshalJSON serializes the Peers as a list, as they were before being
+// indexed by their Key
+func (peers *Peers) MarshalJSON() ([]byte, error) {
+	peers.mux.RLock()
+	defer peers.mux.RUnlock()
+
+	list := make([]*Peer, 0, len(peers.P))
+	for _, p := range peers.P {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key() < list[j].Key()
+	})
+	return json.Marshal(struct{ P []*Peer }{list})
+}
+
+// UnmarshalJSON deserializes Peers from a list of Peer
+func (peers *Peers) UnmarshalJSON(data []byte) error {
+	var list struct{ P []*Peer }
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+
+	peers.mux.Lock()
+	peers.P = make(map[string]*Peer)
+	peers.mux.Unlock()
+	for _, p := range list.P {
+		if p != nil {
+			peers.Add(p)
+		}
+	}
+	return nil
+}
+
 // WebsiteMap
 
 // Set adds/updates a website to the website map
@@ -249,6 +696,13 @@ func (wm *WebsiteMap) Get(name string) *Website {
 	return website
 }
 
+// Remove removes a website from the website map
+func (wm *WebsiteMap) Remove(name string) {
+	wm.mux.Lock()
+	defer wm.mux.Unlock()
+	delete(wm.W, name)
+}
+
 // GetIndices returns of copy of all indices
 func (wm *WebsiteMap) GetIndices() []string {
 	var indices []string
@@ -290,6 +744,19 @@ func (wm *WebsiteMap) RemovePeer(peer *Peer) {
 	}
 }
 
+// UpdatePeer updates the address and relay of a peer in the seeders lists it
+// is in
+func (wm *WebsiteMap) UpdatePeer(peer *Peer) {
+	wm.mux.Lock()
+	defer wm.mux.Unlock()
+
+	for _, w := range wm.W {
+		if w.Seeders.Contains(peer) {
+			w.Seeders.Add(peer)
+		}
+	}
+}
+
 // Count returns the number of websites stored in the WebsiteMap
 func (wm *WebsiteMap) Count() int {
 	wm.mux.RLock()
@@ -357,114 +824,449 @@ func (w *Website) Owned() bool {
 	return (err == nil)
 }
 
-// Sign scans the website folder hashing all files in order to create the
-// contents.json file with the website's signature
-func (w *Website) Sign() {
-	var hashes []byte
-	var contents = make(map[string]string)
+// Sign scans the website folder to build its Manifest, signs it with the
+// (unlocked) private key of the owner or of an editor and writes it as the
+// contents.json file at the root of the website
+func (w *Website) Sign(privKey *w2pcrypto.PrivateKey) error {
+	root := utils.WebsiteDir + w.Name
 
-	err := filepath.Walk(utils.WebsiteDir+w.Name, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.Mode().IsRegular() && info.Name() != "contents.json" {
-			data, err := ioutil.ReadFile(path)
-			if err != nil {
-				return err
-			}
-			hash := sha256.Sum256(data)
-			hashes = append(hashes, hash[:]...)
-			contents[path] = hex.EncodeToString(hash[:])
-		}
-		return nil
-	})
-	utils.CheckError(err)
+	manifest, err := BuildManifest(root)
+	if err != nil {
+		return err
+	}
 
-	privKey := w2pcrypto.LoadPrivateKey(w.Name)
-	sig := privKey.SignMessage(hashes)
-	contents["signature"] = sig
+	manifest.Signer = privKey.Public()
+	manifest.Signature = privKey.SignMessage(manifest.Bytes())
 
-	jsonData, err := json.Marshal(contents)
-	utils.CheckError(err)
+	jsonData, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
 
-	path := utils.WebsiteDir + w.Name + "/contents.json"
-	err = ioutil.WriteFile(path, jsonData, 0600)
-	utils.CheckError(err)
+	return ioutil.WriteFile(filepath.Join(root, utils.ManifestFile), jsonData, 0600)
 }
 
-// Verify verifies if the Website is signed by the owner
+// Verify verifies if the Website is signed by the owner or a delegated editor
+// and that its folder contains exactly the files listed in the signed Manifest
 func (w *Website) Verify() bool {
-	var hashes []byte
-	var contents = make(map[string]string)
-
-	path := utils.WebsiteDir + w.Name + "/contents.json"
-	data, err := ioutil.ReadFile(path)
-	utils.CheckError(err)
-
-	err = json.Unmarshal(data, &contents)
-	utils.CheckError(err)
-
-	// Verifying each file's hash
-	err = filepath.Walk(utils.WebsiteDir+w.Name, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.Mode().IsRegular() && info.Name() != "contents.json" {
-			data, err := ioutil.ReadFile(path)
-			if err != nil {
-				return err
-			}
+	root := utils.WebsiteDir + w.Name
 
-			hash := sha256.Sum256(data)
-			hashStr := hex.EncodeToString(hash[:])
-			if hashStr != contents[path] {
-				err = errors.New("VerificationError")
-				return err
-			}
+	signed, err := LoadManifest(root)
+	if err != nil {
+		return false
+	}
 
-			hashes = append(hashes, hash[:]...)
-			contents[path] = hex.EncodeToString(hash[:])
-		}
-		return nil
-	})
+	actual, err := BuildManifest(root)
 	if err != nil {
 		return false
 	}
 
-	// Verifying signature
-	return w.PubKey.VerifySignature(hashes, contents["signature"])
-}
+	// Rejects any missing, extra or modified file
+	if !signed.Equals(actual) {
+		return false
+	}
 
-// Bundle creates a compressed archive of a website folder for seeding
-func (w *Website) Bundle() {
-	file, err := os.Create(utils.SeedDir + w.Name)
-	defer file.Close()
-	utils.CheckError(err)
+	// Manifests signed before delegations were introduced have no signer
+	signer := signed.Signer
+	if signer == nil {
+		signer = w.PubKey
+	}
 
-	gzw := gzip.NewWriter(file)
-	defer gzw.Close()
+	// Verifying signature with the signer's algorithm
+	return w.VerifySigner(signer, signed.Bytes(), signed.Signature)
+}
 
-	tw := tar.NewWriter(gzw)
-	defer tw.Close()
+// VerifySigner verifies a signature made by the owner's key or by a currently
+// delegated editor key
+func (w *Website) VerifySigner(signer *w2pcrypto.PublicKey, msg []byte, signature string) bool {
+	if w.Revoked(signer) {
+		return false
+	}
+	if signer.String() == w.PubKey.String() {
+		return w.PubKey.VerifyAlgorithm(w.Algorithm(), msg, signature)
+	}
+	if !w.Delegated(signer) {
+		return false
+	}
+	return signer.VerifySignature(msg, signature)
+}
 
-	target := utils.WebsiteDir + w.Name
+// Delegated checks if the key is an editor key currently delegated by the
+// owner of the website
+func (w *Website) Delegated(key *w2pcrypto.PublicKey) bool {
+	// editor keys have to be modern keys
+	if key.Algorithm() == w2pcrypto.AlgLegacyRSA || w.Revoked(key) || !w.validDelegations() {
+		return false
+	}
 
-	err = filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	now := time.Now().Unix()
+	for _, d := range w.Delegations {
+		if d.EditorKey == nil || d.EditorKey.String() != key.String() {
+			continue
 		}
-
-		header, err := tar.FileInfoHeader(info, info.Name())
-		if err != nil {
-			return err
+		if d.Expiry != 0 && d.Expiry <= now {
+			continue
+		}
+		if w.PubKey.VerifyAlgorithm(w.Algorithm(), w.delegationMessage(d), d.Signature) {
+			return true
 		}
+	}
+	return false
+}
 
-		header.Name = path
+// delegationMessage returns the message signed by the owner to delegate an
+// editor key
+func (w *Website) delegationMessage(d *Delegation) []byte {
+	return []byte(w.Name + "|" + d.EditorKey.String() + "|" + strconv.FormatInt(d.Expiry, 10))
+}
 
-		log.Println("[BUNDLE]\t\tBundling '" + header.Name + "'")
+// delegationsMessage returns the message signed by the owner for the whole
+// list of delegations at its sequence number
+func (w *Website) delegationsMessage() []byte {
+	msg := "delegations|" + w.Name + "|" + strconv.Itoa(w.DelegationSeq)
+	for _, d := range w.Delegations {
+		msg += "|" + d.EditorKey.String() + "|" + strconv.FormatInt(d.Expiry, 10)
+	}
+	return []byte(msg)
+}
 
-		err = tw.WriteHeader(header)
-		if err != nil {
+// signDelegations signs the list of delegations as its next version
+func (w *Website) signDelegations(ownerKey *w2pcrypto.PrivateKey) {
+	w.DelegationSeq++
+	w.DelegationSignature = ownerKey.SignMessage(w.delegationsMessage())
+}
+
+// validDelegations checks that the list of delegations is the one signed by
+// the current owner key, a website which never delegated having none
+func (w *Website) validDelegations() bool {
+	if w.DelegationSeq == 0 {
+		return len(w.Delegations) == 0
+	}
+	for _, d := range w.Delegations {
+		if d == nil || d.EditorKey == nil {
+			return false
+		}
+	}
+	return w.PubKey.VerifyAlgorithm(w.Algorithm(), w.delegationsMessage(), w.DelegationSignature)
+}
+
+// Delegate allows the editor key to publish the website until expiry (0 for
+// no expiry), ownerKey being the owner's private key
+func (w *Website) Delegate(ownerKey *w2pcrypto.PrivateKey, editorKey *w2pcrypto.PublicKey, expiry int64) error {
+	if ownerKey.Public().String() != w.PubKey.String() {
+		return errors.New("only the owner of '" + w.Name + "' can delegate")
+	}
+	if editorKey.Algorithm() == w2pcrypto.AlgLegacyRSA {
+		return errors.New("editor keys cannot be legacy keys")
+	}
+	if w.Revoked(editorKey) {
+		return errors.New("cannot delegate a revoked key")
+	}
+
+	w.removeDelegation(editorKey)
+
+	d := &Delegation{
+		EditorKey: editorKey,
+		Expiry:    expiry,
+	}
+	d.Signature = ownerKey.SignMessage(w.delegationMessage(d))
+	w.Delegations = append(w.Delegations, d)
+	w.signDelegations(ownerKey)
+
+	return nil
+}
+
+// Undelegate removes the delegation of an editor key, ownerKey being the
+// owner's private key
+func (w *Website) Undelegate(ownerKey *w2pcrypto.PrivateKey, editorKey *w2pcrypto.PublicKey) error {
+	if ownerKey.Public().String() != w.PubKey.String() {
+		return errors.New("only the owner of '" + w.Name + "' can remove editors")
+	}
+
+	w.removeDelegation(editorKey)
+	w.signDelegations(ownerKey)
+	return nil
+}
+
+// removeDelegation removes the delegation of an editor key from the list, it
+// returns true if there was one
+func (w *Website) removeDelegation(editorKey *w2pcrypto.PublicKey) bool {
+	var delegations []*Delegation
+	for _, d := range w.Delegations {
+		if d.EditorKey != nil && d.EditorKey.String() != editorKey.String() {
+			delegations = append(delegations, d)
+		}
+	}
+	removed := len(delegations) != len(w.Delegations)
+	w.Delegations = delegations
+	return removed
+}
+
+// updateMessage returns the message signed when publishing a version of the
+// website, which covers the version of the delegations it was published with
+func (w *Website) updateMessage() []byte {
+	data, err := json.Marshal(struct {
+		Name          string
+		Version       int
+		Keywords      []string
+		PieceLength   int
+		Pieces        string
+		DelegationSeq int `json:",omitempty"`
+	}{w.Name, w.Version, w.Keywords, w.PieceLength, w.Pieces, w.DelegationSeq})
+	utils.CheckError(err)
+
+	return data
+}
+
+// SignUpdate signs the current version of the website with the private key
+// of the owner or of an editor
+func (w *Website) SignUpdate(privKey *w2pcrypto.PrivateKey) {
+	w.Signer = privKey.Public()
+	w.Signature = privKey.SignMessage(w.updateMessage())
+}
+
+// VerifyUpdate verifies that the current version of the website was signed by
+// the owner or a currently delegated editor
+func (w *Website) VerifyUpdate() bool {
+	if w.Signer == nil || w.PubKey == nil {
+		return false
+	}
+	return w.VerifySigner(w.Signer, w.updateMessage(), w.Signature)
+}
+
+// VerifyNewVersion verifies that rWeb, received from another node, is a valid
+// next version of the website: newer, signed by the owner or a currently
+// delegated editor, and with delegations at least as recent as the known ones.
+// Keys revoked locally stay revoked whatever the revocations of rWeb, and a
+// new owner key has to come from a valid rotation which keeps them revoked
+func (w *Website) VerifyNewVersion(rWeb *Website) bool {
+	if rWeb.Version <= w.Version || rWeb.DelegationSeq < w.DelegationSeq {
+		return false
+	}
+	if rWeb.Signer == nil || w.Revoked(rWeb.Signer) {
+		return false
+	}
+
+	if rWeb.PubKey == nil {
+		return false
+	}
+	if rWeb.PubKey.String() != w.PubKey.String() {
+		if !rWeb.VerifyRotation(w.PubKey) {
+			return false
+		}
+		for _, key := range w.RevokedKeys() {
+			if !rWeb.Revoked(key) {
+				return false
+			}
+		}
+	}
+
+	return rWeb.VerifyUpdate()
+}
+
+// Algorithm returns the algorithm of the website's key, websites published
+// before it was recorded use legacy RSA keys
+func (w *Website) Algorithm() w2pcrypto.Algorithm {
+	if w.KeyAlgorithm == "" {
+		return w2pcrypto.AlgLegacyRSA
+	}
+	return w.KeyAlgorithm
+}
+
+// rotationMessage returns the message signed by the old key of a rotation
+func (w *Website) rotationMessage(r *KeyRotation) []byte {
+	return []byte("rotate|" + w.Name + "|" + string(r.OldAlgorithm) + "|" +
+		r.OldPubKey.String() + "|" + r.NewPubKey.String())
+}
+
+// RotateKey moves the website to a new owner key, the rotation being signed by
+// the current owner's private key. Revocations and delegations are re-signed
+// with the new key and the website needs to be re-signed afterwards
+func (w *Website) RotateKey(oldPrivKey, newPrivKey *w2pcrypto.PrivateKey) error {
+	if oldPrivKey.Public().String() != w.PubKey.String() {
+		return errors.New("only the owner of '" + w.Name + "' can rotate its key")
+	}
+	if w.Revoked(newPrivKey.Public()) {
+		return errors.New("cannot rotate to a revoked key")
+	}
+
+	r := &KeyRotation{
+		OldPubKey:    w.PubKey,
+		OldAlgorithm: w.Algorithm(),
+		NewPubKey:    newPrivKey.Public(),
+	}
+	r.Signature = oldPrivKey.SignMessage(w.rotationMessage(r))
+
+	revoked := w.RevokedKeys()
+	var delegations []*Delegation
+	for _, d := range w.Delegations {
+		if d.EditorKey != nil && w.Delegated(d.EditorKey) {
+			delegations = append(delegations, d)
+		}
+	}
+
+	w.Rotations = append(w.Rotations, r)
+	w.PubKey = r.NewPubKey
+	w.KeyAlgorithm = newPrivKey.Algorithm()
+
+	// revocations and delegations are only valid when signed by the current
+	// owner key
+	w.Revocations = nil
+	for _, key := range revoked {
+		w.Revoke(newPrivKey, key)
+	}
+	w.Delegations = nil
+	for _, d := range delegations {
+		d = &Delegation{
+			EditorKey: d.EditorKey,
+			Expiry:    d.Expiry,
+		}
+		d.Signature = newPrivKey.SignMessage(w.delegationMessage(d))
+		w.Delegations = append(w.Delegations, d)
+	}
+	w.signDelegations(newPrivKey)
+
+	return nil
+}
+
+// VerifyRotation checks if the website's current key was reached by a valid
+// chain of rotations from the given key
+func (w *Website) VerifyRotation(from *w2pcrypto.PublicKey) bool {
+	start := -1
+	for i, r := range w.Rotations {
+		if r.OldPubKey != nil && r.OldPubKey.String() == from.String() {
+			start = i
+		}
+	}
+	if start < 0 {
+		return false
+	}
+
+	key := from
+	for _, r := range w.Rotations[start:] {
+		if r.OldPubKey == nil || r.NewPubKey == nil || r.OldPubKey.String() != key.String() {
+			return false
+		}
+		if !r.OldPubKey.VerifyAlgorithm(r.OldAlgorithm, w.rotationMessage(r), r.Signature) {
+			return false
+		}
+		key = r.NewPubKey
+	}
+
+	return key.String() == w.PubKey.String()
+}
+
+// revocationMessage returns the message signed by the owner to revoke a key
+func (w *Website) revocationMessage(key *w2pcrypto.PublicKey) []byte {
+	return []byte("revoke|" + w.Name + "|" + key.String())
+}
+
+// Revoke records that the key must not be trusted anymore for this website,
+// ownerKey being the current owner's private key. Revoked editor keys lose
+// their delegation
+func (w *Website) Revoke(ownerKey *w2pcrypto.PrivateKey, key *w2pcrypto.PublicKey) error {
+	if ownerKey.Public().String() != w.PubKey.String() {
+		return errors.New("only the owner of '" + w.Name + "' can revoke keys")
+	}
+	if key.String() == w.PubKey.String() {
+		return errors.New("cannot revoke the current owner key, rotate it first")
+	}
+
+	if w.removeDelegation(key) {
+		w.signDelegations(ownerKey)
+	}
+	if w.Revoked(key) {
+		return nil
+	}
+
+	w.Revocations = append(w.Revocations, &Revocation{
+		Key:       key,
+		Signature: ownerKey.SignMessage(w.revocationMessage(key)),
+	})
+
+	return nil
+}
+
+// validRevocation checks if a revocation is signed by the current owner key
+func (w *Website) validRevocation(r *Revocation) bool {
+	if r == nil || r.Key == nil || r.Key.String() == w.PubKey.String() {
+		return false
+	}
+	return w.PubKey.VerifyAlgorithm(w.Algorithm(), w.revocationMessage(r.Key), r.Signature)
+}
+
+// Revoked checks if the key was revoked by the owner of the website
+func (w *Website) Revoked(key *w2pcrypto.PublicKey) bool {
+	for _, r := range w.Revocations {
+		if r.Key != nil && r.Key.String() == key.String() && w.validRevocation(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// RevokedKeys returns the keys validly revoked by the owner of the website
+func (w *Website) RevokedKeys() []*w2pcrypto.PublicKey {
+	var keys []*w2pcrypto.PublicKey
+	for _, r := range w.Revocations {
+		if w.validRevocation(r) {
+			keys = append(keys, r.Key)
+		}
+	}
+	return keys
+}
+
+// MergeRevocations adds the valid revocations not yet known, it returns true
+// if any was added. The delegations of the revoked keys, signed by the owner,
+// are kept but not trusted anymore
+func (w *Website) MergeRevocations(revocations []*Revocation) bool {
+	added := false
+	for _, r := range revocations {
+		if r != nil && r.Key != nil && !w.Revoked(r.Key) && w.validRevocation(r) {
+			w.Revocations = append(w.Revocations, r)
+			added = true
+		}
+	}
+	return added
+}
+
+// Bundle creates a compressed archive of a website folder for seeding
+func (w *Website) Bundle() error {
+	file, err := os.Create(utils.SeedDir + w.Name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzw := gzip.NewWriter(file)
+	defer gzw.Close()
+
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	target := utils.WebsiteDir + w.Name
+
+	err = filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, info.Name())
+		if err != nil {
+			return err
+		}
+
+		// paths are relative to the WebsiteDir, which depends on the node
+		rel, err := filepath.Rel(utils.WebsiteDir, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+
+		log.Println("[BUNDLE]\t\tBundling '" + path + "'")
+
+		err = tw.WriteHeader(header)
+		if err != nil {
 			return err
 		}
 
@@ -486,21 +1288,35 @@ func (w *Website) Bundle() {
 
 		return nil
 	})
-	utils.CheckError(err)
+	if err != nil {
+		return err
+	}
+
+	// the archive is only complete once flushed
+	err = tw.Close()
+	if err == nil {
+		err = gzw.Close()
+	}
+	return err
 }
 
 // Unbundle uncompress and unarchive a website to display it
-func (w *Website) Unbundle() {
+func (w *Website) Unbundle() error {
 	// remove everything before undbundling
 	os.RemoveAll(utils.WebsiteDir + w.Name)
 
 	archive, err := os.Open(utils.SeedDir + w.Name)
+	if err != nil {
+		return err
+	}
 	defer archive.Close()
-	utils.CheckError(err)
 
+	// the archive comes from other nodes, errors are not fatal
 	gzr, err := gzip.NewReader(archive)
+	if err != nil {
+		return err
+	}
 	defer gzr.Close()
-	utils.CheckError(err)
 
 	tr := tar.NewReader(gzr)
 
@@ -509,9 +1325,22 @@ func (w *Website) Unbundle() {
 		if err == io.EOF {
 			break
 		}
-		utils.CheckError(err)
+		if err != nil {
+			return err
+		}
 
-		target := header.Name
+		// bundles made before paths were relative to the WebsiteDir start
+		// with the owner's one ("website/")
+		parts := strings.Split(path.Clean(header.Name), "/")
+		if len(parts) > 1 && parts[0] != w.Name && parts[1] == w.Name {
+			parts = parts[1:]
+		}
+		if parts[0] != w.Name {
+			log.Println("[UNBUNDLE]\t\tSkipping '" + header.Name + "' outside of the website")
+			continue
+		}
+
+		target := utils.WebsiteDir + filepath.FromSlash(strings.Join(parts, "/"))
 		log.Println("[UNBUNDLE]\t\tUnbundling '" + target + "'")
 
 		switch header.Typeflag {
@@ -519,28 +1348,53 @@ func (w *Website) Unbundle() {
 			_, err := os.Stat(target)
 			if err != nil {
 				err = os.MkdirAll(target, 0755)
-				utils.CheckError(err)
+				if err != nil {
+					return err
+				}
 			}
 
 		case tar.TypeReg:
 			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
-			defer f.Close()
-			utils.CheckError(err)
-
+			if err != nil {
+				return err
+			}
 			_, err = io.Copy(f, tr)
-			utils.CheckError(err)
+			f.Close()
+			if err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
 // GenPieces generates the pieces from the website archive and set it in
 // the Website object
-func (w *Website) GenPieces(pieceLength int) {
+func (w *Website) GenPieces(pieceLength int) error {
+	data, err := ioutil.ReadFile(utils.SeedDir + w.Name)
+	if err != nil {
+		return err
+	}
 	w.PieceLength = pieceLength
+	w.Pieces = hashPieces(data, pieceLength)
+	return nil
+}
 
+// Seeded checks if the node holds the archive of the current version of the
+// website, the one whose pieces are the Pieces
+func (w *Website) Seeded() bool {
+	if w.PieceLength <= 0 || w.Pieces == "" {
+		return false
+	}
 	data, err := ioutil.ReadFile(utils.SeedDir + w.Name)
-	utils.CheckError(err)
+	if err != nil {
+		return false
+	}
+	return hashPieces(data, w.PieceLength) == w.Pieces
+}
 
+// hashPieces returns the hashes of the pieces of data
+func hashPieces(data []byte, pieceLength int) string {
 	dataSize := len(data)
 	var chunk []byte
 	var pieces string
@@ -558,59 +1412,608 @@ func (w *Website) GenPieces(pieceLength int) {
 		pieces = pieces + hash
 	}
 
-	w.Pieces = pieces
+	return pieces
 }
 
 // ClearSeeders removes all seeders for a website
 func (w *Website) ClearSeeders() {
 	w.Seeders.mux.Lock()
 	defer w.Seeders.mux.Unlock()
-	w.Seeders.P = make([]*Peer, 0, 5)
+	w.Seeders.P = make(map[string]*Peer)
+}
+
+// Identity
+
+// Seal encrypts the Identity with a passphrase into a bundle that can be
+// imported by another node
+func (id *Identity) Seal(passphrase []byte) ([]byte, error) {
+	// the private key is only serialized here, to be encrypted
+	data, err := json.Marshal(struct {
+		Website *Website
+		PrivKey string
+	}{id.Website, id.PrivKey.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	return w2pcrypto.EncryptPEM(identityPEMType, data, passphrase)
+}
+
+// Manifest
+
+// Bytes returns the canonical serialization of the Manifest's files, which
+// is the message being signed
+func (m *Manifest) Bytes() []byte {
+	files := m.Files
+	if files == nil {
+		files = []ManifestEntry{}
+	}
+
+	data, err := json.Marshal(files)
+	utils.CheckError(err)
+
+	return data
+}
+
+// Equals checks if two manifests list exactly the same files (the signature
+// is not compared)
+func (m *Manifest) Equals(other *Manifest) bool {
+	if len(m.Files) != len(other.Files) {
+		return false
+	}
+	for i, f := range m.Files {
+		if f != other.Files[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PeerState
+
+// String returns the name of the PeerState
+func (s PeerState) String() string {
+	switch s {
+	case PeerAlive:
+		return "alive"
+	case PeerSuspect:
+		return "suspect"
+	case PeerDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Membership
+
+// Seen marks peer alive, returning its previous state (PeerDead for a peer
+// rejoining or never seen before)
+func (m *Membership) Seen(peer *Peer) PeerState {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	now := time.Now()
+	member := m.M[peer.Key()]
+
+	// a peer first known by its address only
+	if member == nil && peer.ID != "" {
+		if byAddr := m.M[peer.String()]; byAddr != nil && byAddr.Peer.ID == "" {
+			member = byAddr
+			delete(m.M, peer.String())
+		}
+	}
+
+	if member == nil {
+		m.M[peer.Key()] = &Member{
+			Peer:     peer,
+			State:    PeerAlive,
+			Since:    now,
+			LastSeen: now,
+		}
+		return PeerDead
+	}
+
+	previous := member.State
+	member.Peer = peer
+	member.LastSeen = now
+	if member.State != PeerAlive {
+		member.State = PeerAlive
+		member.Since = now
+	}
+	m.M[peer.Key()] = member
+	return previous
+}
+
+// Suspect marks an alive peer as suspect, returning false if it was not alive
+func (m *Membership) Suspect(peer *Peer) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	member := m.M[peer.Key()]
+	if member == nil {
+		member = &Member{Peer: peer}
+		m.M[peer.Key()] = member
+	} else if member.State != PeerAlive {
+		return false
+	}
+	member.State = PeerSuspect
+	member.Since = time.Now()
+	return true
+}
+
+// State returns the state of peer, a peer never seen being alive
+func (m *Membership) State(peer *Peer) PeerState {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	member := m.M[peer.Key()]
+	if member == nil {
+		return PeerAlive
+	}
+	return member.State
+}
+
+// Expire marks dead the peers suspected for longer than timeout and returns
+// them, peers dead for longer than deadTimeout being forgotten
+func (m *Membership) Expire(timeout, deadTimeout time.Duration) []*Peer {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var dead []*Peer
+	now := time.Now()
+	for key, member := range m.M {
+		if member.State == PeerSuspect && now.Sub(member.Since) > timeout {
+			member.State = PeerDead
+			member.Since = now
+			dead = append(dead, member.Peer)
+		} else if member.State == PeerDead && now.Sub(member.Since) > deadTimeout {
+			delete(m.M, key)
+		}
+	}
+	return dead
+}
+
+// Next returns the next of peers to probe, going through them in a random
+// order renewed every round, or nil if there are no peers
+func (m *Membership) Next(peers *Peers) *Peer {
+	// Peers are not locked within the Membership, Bound doing the opposite
+	all := peers.GetAll()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if len(m.round) == 0 {
+		m.round = all
+		rand.Shuffle(len(m.round), func(i, j int) {
+			m.round[i], m.round[j] = m.round[j], m.round[i]
+		})
+	}
+	if len(m.round) == 0 {
+		return nil
+	}
+
+	next := m.round[0]
+	m.round = m.round[1:]
+	return &next
+}
+
+// Sample returns at most k random alive peers, other than the given ones
+func (m *Membership) Sample(peers *Peers, k int, except ...*Peer) []*Peer {
+	all := peers.GetAll()
+	rand.Shuffle(len(all), func(i, j int) {
+		all[i], all[j] = all[j], all[i]
+	})
+
+	var sample []*Peer
+	for i := range all {
+		if len(sample) >= k {
+			break
+		}
+		p := &all[i]
+		excluded := false
+		for _, e := range except {
+			excluded = excluded || PeerEquals(p, e)
+		}
+		if !excluded && m.State(p) == PeerAlive {
+			sample = append(sample, p)
+		}
+	}
+	return sample
+}
+
+// SetRTT records the round trip time of a heartbeat answered by peer
+func (m *Membership) SetRTT(peer *Peer, rtt time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if member := m.M[peer.Key()]; member != nil {
+		member.RTT = rtt
+	}
+}
+
+// AddGood records that peer sent a good piece
+func (m *Membership) AddGood(peer *Peer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if member := m.M[peer.Key()]; member != nil {
+		member.Good++
+	}
+}
+
+// AddBad records that peer sent a bad piece, returning how many it sent
+func (m *Membership) AddBad(peer *Peer) int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	member := m.M[peer.Key()]
+	if member == nil {
+		return 1
+	}
+	member.Bad++
+	return member.Bad
+}
+
+// AddTimeout records that peer did not answer a request for a piece
+func (m *Membership) AddTimeout(peer *Peer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if member := m.M[peer.Key()]; member != nil {
+		member.Timeouts++
+	}
 }
 
-// Counter
+// Reputation rates between 0 and 1 how reliably peer serves pieces, a bad
+// piece counting as much as 4 timeouts and an unknown peer rating 0.5
+func (m *Membership) Reputation(peer *Peer) float64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.reputation(m.M[peer.Key()])
+}
+
+// reputation rates member, which may be nil
+func (m *Membership) reputation(member *Member) float64 {
+	if member == nil {
+		return 0.5
+	}
+	good := float64(member.Good + 1)
+	return good / (good + float64(4*member.Bad+member.Timeouts+1))
+}
+
+// Score rates peer by its uptime (up to an hour), latency and reputation, each
+// counting for at most 1, a peer which is not alive scoring 0 and an unknown
+// one as much as a peer just seen
+func (m *Membership) Score(peer *Peer) float64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	member := m.M[peer.Key()]
+	if member == nil {
+		return 1
+	}
+	if member.State != PeerAlive {
+		return 0
+	}
 
-// Read returns the current value
-func (c *Counter) Read() int {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
-	return c.C
+	uptime := math.Min(time.Since(member.Since).Hours(), 1)
+	latency := 0.5
+	if member.RTT > 0 {
+		latency = 1 / (1 + member.RTT.Seconds()*10)
+	}
+	return uptime + latency + m.reputation(member)
 }
 
-// Inc adds 1 to the current value
-func (c *Counter) Inc() {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	c.C++
+// Forget removes what is known about peer
+func (m *Membership) Forget(peer *Peer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.M, peer.Key())
 }
 
-// Dec substracts 1 from the current value
-func (c *Counter) Dec() {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	if (c.C - 1) < 0 {
-		c.C = 0
+// StartProbe marks peer as being probed, returning false if it already is
+func (m *Membership) StartProbe(peer *Peer) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.probing[peer.Key()] {
+		return false
+	}
+	m.probing[peer.Key()] = true
+	return true
+}
+
+// EndProbe marks the probe of peer as done
+func (m *Membership) EndProbe(peer *Peer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.probing, peer.Key())
+}
+
+// TokenBuckets
+
+// Allow takes a token from the bucket of key, returning false if it is empty
+func (tb *TokenBuckets) Allow(key string) bool {
+	tb.mux.Lock()
+	defer tb.mux.Unlock()
+
+	now := time.Now()
+	if len(tb.B) >= tb.prune {
+		for k, b := range tb.B {
+			if b.tokens+now.Sub(b.last).Seconds()*tb.Rate >= tb.Burst {
+				delete(tb.B, k)
+			}
+		}
+		tb.prune = 2*len(tb.B) + 64
+	}
+
+	b := tb.B[key]
+	if b == nil {
+		b = &tokenBucket{tokens: tb.Burst, last: now}
+		tb.B[key] = b
+	}
+	b.tokens = math.Min(tb.Burst, b.tokens+now.Sub(b.last).Seconds()*tb.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Throttle
+
+// Wait blocks until size bytes can be transferred at the Throttle's rate, a
+// second of transfer being allowed at once
+func (t *Throttle) Wait(size int) {
+	t.mux.Lock()
+	if t.Rate <= 0 {
+		t.mux.Unlock()
+		return
+	}
+
+	now := time.Now()
+	rate := float64(t.Rate)
+	t.tokens = math.Min(rate, t.tokens+now.Sub(t.last).Seconds()*rate)
+	t.last = now
+
+	// the bytes are reserved now, waiting for the tokens if they are missing
+	t.tokens -= float64(size)
+	wait := time.Duration(-t.tokens / rate * float64(time.Second))
+	t.mux.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// SetRate changes the rate of the Throttle, 0 removing the cap
+func (t *Throttle) SetRate(rate int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.Rate = rate
+	t.tokens = 0
+	t.last = time.Now()
+}
+
+// Bandwidth
+
+// Wait blocks until size bytes of website can be transferred within both the
+// cap of the website and the global one
+func (b *Bandwidth) Wait(website string, size int) {
+	b.mux.Lock()
+	site := b.Sites[website]
+	b.mux.Unlock()
+
+	if site != nil {
+		site.Wait(size)
+	}
+	b.Global.Wait(size)
+}
+
+// SetRate caps the rate of website, or the global one if website is empty,
+// at rate bytes per second, 0 removing the cap
+func (b *Bandwidth) SetRate(website string, rate int) {
+	if website == "" {
+		b.Global.SetRate(rate)
+		return
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if rate <= 0 {
+		delete(b.Sites, website)
+	} else if site := b.Sites[website]; site != nil {
+		site.SetRate(rate)
 	} else {
-		c.C--
+		b.Sites[website] = &Throttle{Rate: rate, last: time.Now()}
+	}
+}
+
+// Rates returns the caps in bytes per second, the global one being indexed
+// by an empty website name
+func (b *Bandwidth) Rates() map[string]int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	rates := make(map[string]int)
+	b.Global.mux.Lock()
+	rates[""] = b.Global.Rate
+	b.Global.mux.Unlock()
+	for name, site := range b.Sites {
+		site.mux.Lock()
+		rates[name] = site.Rate
+		site.mux.Unlock()
+	}
+	return rates
+}
+
+// Bans
+
+// Ban bans peer, by its ID and its address if it has them, for duration d
+func (b *Bans) Ban(peer *Peer, d time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	until := time.Now().Add(d)
+	if peer.ID != "" {
+		b.B[peer.ID] = until
+	}
+	if peer.Addr != nil {
+		b.B[peer.String()] = until
+	}
+}
+
+// Banned tells if peer is banned, by its Key or its address
+func (b *Bans) Banned(peer *Peer) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+	banned := false
+	for _, key := range []string{peer.Key(), peer.String()} {
+		if until, ok := b.B[key]; ok && now.After(until) {
+			delete(b.B, key)
+		} else if ok {
+			banned = true
+		}
 	}
+	return banned
 }
 
 // Routing table
 
-// Get returns the value peer through which to send the packet or dst
-func (rt *RoutingTable) Get(dst string) *Peer {
+// Get returns the peer through which to send the packet for dst, its relay
+// or dst itself if no route is known
+func (rt *RoutingTable) Get(dst *Peer) *Peer {
 	rt.mux.Lock()
 	defer rt.mux.Unlock()
-	via := rt.R[dst]
-	if via == nil {
-		via = ParsePeer(dst)
+	via := rt.R[dst.Key()]
+	if via == nil && dst.Relay != nil {
+		via = dst.Relay
+	} else if via == nil {
+		via = dst
 	}
 	return via
 }
 
 // Set adds a new entry or updates an existing one in the routing table
-func (rt *RoutingTable) Set(dst string, via *Peer) {
+func (rt *RoutingTable) Set(dst, via *Peer) {
 	rt.mux.Lock()
 	defer rt.mux.Unlock()
-	rt.R[dst] = via
+	rt.R[dst.Key()] = via
+}
+
+// Unpacker
+
+// Add writes the contents of r as the file name, a path relative to the Dir
+// with slashes or backslashes as separators
+func (u *Unpacker) Add(name string, r io.Reader) error {
+	if u.files >= u.MaxFiles {
+		return ErrTooManyFiles
+	}
+	u.files++
+
+	target, err := u.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// one more byte than allowed tells the file is too large
+	n, err := io.Copy(f, io.LimitReader(r, u.MaxSize-u.size+1))
+	u.size += n
+	if err != nil {
+		return err
+	}
+	if u.size > u.MaxSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// AddArchive writes the files of a zip, tar or gzipped tar archive of the
+// given size, skipping its links and special files
+func (u *Unpacker) AddArchive(archive io.ReaderAt, size int64) error {
+	magic := make([]byte, 4)
+	archive.ReadAt(magic, 0)
+
+	if string(magic) == "PK\x03\x04" {
+		zr, err := zip.NewReader(archive, size)
+		if err != nil {
+			return err
+		}
+		for _, file := range zr.File {
+			// the resource forks added by macOS are not part of the website
+			if file.FileInfo().IsDir() || !file.Mode().IsRegular() ||
+				strings.HasPrefix(file.Name, "__MACOSX/") {
+				continue
+			}
+			rc, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = u.Add(file.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = io.NewSectionReader(archive, 0, size)
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gzr.Close()
+		r = gzr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("not a zip, tar or tar.gz archive: " + err.Error())
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = u.Add(header.Name, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Root returns the folder containing the website: the Dir, or its only
+// folder when everything was in one (as in the archive of a folder), and
+// whether it is that folder
+func (u *Unpacker) Root() (string, bool) {
+	entries, err := ioutil.ReadDir(u.Dir)
+	if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+		return u.Dir, false
+	}
+	return filepath.Join(u.Dir, entries[0].Name()), true
+}
+
+// path returns where to write the file name, which has to be in the Dir
+func (u *Unpacker) path(name string) (string, error) {
+	clean := path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	if clean == "/" || strings.Contains(name, ":") {
+		return "", errors.New("invalid file name '" + name + "'")
+	}
+	// the leading slash keeps ".." from leaving the Dir
+	return filepath.Join(u.Dir, filepath.FromSlash(clean[1:])), nil
 }
@@ -0,0 +1,1261 @@
+package structs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yaanst/W2P/utils"
+	"github.com/yaanst/W2P/w2pcrypto"
+)
+
+// -----------
+// - Helpers -
+// -----------
+
+// useTempDirs points the directories of the websites to a temporary folder
+// for the duration of the test
+func useTempDirs(t *testing.T) string {
+	t.Helper()
+	tmp := t.TempDir()
+
+	websiteDir, metadataDir, seedDir := utils.WebsiteDir, utils.MetadataDir, utils.SeedDir
+	t.Cleanup(func() {
+		utils.WebsiteDir, utils.MetadataDir, utils.SeedDir = websiteDir, metadataDir, seedDir
+	})
+
+	utils.WebsiteDir = filepath.Join(tmp, "website") + "/"
+	utils.MetadataDir = filepath.Join(tmp, "metadata") + "/"
+	utils.SeedDir = filepath.Join(tmp, "seed") + "/"
+	for _, dir := range []string{utils.WebsiteDir, utils.MetadataDir, utils.SeedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tmp
+}
+
+// writeFiles writes the files, indexed by their slash-separated path, in the
+// folder root
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestWebsite creates a website with a few files in the WebsiteDir, owned
+// by a new Ed25519 key and signed with it
+func newTestWebsite(t *testing.T, name string) (*Website, *w2pcrypto.PrivateKey) {
+	t.Helper()
+	writeFiles(t, utils.WebsiteDir+name, map[string]string{
+		"index.html":  "<h1>" + name + "</h1>",
+		"css/m.css":   "h1 { color: red; }",
+		"img/a/b.txt": "b",
+	})
+
+	privKey, pubKey := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+	website := NewWebsite(name, []string{"test"}, pubKey)
+	if err := website.Sign(privKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := website.Bundle(); err != nil {
+		t.Fatal(err)
+	}
+	if err := website.GenPieces(utils.DefaultPieceLength); err != nil {
+		t.Fatal(err)
+	}
+	website.SignUpdate(privKey)
+	return website, privKey
+}
+
+// writeManifest replaces the manifest of the website at root
+func writeManifest(t *testing.T, root string, manifest *Manifest) {
+	t.Helper()
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, utils.ManifestFile), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// copyWebsite returns a copy of the website as received from another node
+func copyWebsite(t *testing.T, website *Website) *Website {
+	t.Helper()
+	data, err := json.Marshal(website)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Website{}
+	if err := json.Unmarshal(data, c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newVersion returns the next version of the website signed by privKey
+func newVersion(t *testing.T, website *Website, privKey *w2pcrypto.PrivateKey) *Website {
+	t.Helper()
+	rWeb := copyWebsite(t, website)
+	rWeb.IncVersion()
+	rWeb.SignUpdate(privKey)
+	return rWeb
+}
+
+// zipArchive returns a zip archive of the files, in the given order
+func zipArchive(t *testing.T, names []string) *bytes.Reader {
+	t.Helper()
+	b := bytes.Buffer{}
+	zw := zip.NewWriter(&b)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(name))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b.Bytes())
+}
+
+// tarArchive returns a tar archive of the headers, regular files holding their
+// name
+func tarArchive(t *testing.T, headers []*tar.Header) *bytes.Reader {
+	t.Helper()
+	b := bytes.Buffer{}
+	tw := tar.NewWriter(&b)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			tw.Write([]byte(header.Name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b.Bytes())
+}
+
+// listFiles returns the slash-separated paths of the files under root
+func listFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files
+}
+
+// udpAddr returns the UDP address s
+func udpAddr(t *testing.T, s string) *net.UDPAddr {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// peerKeys returns the sorted keys of the peers
+func peerKeys(peers *Peers) []string {
+	var keys []string
+	for key := range peers.P {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ---------
+// - Tests -
+// ---------
+
+func TestManifestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, root string)
+		valid  bool
+	}{
+		{"unchanged", func(t *testing.T, root string) {}, true},
+		{"modified file", func(t *testing.T, root string) {
+			writeFiles(t, root, map[string]string{"index.html": "<h1>defaced</h1>"})
+		}, false},
+		{"extra file", func(t *testing.T, root string) {
+			writeFiles(t, root, map[string]string{"evil.js": "alert(1)"})
+		}, false},
+		{"missing file", func(t *testing.T, root string) {
+			os.Remove(filepath.Join(root, "css", "m.css"))
+		}, false},
+		{"renamed file", func(t *testing.T, root string) {
+			os.Rename(filepath.Join(root, "img", "a", "b.txt"), filepath.Join(root, "img", "b.txt"))
+		}, false},
+		{"missing manifest", func(t *testing.T, root string) {
+			os.Remove(filepath.Join(root, utils.ManifestFile))
+		}, false},
+		{"manifest signed by another key", func(t *testing.T, root string) {
+			manifest, err := BuildManifest(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+			manifest.Signer = other.Public()
+			manifest.Signature = other.SignMessage(manifest.Bytes())
+			writeManifest(t, root, manifest)
+		}, false},
+		{"manifest without signer signed by another key", func(t *testing.T, root string) {
+			manifest, err := BuildManifest(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+			manifest.Signature = other.SignMessage(manifest.Bytes())
+			writeManifest(t, root, manifest)
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTempDirs(t)
+			website, _ := newTestWebsite(t, "site")
+
+			test.change(t, utils.WebsiteDir+website.Name)
+			if got := website.Verify(); got != test.valid {
+				t.Errorf("Verify() = %v, want %v", got, test.valid)
+			}
+		})
+	}
+}
+
+func TestManifestPathIndependent(t *testing.T) {
+	tmp := useTempDirs(t)
+	website, _ := newTestWebsite(t, "site")
+
+	// the same website stored in another WebsiteDir still verifies
+	moved := filepath.Join(tmp, "elsewhere") + "/"
+	if err := os.Rename(utils.WebsiteDir, moved); err != nil {
+		t.Fatal(err)
+	}
+	utils.WebsiteDir = moved
+
+	if !website.Verify() {
+		t.Error("website does not verify once moved")
+	}
+}
+
+func TestManifestBytesCanonical(t *testing.T) {
+	useTempDirs(t)
+	root := utils.WebsiteDir + "site"
+	writeFiles(t, root, map[string]string{"b.html": "b", "a/c.html": "c", "a.html": "a"})
+
+	first, err := BuildManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := BuildManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(first.Bytes()) != string(second.Bytes()) {
+		t.Error("manifest bytes differ between two builds")
+	}
+	var paths []string
+	for _, f := range first.Files {
+		paths = append(paths, f.Path)
+	}
+	want := []string{"a.html", "a/c.html", "b.html"}
+	if len(paths) != len(want) {
+		t.Fatalf("paths = %v, want %v", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("paths = %v, want %v", paths, want)
+		}
+	}
+}
+
+func TestDelegationUpdate(t *testing.T) {
+	editorKey, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+	otherKey, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+
+	tests := []struct {
+		name   string
+		remote func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website
+		valid  bool
+	}{
+		{"owner update", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			return newVersion(t, lWeb, ownerKey)
+		}, true},
+		{"editor update", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			return newVersion(t, lWeb, editorKey)
+		}, true},
+		{"expired editor", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 1)
+			return newVersion(t, lWeb, editorKey)
+		}, false},
+		{"editor until a later expiry", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), time.Now().Add(time.Hour).Unix())
+			return newVersion(t, lWeb, editorKey)
+		}, true},
+		{"editor expired since", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), time.Now().Unix())
+			return newVersion(t, lWeb, editorKey)
+		}, false},
+		{"stale delegation sequence", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			old := copyWebsite(t, lWeb)
+			lWeb.Delegate(ownerKey, otherKey.Public(), 0)
+			old.Version = lWeb.Version
+			return newVersion(t, old, editorKey)
+		}, false},
+		{"revoked editor", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			if err := lWeb.Revoke(ownerKey, editorKey.Public()); err != nil {
+				t.Fatal(err)
+			}
+			return newVersion(t, lWeb, editorKey)
+		}, false},
+		{"revoked editor with older delegations", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			old := copyWebsite(t, lWeb)
+			lWeb.Revoke(ownerKey, editorKey.Public())
+			old.Version = lWeb.Version
+			old.DelegationSeq = lWeb.DelegationSeq
+			return newVersion(t, old, editorKey)
+		}, false},
+		{"editor revoked by the owner only", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			rWeb := copyWebsite(t, lWeb)
+			rWeb.Revocations = []*Revocation{{
+				Key:       editorKey.Public(),
+				Signature: otherKey.SignMessage(rWeb.revocationMessage(editorKey.Public())),
+			}}
+			return newVersion(t, rWeb, editorKey)
+		}, true},
+		{"not delegated", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			return newVersion(t, lWeb, otherKey)
+		}, false},
+		{"older version", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			rWeb := copyWebsite(t, lWeb)
+			lWeb.IncVersion()
+			return rWeb
+		}, false},
+		{"no signer", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			rWeb := newVersion(t, lWeb, ownerKey)
+			rWeb.Signer, rWeb.Signature = nil, ""
+			return rWeb
+		}, false},
+		{"undelegated editor with older delegations", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			old := copyWebsite(t, lWeb)
+			if err := lWeb.Undelegate(ownerKey, editorKey.Public()); err != nil {
+				t.Fatal(err)
+			}
+			old.Version = lWeb.Version
+			return newVersion(t, old, editorKey)
+		}, false},
+		{"undelegated editor adding back its delegation", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			delegations := lWeb.Delegations
+			lWeb.Undelegate(ownerKey, editorKey.Public())
+			rWeb := copyWebsite(t, lWeb)
+			rWeb.Delegations = delegations
+			return newVersion(t, rWeb, editorKey)
+		}, false},
+		{"delegations signed by an editor", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			rWeb := copyWebsite(t, lWeb)
+			d := &Delegation{EditorKey: editorKey.Public()}
+			d.Signature = editorKey.SignMessage(rWeb.delegationMessage(d))
+			rWeb.Delegations = []*Delegation{d}
+			rWeb.DelegationSeq++
+			rWeb.DelegationSignature = editorKey.SignMessage(rWeb.delegationsMessage())
+			return newVersion(t, rWeb, editorKey)
+		}, false},
+		{"delegation sequence changed", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			rWeb := copyWebsite(t, lWeb)
+			rWeb.DelegationSeq++
+			return newVersion(t, rWeb, editorKey)
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTempDirs(t)
+			lWeb, ownerKey := newTestWebsite(t, "site")
+
+			rWeb := test.remote(t, lWeb, ownerKey)
+			if got := lWeb.VerifyNewVersion(rWeb); got != test.valid {
+				t.Errorf("VerifyNewVersion() = %v, want %v", got, test.valid)
+			}
+		})
+	}
+}
+
+func TestUndelegate(t *testing.T) {
+	useTempDirs(t)
+	website, ownerKey := newTestWebsite(t, "site")
+	editorKey, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+
+	if err := website.Delegate(ownerKey, editorKey.Public(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if !website.Delegated(editorKey.Public()) {
+		t.Fatal("editor not delegated")
+	}
+	if err := website.Undelegate(editorKey, editorKey.Public()); err == nil {
+		t.Error("editor removed its own delegation")
+	}
+	if err := website.Undelegate(ownerKey, editorKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+	if website.Delegated(editorKey.Public()) {
+		t.Error("editor still delegated")
+	}
+	if website.DelegationSeq != 2 {
+		t.Errorf("DelegationSeq = %v, want 2", website.DelegationSeq)
+	}
+}
+
+func TestRevocationUpdate(t *testing.T) {
+	editorKey, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+	newOwnerKey, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+
+	tests := []struct {
+		name   string
+		remote func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website
+		valid  bool
+	}{
+		{"revoked editor", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			lWeb.Revoke(ownerKey, editorKey.Public())
+			return newVersion(t, lWeb, editorKey)
+		}, false},
+		{"revoked editor dropping its revocation", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Delegate(ownerKey, editorKey.Public(), 0)
+			old := copyWebsite(t, lWeb)
+
+			// only the revocation reached this node
+			revoked := copyWebsite(t, lWeb)
+			revoked.Revoke(ownerKey, editorKey.Public())
+			lWeb.MergeRevocations(revoked.Revocations)
+
+			old.Version = math.MaxInt32 - 1
+			return newVersion(t, old, editorKey)
+		}, false},
+		{"rotation", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Revoke(ownerKey, editorKey.Public())
+			rWeb := copyWebsite(t, lWeb)
+			rWeb.RotateKey(ownerKey, newOwnerKey)
+			return newVersion(t, rWeb, newOwnerKey)
+		}, true},
+		{"rotation dropping revocations", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			lWeb.Revoke(ownerKey, editorKey.Public())
+			rWeb := copyWebsite(t, lWeb)
+			rWeb.RotateKey(ownerKey, newOwnerKey)
+			rWeb.Revocations = nil
+			return newVersion(t, rWeb, newOwnerKey)
+		}, false},
+		{"rotation signed by another key", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			rWeb := copyWebsite(t, lWeb)
+			rWeb.RotateKey(ownerKey, newOwnerKey)
+			rWeb.Rotations[0].Signature = editorKey.SignMessage(rWeb.rotationMessage(rWeb.Rotations[0]))
+			return newVersion(t, rWeb, newOwnerKey)
+		}, false},
+		{"new key without rotation", func(t *testing.T, lWeb *Website, ownerKey *w2pcrypto.PrivateKey) *Website {
+			rWeb := copyWebsite(t, lWeb)
+			rWeb.PubKey = newOwnerKey.Public()
+			rWeb.KeyAlgorithm = newOwnerKey.Algorithm()
+			return newVersion(t, rWeb, newOwnerKey)
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTempDirs(t)
+			lWeb, ownerKey := newTestWebsite(t, "site")
+
+			rWeb := test.remote(t, lWeb, ownerKey)
+			if got := lWeb.VerifyNewVersion(rWeb); got != test.valid {
+				t.Errorf("VerifyNewVersion() = %v, want %v", got, test.valid)
+			}
+		})
+	}
+}
+
+func TestBans(t *testing.T) {
+	addr := func(s string) *net.UDPAddr {
+		a, _ := net.ResolveUDPAddr("udp", s)
+		return a
+	}
+
+	tests := []struct {
+		name   string
+		ban    *Peer
+		check  *Peer
+		banned bool
+	}{
+		{"same id", NewPeer("a", nil), NewPeer("a", addr("10.0.0.1:5000")), true},
+		{"other id", NewPeer("a", nil), NewPeer("b", addr("10.0.0.1:5000")), false},
+		{"same address", NewPeer("a", addr("10.0.0.1:5000")), NewPeer("", addr("10.0.0.1:5000")), true},
+		{"id only does not ban an address", NewPeer("a", nil), NewPeer("", addr("10.0.0.1:5000")), false},
+		{"nothing to ban", NewPeer("", nil), NewPeer("", nil), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bans := NewBans()
+			bans.Ban(test.ban, time.Minute)
+			if got := bans.Banned(test.check); got != test.banned {
+				t.Errorf("Banned() = %v, want %v", got, test.banned)
+			}
+		})
+	}
+
+	bans := NewBans()
+	bans.Ban(NewPeer("a", nil), -time.Minute)
+	if bans.Banned(NewPeer("a", nil)) {
+		t.Error("expired ban still applies")
+	}
+}
+
+func TestUnpackerPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		err  bool
+	}{
+		{"file", "index.html", false},
+		{"nested file", "css/m.css", false},
+		{"backslashes", "img\\a.png", false},
+		{"parent", "../evil.html", false},
+		{"parents", "a/../../../evil.html", false},
+		{"backslash parents", "..\\..\\evil.html", false},
+		{"absolute", "/etc/passwd", false},
+		{"drive", "C:\\evil.html", true},
+		{"empty", "", true},
+		{"only parents", "../..", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			dir := filepath.Join(tmp, "upload")
+			os.Mkdir(dir, 0755)
+			unpacker := NewUnpacker(dir, 1024, 10)
+
+			err := unpacker.Add(test.path, strings.NewReader("data"))
+			if (err != nil) != test.err {
+				t.Fatalf("Add() error = %v, want error %v", err, test.err)
+			}
+
+			// nothing is ever written outside of the Dir
+			all := listFiles(t, tmp)
+			inDir := listFiles(t, dir)
+			if len(all) != len(inDir) {
+				t.Errorf("files written outside of the Dir: %v", all)
+			}
+			if !test.err && len(inDir) != 1 {
+				t.Errorf("files = %v, want one file", inDir)
+			}
+		})
+	}
+}
+
+func TestUnpackerLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSize  int64
+		maxFiles int
+		files    map[string]string
+		err      error
+	}{
+		{"within limits", 8, 2, map[string]string{"a": "1234", "b": "5678"}, nil},
+		{"too large file", 8, 2, map[string]string{"a": "123456789"}, ErrTooLarge},
+		{"too large in total", 8, 2, map[string]string{"a": "12345", "b": "6789"}, ErrTooLarge},
+		{"too many files", 8, 2, map[string]string{"a": "1", "b": "2", "c": "3"}, ErrTooManyFiles},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unpacker := NewUnpacker(t.TempDir(), test.maxSize, test.maxFiles)
+
+			var err error
+			for name, contents := range test.files {
+				if err = unpacker.Add(name, strings.NewReader(contents)); err != nil {
+					break
+				}
+			}
+			if err != test.err {
+				t.Errorf("Add() error = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestUnpackerArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) *bytes.Reader
+		files   []string
+		err     error
+		invalid bool
+	}{
+		{"zip", func(t *testing.T) *bytes.Reader {
+			return zipArchive(t, []string{"site/index.html", "site/css/m.css", "__MACOSX/site/._index.html"})
+		}, []string{"site/css/m.css", "site/index.html"}, nil, false},
+		{"zip traversal", func(t *testing.T) *bytes.Reader {
+			return zipArchive(t, []string{"../../evil.html"})
+		}, []string{"evil.html"}, nil, false},
+		{"zip with too many files", func(t *testing.T) *bytes.Reader {
+			return zipArchive(t, []string{"a", "b", "c", "d"})
+		}, nil, ErrTooManyFiles, false},
+		{"tar skipping links", func(t *testing.T) *bytes.Reader {
+			return tarArchive(t, []*tar.Header{
+				{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+				{Name: "hosts", Typeflag: tar.TypeLink, Linkname: "/etc/hosts"},
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+			})
+		}, []string{"index.html"}, nil, false},
+		{"tar traversal", func(t *testing.T) *bytes.Reader {
+			return tarArchive(t, []*tar.Header{
+				{Name: "../../evil.html", Typeflag: tar.TypeReg, Mode: 0644},
+			})
+		}, []string{"evil.html"}, nil, false},
+		{"not an archive", func(t *testing.T) *bytes.Reader {
+			return bytes.NewReader([]byte("<h1>not an archive</h1>"))
+		}, nil, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			dir := filepath.Join(tmp, "upload")
+			os.Mkdir(dir, 0755)
+			unpacker := NewUnpacker(dir, 1024, 3)
+
+			archive := test.archive(t)
+			err := unpacker.AddArchive(archive, archive.Size())
+			if test.invalid {
+				if err == nil {
+					t.Error("AddArchive() accepted an invalid archive")
+				}
+				return
+			}
+			if err != test.err {
+				t.Fatalf("AddArchive() error = %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+
+			if all := listFiles(t, tmp); len(all) != len(test.files) {
+				t.Errorf("files written outside of the Dir: %v", all)
+			}
+			files := listFiles(t, dir)
+			if strings.Join(files, ",") != strings.Join(test.files, ",") {
+				t.Errorf("files = %v, want %v", files, test.files)
+			}
+		})
+	}
+}
+
+func TestPeersAdd(t *testing.T) {
+	a := udpAddr(t, "10.0.0.1:5000")
+	b := udpAddr(t, "10.0.0.2:5000")
+
+	tests := []struct {
+		name  string
+		added []*Peer
+		keys  []string
+		addrs []string
+	}{
+		{"address only", []*Peer{NewPeer("", a)},
+			[]string{"10.0.0.1:5000"}, []string{"10.0.0.1:5000"}},
+		{"ID learned", []*Peer{NewPeer("", a), NewPeer("x", a)},
+			[]string{"x"}, []string{"10.0.0.1:5000"}},
+		{"moved to another address", []*Peer{NewPeer("x", a), NewPeer("x", b)},
+			[]string{"x"}, []string{"10.0.0.2:5000"}},
+		{"two nodes at the same address", []*Peer{NewPeer("x", a), NewPeer("y", a)},
+			[]string{"x", "y"}, []string{"10.0.0.1:5000", "10.0.0.1:5000"}},
+		{"address of a known node", []*Peer{NewPeer("x", a), NewPeer("", a)},
+			[]string{"x"}, []string{"10.0.0.1:5000"}},
+		{"ID only", []*Peer{NewPeer("x", a), NewPeer("x", nil)},
+			[]string{"x"}, []string{"10.0.0.1:5000"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers := NewPeers()
+			for _, p := range test.added {
+				peers.Add(p)
+			}
+
+			keys := peerKeys(peers)
+			if strings.Join(keys, ",") != strings.Join(test.keys, ",") {
+				t.Fatalf("keys = %v, want %v", keys, test.keys)
+			}
+			for i, key := range keys {
+				if got := peers.P[key].String(); got != test.addrs[i] {
+					t.Errorf("address of %v = %v, want %v", key, got, test.addrs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPeersFind(t *testing.T) {
+	a := udpAddr(t, "10.0.0.1:5000")
+	b := udpAddr(t, "10.0.0.2:5000")
+	peers := NewPeers()
+	peers.Add(NewPeer("x", a))
+	peers.Add(NewPeer("", b))
+
+	tests := []struct {
+		name  string
+		peer  *Peer
+		found string
+	}{
+		{"by ID", NewPeer("x", nil), "x"},
+		{"by ID at another address", NewPeer("x", b), "x"},
+		{"by address", NewPeer("", a), "x"},
+		{"address only entry by ID", NewPeer("y", b), "10.0.0.2:5000"},
+		{"other ID at a known address", NewPeer("z", a), ""},
+		{"unknown address", NewPeer("", udpAddr(t, "10.0.0.3:5000")), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			known := peers.Get(test.peer)
+			if test.found == "" {
+				if known != nil || peers.Contains(test.peer) {
+					t.Errorf("Get() = %v, want nothing", known)
+				}
+				return
+			}
+			if known == nil || known.Key() != test.found || !peers.Contains(test.peer) {
+				t.Errorf("Get() = %v, want %v", known, test.found)
+			}
+		})
+	}
+}
+
+func TestPeerUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		id   string
+		addr string
+	}{
+		{"peer", `{"ID":"x","Addr":{"IP":"10.0.0.1","Port":5000,"Zone":""}}`, "x", "10.0.0.1:5000"},
+		{"address of old metadata", `{"IP":"10.0.0.1","Port":5000,"Zone":""}`, "", "10.0.0.1:5000"},
+		{"ID only", `{"ID":"x"}`, "x", "<nil>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Peer{}
+			if err := json.Unmarshal([]byte(test.json), p); err != nil {
+				t.Fatal(err)
+			}
+			if p.ID != test.id || p.String() != test.addr {
+				t.Errorf("peer = %v at %v, want %v at %v", p.ID, p, test.id, test.addr)
+			}
+		})
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	relay := NewPeer("r", udpAddr(t, "10.0.0.9:5000"))
+	via := NewPeer("v", udpAddr(t, "10.0.0.8:5000"))
+	rt := NewRoutingTable()
+	rt.Set(NewPeer("x", udpAddr(t, "10.0.0.1:5000")), via)
+
+	tests := []struct {
+		name string
+		dst  *Peer
+		via  string
+	}{
+		{"route by ID", NewPeer("x", udpAddr(t, "10.0.0.2:5000")), "v"},
+		{"behind a relay", &Peer{ID: "y", Addr: udpAddr(t, "10.0.0.3:5000"), Relay: relay}, "r"},
+		{"direct", NewPeer("z", udpAddr(t, "10.0.0.4:5000")), "z"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rt.Get(test.dst); got.Key() != test.via {
+				t.Errorf("Get() = %v, want %v", got.Key(), test.via)
+			}
+		})
+	}
+}
+
+func TestWebsiteMapUpdatePeer(t *testing.T) {
+	key, _ := w2pcrypto.CreateKey(w2pcrypto.AlgEd25519)
+	relay := NewPeer("relay", udpAddr(t, "10.0.0.9:5000"))
+	seeded, other := NewWebsite("seeded", nil, key.Public()), NewWebsite("other", nil, key.Public())
+	seeded.AddSeeder(NewPeer("x", udpAddr(t, "10.0.0.1:5000")))
+	other.AddSeeder(NewPeer("y", udpAddr(t, "10.0.0.2:5000")))
+	wm := NewWebsiteMap()
+	wm.Set(seeded)
+	wm.Set(other)
+
+	// the node moved behind a NAT
+	wm.UpdatePeer(&Peer{ID: "x", Addr: udpAddr(t, "203.0.113.7:40000"), Relay: relay})
+
+	tests := []struct {
+		name    string
+		website *Website
+		keys    []string
+		addr    string
+		relay   bool
+	}{
+		{"seeded by the peer", seeded, []string{"x"}, "203.0.113.7:40000", true},
+		{"not seeded by the peer", other, []string{"y"}, "10.0.0.2:5000", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys := peerKeys(test.website.Seeders)
+			if strings.Join(keys, ",") != strings.Join(test.keys, ",") {
+				t.Fatalf("seeders = %v, want %v", keys, test.keys)
+			}
+			seeder := test.website.Seeders.P[keys[0]]
+			if seeder.String() != test.addr || (seeder.Relay != nil) != test.relay {
+				t.Errorf("seeder at %v relayed by %v", seeder, seeder.Relay)
+			}
+		})
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	tests := []struct {
+		name  string
+		peers string
+		addrs []string
+	}{
+		{"none", "", nil},
+		{"IPv4", "10.0.0.1:5000", []string{"10.0.0.1:5000"}},
+		{"IPv6", "[2001:db8::1]:5000", []string{"[2001:db8::1]:5000"}},
+		{"IPv6 loopback", "[::1]:5000", []string{"[::1]:5000"}},
+		{"IPv6 with a zone", "[fe80::1%eth0]:5000", []string{"[fe80::1%eth0]:5000"}},
+		{"both", "[2001:db8::1]:5000,10.0.0.1:5000", []string{"10.0.0.1:5000", "[2001:db8::1]:5000"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers := ParsePeers(test.peers)
+			addrs := peerKeys(peers)
+			if strings.Join(addrs, ",") != strings.Join(test.addrs, ",") {
+				t.Fatalf("peers = %v, want %v", addrs, test.addrs)
+			}
+
+			// the addresses are kept in the metadata of the websites
+			data, err := json.Marshal(peers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := NewPeers()
+			if err := json.Unmarshal(data, decoded); err != nil {
+				t.Fatal(err)
+			}
+			if got := peerKeys(decoded); strings.Join(got, ",") != strings.Join(addrs, ",") {
+				t.Errorf("decoded peers = %v, want %v", got, addrs)
+			}
+		})
+	}
+}
+
+func TestMembershipStates(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		state   PeerState
+		dead    int
+		known   bool
+	}{
+		{"seen", []string{"seen"}, PeerAlive, 0, true},
+		{"suspected", []string{"seen", "suspect"}, PeerSuspect, 0, true},
+		{"alive again", []string{"seen", "suspect", "seen"}, PeerAlive, 0, true},
+		{"suspected briefly", []string{"seen", "suspect", "expire"}, PeerSuspect, 0, true},
+		{"suspected too long", []string{"seen", "suspect", "wait", "expire"}, PeerDead, 1, true},
+		{"dead too long", []string{"seen", "suspect", "wait", "expire", "wait", "expire"}, PeerAlive, 1, false},
+		{"rejoined", []string{"seen", "suspect", "wait", "expire", "seen"}, PeerAlive, 1, true},
+		{"alive not expired", []string{"seen", "wait", "expire"}, PeerAlive, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMembership()
+			p := NewPeer("x", udpAddr(t, "10.0.0.1:5000"))
+			dead := 0
+			for _, action := range test.actions {
+				switch action {
+				case "seen":
+					m.Seen(p)
+				case "suspect":
+					m.Suspect(p)
+				case "wait":
+					if member := m.M[p.Key()]; member != nil {
+						member.Since = member.Since.Add(-2 * time.Minute)
+					}
+				case "expire":
+					dead += len(m.Expire(time.Minute, time.Minute))
+				}
+			}
+
+			if got := m.State(p); got != test.state {
+				t.Errorf("State() = %v, want %v", got, test.state)
+			}
+			if dead != test.dead {
+				t.Errorf("%v peers expired, want %v", dead, test.dead)
+			}
+			if _, known := m.M[p.Key()]; known != test.known {
+				t.Errorf("peer known = %v, want %v", known, test.known)
+			}
+		})
+	}
+}
+
+func TestMembershipSeenReturns(t *testing.T) {
+	m := NewMembership()
+	byAddr := NewPeer("", udpAddr(t, "10.0.0.1:5000"))
+	byID := NewPeer("x", udpAddr(t, "10.0.0.1:5000"))
+
+	// Seen returns the previous state, a new peer joining as if it was dead
+	steps := []struct {
+		name     string
+		action   func() PeerState
+		previous PeerState
+	}{
+		{"new peer", func() PeerState { return m.Seen(byAddr) }, PeerDead},
+		{"its ID learnt", func() PeerState { return m.Seen(byID) }, PeerAlive},
+		{"suspected", func() PeerState { m.Suspect(byID); return m.Seen(byID) }, PeerSuspect},
+	}
+	for _, step := range steps {
+		if got := step.action(); got != step.previous {
+			t.Errorf("%v: Seen() = %v, want %v", step.name, got, step.previous)
+		}
+	}
+	if len(m.M) != 1 || m.M["x"] == nil {
+		t.Errorf("members = %v, want the peer by its ID", m.M)
+	}
+	if !m.Suspect(byID) || m.Suspect(byID) {
+		t.Error("a suspect peer suspected again")
+	}
+}
+
+func TestMembershipProbes(t *testing.T) {
+	peers := NewPeers()
+	for i, id := range []string{"a", "b", "c", "d"} {
+		peers.Add(NewPeer(id, &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 5000}))
+	}
+	m := NewMembership()
+	m.Suspect(NewPeer("b", nil))
+
+	// every peer is probed once a round
+	for round := 0; round < 2; round++ {
+		var probed []string
+		for range peers.P {
+			probed = append(probed, m.Next(peers).Key())
+		}
+		sort.Strings(probed)
+		if strings.Join(probed, ",") != "a,b,c,d" {
+			t.Errorf("round %v probed %v", round, probed)
+		}
+	}
+
+	// helpers are alive and not the probed peer
+	for i := 0; i < 10; i++ {
+		for _, p := range m.Sample(peers, 2, NewPeer("a", nil)) {
+			if p.Key() == "a" || p.Key() == "b" {
+				t.Fatalf("Sample() returned %v", p.Key())
+			}
+		}
+	}
+	if sample := m.Sample(peers, 5); len(sample) != 3 {
+		t.Errorf("Sample() = %v peers, want 3", len(sample))
+	}
+
+	if !m.StartProbe(NewPeer("a", nil)) || m.StartProbe(NewPeer("a", nil)) {
+		t.Error("peer probed twice at the same time")
+	}
+	m.EndProbe(NewPeer("a", nil))
+	if !m.StartProbe(NewPeer("a", nil)) {
+		t.Error("peer not probed again")
+	}
+}
+
+func TestPeersBound(t *testing.T) {
+	scores := map[string]float64{"a": 0.5, "b": 0.1, "c": 2, "d": 1}
+	score := func(p *Peer) float64 { return scores[p.Key()] }
+	keep := func(p *Peer) bool { return p.Key() == "b" }
+
+	tests := []struct {
+		max     int
+		kept    []string
+		removed []string
+	}{
+		{5, []string{"a", "b", "c", "d"}, nil},
+		{4, []string{"a", "b", "c", "d"}, nil},
+		{3, []string{"b", "c", "d"}, []string{"a"}},
+		{2, []string{"b", "c"}, []string{"a", "d"}},
+		{0, []string{"b"}, []string{"a", "d", "c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.max), func(t *testing.T) {
+			peers := NewPeers()
+			for i, id := range []string{"a", "b", "c", "d"} {
+				peers.Add(NewPeer(id, &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 5000}))
+			}
+
+			// the peers with the lowest score go first
+			var removed []string
+			for _, p := range peers.Bound(test.max, score, keep) {
+				removed = append(removed, p.Key())
+			}
+			if strings.Join(removed, ",") != strings.Join(test.removed, ",") {
+				t.Errorf("removed = %v, want %v", removed, test.removed)
+			}
+			if kept := peerKeys(peers); strings.Join(kept, ",") != strings.Join(test.kept, ",") {
+				t.Errorf("kept = %v, want %v", kept, test.kept)
+			}
+		})
+	}
+}
+
+func TestMembershipScore(t *testing.T) {
+	tests := []struct {
+		name   string
+		member *Member
+		min    float64
+		max    float64
+	}{
+		{"unknown", nil, 1, 1},
+		{"just seen", &Member{State: PeerAlive, Since: time.Now()}, 1, 1.01},
+		{"up for an hour", &Member{State: PeerAlive, Since: time.Now().Add(-2 * time.Hour)}, 2, 2},
+		{"fast", &Member{State: PeerAlive, Since: time.Now(), RTT: time.Millisecond}, 1.48, 1.5},
+		{"slow", &Member{State: PeerAlive, Since: time.Now(), RTT: time.Second}, 0.59, 0.6},
+		{"serving good pieces", &Member{State: PeerAlive, Since: time.Now(), Good: 98}, 1.48, 1.5},
+		{"suspect", &Member{State: PeerSuspect, Since: time.Now().Add(-2 * time.Hour), Good: 98}, 0, 0},
+		{"dead", &Member{State: PeerDead}, 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMembership()
+			p := NewPeer("x", nil)
+			if test.member != nil {
+				test.member.Peer = p
+				m.M[p.Key()] = test.member
+			}
+			if s := m.Score(p); s < test.min || s > test.max {
+				t.Errorf("Score() = %v, want between %v and %v", s, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestMembershipReputation(t *testing.T) {
+	tests := []struct {
+		name     string
+		known    bool
+		good     int
+		bad      int
+		timeouts int
+		want     float64
+	}{
+		{"unknown", false, 3, 3, 3, 0.5},
+		{"new", true, 0, 0, 0, 0.5},
+		{"good pieces", true, 3, 0, 0, 0.8},
+		{"timeout", true, 0, 0, 1, 1.0 / 3},
+		{"bad piece", true, 0, 1, 0, 1.0 / 6},
+		{"bad piece as 4 timeouts", true, 1, 1, 0, 2.0 / 7},
+		{"mixed", true, 5, 1, 2, 6.0 / 13},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMembership()
+			p := NewPeer("x", nil)
+			if test.known {
+				m.Seen(p)
+			}
+			for i := 0; i < test.good; i++ {
+				m.AddGood(p)
+			}
+			for i := 0; i < test.bad; i++ {
+				if bad := m.AddBad(p); test.known && bad != i+1 {
+					t.Errorf("AddBad() = %v, want %v", bad, i+1)
+				}
+			}
+			for i := 0; i < test.timeouts; i++ {
+				m.AddTimeout(p)
+			}
+			if r := m.Reputation(p); math.Abs(r-test.want) > 1e-9 {
+				t.Errorf("Reputation() = %v, want %v", r, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenBuckets(t *testing.T) {
+	tests := []struct {
+		name string
+		used int
+		wait time.Duration
+		want int
+	}{
+		{"burst", 0, 0, 3},
+		{"empty", 3, 0, 0},
+		{"refilled in part", 3, 500 * time.Millisecond, 1},
+		{"refilled", 3, time.Second, 2},
+		{"refilled up to the burst", 3, time.Hour, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tb := NewTokenBuckets(2, 3)
+			for i := 0; i < test.used; i++ {
+				tb.Allow("a")
+			}
+			if b := tb.B["a"]; b != nil {
+				b.last = b.last.Add(-test.wait)
+			}
+
+			allowed := 0
+			for i := 0; i < 5; i++ {
+				if tb.Allow("a") {
+					allowed++
+				}
+			}
+			if allowed != test.want {
+				t.Errorf("%v events allowed, want %v", allowed, test.want)
+			}
+			if !tb.Allow("b") {
+				t.Error("event of another key refused")
+			}
+		})
+	}
+
+	// the full buckets are forgotten, not the others
+	tb := NewTokenBuckets(1, 1)
+	tb.Allow("empty")
+	for i := 0; i < 100; i++ {
+		tb.B[strconv.Itoa(i)] = &tokenBucket{tokens: 1, last: time.Now()}
+	}
+	tb.Allow("new")
+	if len(tb.B) != 2 || tb.B["empty"] == nil {
+		t.Errorf("%v buckets kept, the empty one being kept = %v", len(tb.B), tb.B["empty"] != nil)
+	}
+}
+
+func TestBandwidthRates(t *testing.T) {
+	tests := []struct {
+		name    string
+		website string
+		rates   []int
+		want    map[string]int
+	}{
+		{"global cap", "", []int{1000}, map[string]int{"": 1000}},
+		{"global cap removed", "", []int{1000, 0}, map[string]int{"": 0}},
+		{"website cap", "site", []int{1000}, map[string]int{"": 0, "site": 1000}},
+		{"website cap changed", "site", []int{1000, 2000}, map[string]int{"": 0, "site": 2000}},
+		{"website cap removed", "site", []int{1000, 0}, map[string]int{"": 0}},
+		{"negative website cap", "site", []int{-1}, map[string]int{"": 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBandwidth(0)
+			for _, rate := range test.rates {
+				b.SetRate(test.website, rate)
+			}
+			rates := b.Rates()
+			if len(rates) != len(test.want) {
+				t.Fatalf("Rates() = %v, want %v", rates, test.want)
+			}
+			for name, rate := range test.want {
+				if rates[name] != rate {
+					t.Errorf("Rates() = %v, want %v", rates, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBandwidthWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  int
+		site    int
+		sizes   []int
+		minWait time.Duration
+		maxWait time.Duration
+	}{
+		{"uncapped", 0, 0, []int{1 << 30, 1 << 30}, 0, 50 * time.Millisecond},
+		{"within the global cap", 100000, 0, []int{0, 100}, 0, 50 * time.Millisecond},
+		{"over the global cap", 100000, 0, []int{0, 10000}, 80 * time.Millisecond, time.Second},
+		{"over the website cap", 0, 100000, []int{0, 10000}, 80 * time.Millisecond, time.Second},
+		{"over both caps", 100000, 100000, []int{0, 10000}, 80 * time.Millisecond, time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBandwidth(0)
+			b.SetRate("", test.global)
+			b.SetRate("site", test.site)
+
+			start := time.Now()
+			for _, size := range test.sizes {
+				b.Wait("site", size)
+			}
+			if elapsed := time.Since(start); elapsed < test.minWait || elapsed > test.maxWait {
+				t.Errorf("waited %v, want between %v and %v", elapsed, test.minWait, test.maxWait)
+			}
+
+			// other websites are only held by the global cap
+			if test.global == 0 {
+				start = time.Now()
+				b.Wait("other", 1<<30)
+				if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+					t.Errorf("other website waited %v", elapsed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package ui
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yaanst/W2P/control"
+)
+
+// sessionDuration is how long the browser stays authenticated after opening
+// the UI with the token
+const sessionDuration time.Duration = time.Duration(2592000000000000) // 30 days
+
+// Login authenticates the browser opening the UI with the token in the query,
+// setting the session and CSRF cookies and redirecting to the page without
+// the token, before serving next
+func Login(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		if _, ok := query["token"]; !ok {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		if !validToken(token, query.Get("token")) {
+			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		csrf, err := control.NewToken()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(writer, cookie(request, control.SessionCookie, token, true))
+		http.SetCookie(writer, cookie(request, control.CSRFCookie, csrf, false))
+
+		query.Del("token")
+		request.URL.RawQuery = query.Encode()
+		http.Redirect(writer, request, request.URL.RequestURI(), http.StatusSeeOther)
+	})
+}
+
+// Authenticate serves next only to the clients with the token, either in the
+// Authorization header or in the session cookie of the browser, whose
+// requests changing anything also need the CSRF header
+func Authenticate(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if auth := request.Header.Get("Authorization"); auth != "" {
+			if !validToken(token, strings.TrimPrefix(auth, "Bearer ")) {
+				writeError(writer, http.StatusUnauthorized, errors.New("invalid token"))
+				return
+			}
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		session, err := request.Cookie(control.SessionCookie)
+		if err != nil || !validToken(token, session.Value) {
+			writeError(writer, http.StatusUnauthorized,
+				errors.New("missing or invalid token, open the UI with the URL logged by the node"))
+			return
+		}
+
+		// other websites cannot read the cookie to set the header
+		if request.Method != "GET" && request.Method != "HEAD" {
+			csrf, err := request.Cookie(control.CSRFCookie)
+			if err != nil || csrf.Value == "" || !validToken(csrf.Value, request.Header.Get(control.CSRFHeader)) {
+				writeError(writer, http.StatusForbidden, errors.New("missing or invalid CSRF token"))
+				return
+			}
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// Sandbox serves the websites, which come from other nodes, in a sandbox
+// without the origin of the UI so that their scripts cannot use the session
+// of the browser
+func Sandbox(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Security-Policy", "sandbox allow-scripts allow-forms allow-popups")
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// validToken compares a token given by a client with the expected one in
+// constant time
+func validToken(expected, given string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(given)) == 1
+}
+
+// cookie builds a cookie sent back only by the pages of the UI, and only over
+// TLS if the request came over it
+func cookie(request *http.Request, name, value string, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(sessionDuration.Seconds()),
+		HttpOnly: httpOnly,
+		Secure:   request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
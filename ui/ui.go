@@ -1,111 +1,778 @@
 package ui
 
 import (
+	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/yaanst/W2P/config"
+	"github.com/yaanst/W2P/control"
 	"github.com/yaanst/W2P/node"
+	"github.com/yaanst/W2P/structs"
 	"github.com/yaanst/W2P/utils"
+	"github.com/yaanst/W2P/w2pcrypto"
 )
 
-// ScanWebsiteFolder finds the user's websites names (/scan)
+// webpage holds the UI embedded in the binary
+//
+//go:embed webpage
+var webpage embed.FS
+
+// maxRequestSize is the maximum size in bytes of a JSON request
+const maxRequestSize int64 = 1048576 // 1MB
+
+// ShowStatus collects some information about the current node (GET /status)
+func ShowStatus(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writeJSON(writer, http.StatusOK, &control.Status{
+			API:      control.APIVersion,
+			Name:     node.Name,
+			ID:       node.ID,
+			Addr:     node.Addr.String(),
+			Peers:    node.Peers.Count(),
+			Websites: node.WebsiteMap.Count(),
+			Upload:   node.Upload.Rates()[""] / 1000,
+			Download: node.Download.Rates()[""] / 1000,
+		})
+	}
+}
+
+// ListPeers lists the known peers with their liveness and score (GET /peers)
+func ListPeers(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		peers := []control.Peer{}
+		for _, p := range node.Peers.GetAll() {
+			peer := p
+			peers = append(peers, control.Peer{
+				ID:         peer.ID,
+				Addr:       peer.String(),
+				State:      node.Members.State(&peer).String(),
+				Score:      node.Members.Score(&peer),
+				Reputation: node.Members.Reputation(&peer),
+			})
+		}
+		writeJSON(writer, http.StatusOK, peers)
+	}
+}
+
+// ScanWebsiteFolder finds the names of the folders in the WebsiteDir, which
+// can be shared (GET /folders)
 func ScanWebsiteFolder(writer http.ResponseWriter, request *http.Request) {
-	if request.Method == "GET" {
-		folders := utils.ScanDir(utils.WebsiteDir)
-		jsonData, err := json.Marshal(folders)
-		utils.CheckError(err)
-		fmt.Fprint(writer, string(jsonData))
+	folders := utils.ScanDir(utils.WebsiteDir)
+	if folders == nil {
+		folders = []string{}
 	}
+	writeJSON(writer, http.StatusOK, folders)
 }
 
-// ListWebsites lists all known websites (/list)
+// ListWebsites lists all known websites, or the ones matching the keywords
+// of the q parameter (GET /sites)
 func ListWebsites(node *node.Node) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		if request.Method == "GET" {
-			jsonData, err := json.Marshal(node.WebsiteMap)
-			utils.CheckError(err)
-			fmt.Fprint(writer, string(jsonData))
+		names := node.WebsiteMap.GetIndices()
+		if keywords := request.URL.Query().Get("q"); keywords != "" {
+			names = node.Search(keywords)
 		}
+
+		sites := []*control.Site{}
+		for _, name := range names {
+			website := node.WebsiteMap.Get(name)
+			if website != nil && !containsSite(sites, name) {
+				sites = append(sites, site(node, website))
+			}
+		}
+		writeJSON(writer, http.StatusOK, sites)
 	}
 }
 
-// FilterWebsites finds websites' names matching a given keyword
-func FilterWebsites(node *node.Node) http.HandlerFunc {
+// ShowWebsite shows a known website (GET /sites/{name})
+func ShowWebsite(node *node.Node) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		if request.Method == "POST" {
-			request.ParseForm()
-			keyword := strings.Join(request.Form["keywords"], "")
-			websites := node.Search(keyword)
-			jsonData, err := json.Marshal(websites)
-			utils.CheckError(err)
-			fmt.Fprint(writer, string(jsonData))
+		website := getWebsite(node, writer, request)
+		if website == nil {
+			return
 		}
+		writeJSON(writer, http.StatusOK, site(node, website))
 	}
 }
 
-// ImportWebsite imports a new website from the UI and add it to the
-// seeding websites (/share)
-func ImportWebsite(node *node.Node) http.HandlerFunc {
+// PublishWebsite shares a new website, copying its folder in the WebsiteDir
+// if it is given, or unpacking it if it is uploaded (POST /sites)
+func PublishWebsite(node *node.Node) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		if request.Method == "POST" {
-			request.ParseForm()
-			name := strings.Join(request.Form["name"], "")
-
-			keywordsString := strings.Join(request.Form["keywords"], "")
-			keywords := strings.Split(keywordsString, ",")
+		req := &control.PublishRequest{}
+		if strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/form-data") {
+			dir, ok := readUpload(node, writer, request, req)
+			if !ok {
+				return
+			}
+			defer os.RemoveAll(dir)
+		} else if !readJSON(writer, request, req) || !checkDir(writer, request, req.Dir) {
+			return
+		}
 
-			log.Println("[WEBSITES] Importing new website '" + name + "'")
+		alg, err := parseAlgorithm(req.Algorithm)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		if !utils.ValidName(req.Name) {
+			writeError(writer, http.StatusBadRequest, errors.New("invalid website name '"+req.Name+"'"))
+			return
+		}
+		if node.WebsiteMap.Get(req.Name) != nil {
+			writeError(writer, http.StatusConflict, errors.New("website '"+req.Name+"' already exists"))
+			return
+		}
+		if _, err := os.Stat(utils.KeyDir + req.Name); err == nil {
+			writeError(writer, http.StatusConflict, errors.New("a key already exists for website '"+req.Name+"'"))
+			return
+		}
 
-			if name != "" {
-				node.AddNewWebsite(name, keywords)
+		// without a folder to copy, the website has to be in the WebsiteDir
+		if req.Dir == "" {
+			if info, err := os.Stat(utils.WebsiteDir + req.Name); err != nil || !info.IsDir() {
+				writeError(writer, http.StatusNotFound, errors.New("no folder '"+req.Name+"' in the websites"))
+				return
 			}
 		}
+
+		log.Println("[WEBSITES] Publishing new website '" + req.Name + "'")
+
+		if req.Dir != "" {
+			err = node.PublishWebsite(req.Dir, req.Name, req.Keywords, alg, []byte(req.Passphrase))
+		} else {
+			err = node.AddNewWebsite(req.Name, req.Keywords, alg, []byte(req.Passphrase))
+		}
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(writer, http.StatusCreated, site(node, node.WebsiteMap.Get(req.Name)))
 	}
 }
 
-// UpdateWebsite updates an existing website (/update)
+// UpdateWebsite publishes a new version of an unlocked website, with the
+// contents of an optional folder, its keywords being kept if none are given
+// (PUT /sites/{name})
 func UpdateWebsite(node *node.Node) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		if request.Method == "POST" {
-			request.ParseForm()
-			name := strings.Join(request.Form["name"], "")
+		website := getUnlockedWebsite(node, writer, request)
+		if website == nil {
+			return
+		}
+
+		req := &control.UpdateRequest{}
+		if !readJSON(writer, request, req) || !checkDir(writer, request, req.Dir) {
+			return
+		}
+		keywords := req.Keywords
+		if keywords == nil {
+			keywords = website.GetKeywords()
+		}
+
+		if req.Dir != "" {
+			err := node.CopyWebsite(website.Name, req.Dir)
+			if err != nil {
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		err := node.UpdateWebsite(website.Name, keywords)
+		if err != nil {
+			writeError(writer, http.StatusInternalServerError, errors.New("could not update website '"+website.Name+"': "+err.Error()))
+			return
+		}
+		writeJSON(writer, http.StatusOK, site(node, website))
+	}
+}
+
+// UnlockWebsite decrypts the key of an owned website with the passphrase so
+// it can be updated (POST /sites/{name}/unlock)
+func UnlockWebsite(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		website := getWebsite(node, writer, request)
+		if website == nil {
+			return
+		}
 
-			keywordsString := strings.Join(request.Form["keywords"], "")
-			keywords := strings.Split(keywordsString, ",")
+		req := &control.UnlockRequest{}
+		if !readJSON(writer, request, req) {
+			return
+		}
 
-			success := node.UpdateWebsite(name, keywords)
-			fmt.Fprint(writer, success)
+		err := node.UnlockWebsite(website.Name, []byte(req.Passphrase))
+		if err != nil {
+			log.Println("[WEBSITES] Cannot unlock website '" + website.Name + "': " + err.Error())
+			writeError(writer, http.StatusForbidden, err)
+			return
 		}
+		writer.WriteHeader(http.StatusNoContent)
 	}
 }
 
-// ShowStatus collects some information about the current node
-func ShowStatus(node *node.Node) http.HandlerFunc {
+// LockWebsite forgets the decrypted key of a website (POST /sites/{name}/lock)
+func LockWebsite(node *node.Node) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-        if request.Method == "GET" {
-            info := make(map[string]interface{})
-            info["name"] = node.Name
-            info["addr"] = node.Addr.String()
-            info["peers"] = node.Peers.Count()
-            info["websites"] = node.WebsiteMap.Count()
+		node.LockWebsite(request.PathValue("name"))
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
 
-            jsonData, err := json.Marshal(info)
-            utils.CheckError(err)
+// FetchWebsite retrieves a known website from its seeders and answers once it
+// is available on the node (POST /sites/{name}/fetch)
+func FetchWebsite(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		website := getWebsite(node, writer, request)
+		if website == nil {
+			return
+		}
 
-            fmt.Fprint(writer, string(jsonData))
-        }
-    }
+		// the retrieval goes on if the client stops waiting
+		done := make(chan error, 1)
+		go func() {
+			done <- node.RetrieveWebsite(website.Name, nil)
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				writeRetrieveError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, site(node, website))
+		case <-request.Context().Done():
+		}
+	}
 }
 
+// ExportWebsite sends the identity bundle of an unlocked website encrypted
+// with the given passphrase as a download (POST /sites/{name}/export)
+func ExportWebsite(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		website := getUnlockedWebsite(node, writer, request)
+		if website == nil {
+			return
+		}
+
+		req := &control.ExportRequest{}
+		if !readJSON(writer, request, req) {
+			return
+		}
+
+		bundle, err := node.ExportWebsite(website.Name, []byte(req.Passphrase))
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
 
-// ServeUI serves the UI page
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		writer.Header().Set("Content-Disposition", "attachment; filename=\""+website.Name+".w2p\"")
+		writer.Write(bundle)
+	}
+}
+
+// ImportIdentity imports the identity bundle of a website exported by another
+// node, so that this node can update it (POST /identities)
+func ImportIdentity(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		err := request.ParseMultipartForm(node.Config.MaxBundleSize)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		file, _, err := request.FormFile("bundle")
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		defer file.Close()
+
+		bundle, err := ioutil.ReadAll(io.LimitReader(file, node.Config.MaxBundleSize))
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		passphrase := []byte(request.FormValue("passphrase"))
+		keyPassphrase := []byte(request.FormValue("key_passphrase"))
+
+		name, err := node.ImportWebsite(bundle, passphrase, keyPassphrase)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(writer, http.StatusCreated, &control.Imported{Name: name})
+	}
+}
+
+// CreateEditorKey creates the key with which this node will edit a website
+// and returns it so it can be sent to the owner
+// (POST /sites/{name}/editor-key)
+func CreateEditorKey(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		req := &control.EditorKeyRequest{}
+		if !readJSON(writer, request, req) {
+			return
+		}
+
+		alg, err := parseAlgorithm(req.Algorithm)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		// the website may not be known yet
+		pubKey, err := node.CreateEditorKey(request.PathValue("name"), alg, []byte(req.Passphrase))
+		if err != nil {
+			writeError(writer, http.StatusConflict, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, &control.EditorKey{Key: pubKey.String()})
+	}
+}
+
+// DelegateWebsite allows an editor key to update an unlocked website until an
+// optional expiry date formatted as YYYY-MM-DD (POST /sites/{name}/delegations)
+func DelegateWebsite(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		website := getUnlockedWebsite(node, writer, request)
+		if website == nil {
+			return
+		}
+
+		req := &control.DelegationRequest{}
+		if !readJSON(writer, request, req) {
+			return
+		}
+
+		editorKey, err := parsePublicKey(req.EditorKey)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		var expiry int64
+		if req.Expiry != "" {
+			date, err := time.Parse("2006-01-02", req.Expiry)
+			if err != nil {
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			}
+			expiry = date.Unix()
+		}
+
+		err = node.DelegateWebsite(website.Name, editorKey, expiry)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// UndelegateWebsite removes the delegation of an editor key
+// (DELETE /sites/{name}/delegations)
+func UndelegateWebsite(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		website := getUnlockedWebsite(node, writer, request)
+		if website == nil {
+			return
+		}
+
+		req := &control.DelegationRequest{}
+		if !readJSON(writer, request, req) {
+			return
+		}
+
+		editorKey, err := parsePublicKey(req.EditorKey)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		err = node.UndelegateWebsite(website.Name, editorKey)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RotateWebsite moves an unlocked website to a new key, optionally revoking
+// the old one (POST /sites/{name}/rotate)
+func RotateWebsite(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		website := getUnlockedWebsite(node, writer, request)
+		if website == nil {
+			return
+		}
+
+		req := &control.RotateRequest{}
+		if !readJSON(writer, request, req) {
+			return
+		}
+
+		alg, err := parseAlgorithm(req.Algorithm)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		err = node.RotateWebsite(website.Name, alg, []byte(req.Passphrase), req.Revoke)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RevokeKey revokes a former owner key or an editor key
+// (POST /sites/{name}/revocations)
+func RevokeKey(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		website := getUnlockedWebsite(node, writer, request)
+		if website == nil {
+			return
+		}
+
+		req := &control.RevocationRequest{}
+		if !readJSON(writer, request, req) {
+			return
+		}
+
+		key, err := parsePublicKey(req.Key)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		err = node.RevokeKey(website.Name, key)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ShowBandwidth shows the upload and download caps in KB/s (GET /bandwidth)
+func ShowBandwidth(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writeJSON(writer, http.StatusOK, bandwidth(node))
+	}
+}
+
+// SetBandwidth changes the caps for a website or globally if no website is
+// given, a missing cap being left unchanged and 0 removing the cap
+// (PUT /bandwidth)
+func SetBandwidth(node *node.Node) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		req := &control.BandwidthRequest{}
+		if !readJSON(writer, request, req) {
+			return
+		}
+		if (req.Upload != nil && *req.Upload < 0) || (req.Download != nil && *req.Download < 0) {
+			writeError(writer, http.StatusBadRequest, errors.New("invalid negative rate"))
+			return
+		}
+
+		if req.Upload != nil {
+			node.Upload.SetRate(req.Name, *req.Upload*1000)
+		}
+		if req.Download != nil {
+			node.Download.SetRate(req.Name, *req.Download*1000)
+		}
+		writeJSON(writer, http.StatusOK, bandwidth(node))
+	}
+}
+
+// NotFound answers the requests to unknown paths of the control API
+func NotFound(writer http.ResponseWriter, request *http.Request) {
+	writeError(writer, http.StatusNotFound, errors.New("no such endpoint "+request.Method+" "+request.URL.Path))
+}
+
+// readUpload unpacks the website uploaded as an archive or as files in a
+// temporary folder, returned to be removed, and reads the other fields of
+// the form into req, answering with an error if the upload is invalid
+func readUpload(node *node.Node, writer http.ResponseWriter, request *http.Request, req *control.PublishRequest) (string, bool) {
+	request.Body = http.MaxBytesReader(writer, request.Body, node.Config.MaxUploadSize+maxRequestSize)
+	err := request.ParseMultipartForm(maxRequestSize)
+	if err != nil {
+		writeUploadError(writer, err)
+		return "", false
+	}
+	defer request.MultipartForm.RemoveAll()
+
+	req.Name = request.FormValue("name")
+	req.Algorithm = request.FormValue("algorithm")
+	req.Passphrase = request.FormValue("passphrase")
+	if keywords := request.FormValue("keywords"); keywords != "" {
+		req.Keywords = strings.Split(keywords, ",")
+	}
+
+	dir, err := ioutil.TempDir("", "w2p-upload-")
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, err)
+		return "", false
+	}
+
+	unpacker := structs.NewUnpacker(dir, node.Config.MaxUploadSize, node.Config.MaxUploadFiles)
+	archives := request.MultipartForm.File["archive"]
+	files := request.MultipartForm.File["files"]
+	// the paths of the files are sent apart as only their base name is kept
+	paths := request.MultipartForm.Value["paths"]
+
+	for i, fileHeader := range files {
+		name := fileHeader.Filename
+		if i < len(paths) {
+			name = paths[i]
+		}
+		file, err := fileHeader.Open()
+		if err == nil {
+			err = unpacker.Add(name, file)
+			file.Close()
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			writeUploadError(writer, err)
+			return "", false
+		}
+	}
+
+	for _, fileHeader := range archives {
+		file, err := fileHeader.Open()
+		if err == nil {
+			err = unpacker.AddArchive(file, fileHeader.Size)
+			file.Close()
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			writeUploadError(writer, err)
+			return "", false
+		}
+	}
+
+	if len(archives) == 0 && len(files) == 0 {
+		os.RemoveAll(dir)
+		writeError(writer, http.StatusBadRequest, errors.New("no archive or files uploaded"))
+		return "", false
+	}
+
+	// the website is named after its folder or its archive by default
+	root, inFolder := unpacker.Root()
+	if req.Name == "" && inFolder {
+		req.Name = filepath.Base(root)
+	} else if req.Name == "" && len(archives) > 0 {
+		req.Name = archiveName(archives[0].Filename)
+	}
+	req.Dir = root
+
+	log.Println("[WEBSITES] Unpacked uploaded website '" + req.Name + "'")
+	return dir, true
+}
+
+// checkDir refuses a folder given by path unless the request comes from the
+// node's machine, as the other clients would read any folder of it through
+// the website. They have to upload the folder instead
+func checkDir(writer http.ResponseWriter, request *http.Request, dir string) bool {
+	if dir == "" {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		writeError(writer, http.StatusForbidden,
+			errors.New("folders can only be given by path from the node's machine, upload them instead"))
+		return false
+	}
+	return true
+}
+
+// archiveName returns the name of an archive without its extension
+func archiveName(filename string) string {
+	name := filepath.Base(filename)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+// writeUploadError answers with the error of an upload, which may be too large
+func writeUploadError(writer http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || err == structs.ErrTooLarge {
+		writeError(writer, http.StatusRequestEntityTooLarge, errors.New("upload too large"))
+		return
+	}
+	if err == structs.ErrTooManyFiles {
+		writeError(writer, http.StatusRequestEntityTooLarge, errors.New("upload with too many files"))
+		return
+	}
+	writeError(writer, http.StatusBadRequest, errors.New("invalid upload: "+err.Error()))
+}
+
+// writeRetrieveError answers with the error of the retrieval of a website,
+// which may not be retrieved again
+func writeRetrieveError(writer http.ResponseWriter, err error) {
+	if err == node.ErrWebsiteOwned || err == node.ErrWebsiteSeeded || err == node.ErrRetrieving {
+		writeError(writer, http.StatusConflict, err)
+		return
+	}
+	writeError(writer, http.StatusBadGateway, err)
+}
+
+// site summarizes a website for the control API
+func site(node *node.Node, website *structs.Website) *control.Site {
+	keywords := website.GetKeywords()
+	if keywords == nil {
+		keywords = []string{}
+	}
+	return &control.Site{
+		Name:      website.Name,
+		Version:   website.Version,
+		Keywords:  keywords,
+		Algorithm: string(website.Algorithm()),
+		Seeders:   website.Seeders.Count(),
+		Owned:     website.Owned(),
+		Unlocked:  node.Keyring.Get(website.Name) != nil,
+	}
+}
+
+// containsSite checks if the website name is in sites
+func containsSite(sites []*control.Site, name string) bool {
+	for _, s := range sites {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bandwidth returns the caps of the node in KB/s
+func bandwidth(node *node.Node) *control.Bandwidth {
+	return &control.Bandwidth{
+		Upload:   toKB(node.Upload.Rates()),
+		Download: toKB(node.Download.Rates()),
+	}
+}
+
+// toKB converts rates from bytes to KB per second
+func toKB(rates map[string]int) map[string]int {
+	for name, rate := range rates {
+		rates[name] = rate / 1000
+	}
+	return rates
+}
+
+// getWebsite returns the website named in the path of the request, answering
+// with an error if it is unknown
+func getWebsite(node *node.Node, writer http.ResponseWriter, request *http.Request) *structs.Website {
+	name := request.PathValue("name")
+	website := node.WebsiteMap.Get(name)
+	if website == nil {
+		writeError(writer, http.StatusNotFound, errors.New("unknown website '"+name+"'"))
+	}
+	return website
+}
+
+// getUnlockedWebsite returns the website named in the path of the request,
+// answering with an error if it is unknown or its key is not unlocked
+func getUnlockedWebsite(node *node.Node, writer http.ResponseWriter, request *http.Request) *structs.Website {
+	website := getWebsite(node, writer, request)
+	if website != nil && node.Keyring.Get(website.Name) == nil {
+		writeError(writer, http.StatusForbidden, errors.New("website '"+website.Name+"' is locked"))
+		return nil
+	}
+	return website
+}
+
+// readJSON decodes the JSON body of a request into v, answering with an error
+// if it is invalid
+func readJSON(writer http.ResponseWriter, request *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxRequestSize)).Decode(v)
+	if err != nil && err != io.EOF {
+		writeError(writer, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return false
+	}
+	return true
+}
+
+// writeJSON answers with status and v as a JSON document
+func writeJSON(writer http.ResponseWriter, status int, v interface{}) {
+	jsonData, err := json.Marshal(v)
+	utils.CheckError(err)
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsonData)
+}
+
+// writeError answers with status and err as an ErrorBody
+func writeError(writer http.ResponseWriter, status int, err error) {
+	code := control.CodeInternal
+	switch status {
+	case http.StatusBadRequest:
+		code = control.CodeBadRequest
+	case http.StatusUnauthorized:
+		code = control.CodeUnauthorized
+	case http.StatusForbidden:
+		code = control.CodeForbidden
+	case http.StatusNotFound:
+		code = control.CodeNotFound
+	case http.StatusConflict:
+		code = control.CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		code = control.CodeTooLarge
+	}
+	writeJSON(writer, status, &control.ErrorBody{Error: control.Error{Code: code, Message: err.Error()}})
+}
+
+// parseAlgorithm reads an optional key algorithm
+func parseAlgorithm(algString string) (w2pcrypto.Algorithm, error) {
+	if algString == "" {
+		return w2pcrypto.DefaultAlgorithm, nil
+	}
+	return w2pcrypto.ParseAlgorithm(algString)
+}
+
+// parsePublicKey reads a public key in its string representation
+func parsePublicKey(str string) (*w2pcrypto.PublicKey, error) {
+	key := &w2pcrypto.PublicKey{}
+	err := key.UnmarshalText([]byte(strings.TrimSpace(str)))
+	return key, err
+}
+
+// ServeUI serves the UI page embedded in the binary, or the one in UIDir if
+// it is set so that the UI can be changed without rebuilding
 func ServeUI() http.Handler {
-	return http.FileServer(http.Dir(utils.UIDir))
+	if utils.UIDir != "" {
+		log.Println("[UI] Serving the UI from '" + utils.UIDir + "'")
+		return http.FileServer(http.Dir(utils.UIDir))
+	}
+
+	root, err := fs.Sub(webpage, "webpage")
+	utils.CheckError(err)
+	return http.FileServer(http.FS(root))
 }
 
 // ServeWebsites serves the website folder
@@ -130,17 +797,58 @@ func OpenBrowser(url string) {
 	utils.CheckError(err)
 }
 
-// StartServer starts listening and serving on addr
-func StartServer(uiPort string, node *node.Node) {
-	http.Handle("/", ServeUI())
-	http.Handle("/w/", ServeWebsites())
-	http.Handle("/list", ListWebsites(node))
-	http.HandleFunc("/scan", ScanWebsiteFolder)
-	http.HandleFunc("/status", ShowStatus(node))
-	http.Handle("/filter", FilterWebsites(node))
-	http.HandleFunc("/share", ImportWebsite(node))
-	http.HandleFunc("/update", UpdateWebsite(node))
+// StartServer starts listening and serving the UI and the control API on the
+// UIPort of cfg, and on its UIListen address over TLS if it is set, the
+// clients being authenticated by the token in the TokenFile
+func StartServer(cfg *config.Config, node *node.Node) {
+	token, err := control.LoadOrCreateToken(utils.TokenFile)
+	utils.CheckError(err)
+
+	api := control.APIPrefix
+	mux := http.NewServeMux()
+	mux.Handle("/api/", Authenticate(token, http.HandlerFunc(NotFound)))
+	handle := func(pattern string, handler http.HandlerFunc) {
+		method, path, _ := strings.Cut(pattern, " ")
+		mux.Handle(method+" "+api+path, Authenticate(token, handler))
+	}
+
+	mux.Handle("/", Login(token, ServeUI()))
+	mux.Handle("/w/", Sandbox(ServeWebsites()))
+	handle("GET /status", ShowStatus(node))
+	handle("GET /peers", ListPeers(node))
+	handle("GET /folders", ScanWebsiteFolder)
+	handle("GET /sites", ListWebsites(node))
+	handle("POST /sites", PublishWebsite(node))
+	handle("GET /sites/{name}", ShowWebsite(node))
+	handle("PUT /sites/{name}", UpdateWebsite(node))
+	handle("POST /sites/{name}/unlock", UnlockWebsite(node))
+	handle("POST /sites/{name}/lock", LockWebsite(node))
+	handle("POST /sites/{name}/fetch", FetchWebsite(node))
+	handle("POST /sites/{name}/export", ExportWebsite(node))
+	handle("POST /sites/{name}/editor-key", CreateEditorKey(node))
+	handle("POST /sites/{name}/delegations", DelegateWebsite(node))
+	handle("DELETE /sites/{name}/delegations", UndelegateWebsite(node))
+	handle("POST /sites/{name}/rotate", RotateWebsite(node))
+	handle("POST /sites/{name}/revocations", RevokeKey(node))
+	handle("POST /identities", ImportIdentity(node))
+	handle("GET /bandwidth", ShowBandwidth(node))
+	handle("PUT /bandwidth", SetBandwidth(node))
 
-	go OpenBrowser("http://127.0.0.1:" + uiPort)
-	http.ListenAndServe("127.0.0.1:"+uiPort, nil)
+	// other machines only reach the UI over TLS, the token being a password
+	if cfg.UIListen != "" {
+		if cfg.UICert == "" || cfg.UIKey == "" {
+			log.Fatal("[UI] Serving the UI on " + cfg.UIListen + " needs a TLS certificate and key (-uiCert and -uiKey)")
+		}
+		log.Println("[UI] Serving the UI over TLS on " + cfg.UIListen)
+		go func() {
+			err := http.ListenAndServeTLS(cfg.UIListen, cfg.UICert, cfg.UIKey, mux)
+			utils.CheckError(err)
+		}()
+	}
+
+	url := "http://127.0.0.1:" + cfg.UIPort + "/?token=" + token
+	log.Println("[UI] Open the UI at " + url)
+	go OpenBrowser(url)
+	err = http.ListenAndServe("127.0.0.1:"+cfg.UIPort, mux)
+	utils.CheckError(err)
 }
@@ -0,0 +1,483 @@
+package ui
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yaanst/W2P/config"
+	"github.com/yaanst/W2P/control"
+	"github.com/yaanst/W2P/node"
+	"github.com/yaanst/W2P/structs"
+	"github.com/yaanst/W2P/utils"
+	"github.com/yaanst/W2P/w2pcrypto"
+)
+
+// -----------
+// - Helpers -
+// -----------
+
+// uploadRequest returns a request uploading the files, given as pairs of
+// path and contents, as the UI does
+func uploadRequest(t *testing.T, files [][2]string) *http.Request {
+	t.Helper()
+	b := bytes.Buffer{}
+	mw := multipart.NewWriter(&b)
+	mw.WriteField("passphrase", "secret")
+	for _, file := range files {
+		w, err := mw.CreateFormFile("files", filepath.Base(file[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(file[1]))
+		mw.WriteField("paths", file[0])
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "/api/v1/sites", &b)
+	request.Header.Set("Content-Type", mw.FormDataContentType())
+	return request
+}
+
+// newTestNode returns a node whose websites and keys are in a temporary
+// folder for the duration of the test
+func newTestNode(t *testing.T) *node.Node {
+	t.Helper()
+	tmp := t.TempDir()
+
+	// the directories set by Apply
+	websiteDir, metadataDir, seedDir, keyDir := utils.WebsiteDir, utils.MetadataDir, utils.SeedDir, utils.KeyDir
+	uiDir, identityFile, tokenFile, keyFolder := utils.UIDir, utils.IdentityFile, utils.TokenFile, w2pcrypto.KeyFolder
+	t.Cleanup(func() {
+		utils.WebsiteDir, utils.MetadataDir, utils.SeedDir, utils.KeyDir = websiteDir, metadataDir, seedDir, keyDir
+		utils.UIDir, utils.IdentityFile, utils.TokenFile, w2pcrypto.KeyFolder = uiDir, identityFile, tokenFile, keyFolder
+	})
+
+	cfg := config.Default()
+	cfg.Datadir = tmp
+	cfg.Apply()
+	for _, dir := range []string{utils.WebsiteDir, utils.MetadataDir, utils.SeedDir, utils.KeyDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &node.Node{
+		Config:     cfg,
+		Addr:       structs.ParsePeer("127.0.0.1:5000"),
+		Peers:      structs.NewPeers(),
+		Members:    structs.NewMembership(),
+		WebsiteMap: structs.NewWebsiteMap(),
+		Keyring:    w2pcrypto.NewKeyring(),
+		Bans:       structs.NewBans(),
+		Upload:     structs.NewBandwidth(0),
+		Download:   structs.NewBandwidth(0),
+	}
+}
+
+// jsonRequest returns a request of the control API with body as JSON
+func jsonRequest(t *testing.T, method, target string, body interface{}) *http.Request {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(method, target, bytes.NewReader(data))
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+// ---------
+// - Tests -
+// ---------
+
+func TestCheckDir(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		dir        string
+		ok         bool
+	}{
+		{"no folder", "203.0.113.7:40000", "", true},
+		{"IPv4 loopback", "127.0.0.1:40000", "/home/user/site", true},
+		{"IPv6 loopback", "[::1]:40000", "/home/user/site", true},
+		{"remote client", "203.0.113.7:40000", "/home/user/site", false},
+		{"LAN client", "192.168.1.20:40000", "/etc", false},
+		{"unknown address", "", "/home/user/site", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("POST", "/api/v1/sites", nil)
+			request.RemoteAddr = test.remoteAddr
+			writer := httptest.NewRecorder()
+
+			if got := checkDir(writer, request, test.dir); got != test.ok {
+				t.Errorf("checkDir() = %v, want %v", got, test.ok)
+			}
+			if !test.ok && writer.Code != http.StatusForbidden {
+				t.Errorf("status = %v, want %v", writer.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestReadUpload(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  [][2]string
+		noTemp bool
+		status int
+		dir    string
+		want   []string
+	}{
+		{"folder", [][2]string{{"site/index.html", "<h1>site</h1>"}, {"site/css/m.css", "h1 {}"}},
+			false, http.StatusOK, "site", []string{"css/m.css", "index.html"}},
+		{"traversal", [][2]string{{"../../evil.html", "evil"}},
+			false, http.StatusOK, "", []string{"evil.html"}},
+		{"too many files", [][2]string{{"a", "a"}, {"b", "b"}, {"c", "c"}, {"d", "d"}},
+			false, http.StatusRequestEntityTooLarge, "", nil},
+		{"too large", [][2]string{{"a", strings.Repeat("a", 2048)}},
+			false, http.StatusRequestEntityTooLarge, "", nil},
+		{"nothing uploaded", nil,
+			false, http.StatusBadRequest, "", nil},
+		{"no temporary folder", [][2]string{{"index.html", "<h1>site</h1>"}},
+			true, http.StatusInternalServerError, "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+			if test.noTemp {
+				t.Setenv("TMPDIR", filepath.Join(tmp, "missing"))
+			}
+
+			cfg := config.Default()
+			cfg.MaxUploadSize = 1024
+			cfg.MaxUploadFiles = 3
+			n := &node.Node{Config: cfg}
+
+			writer := httptest.NewRecorder()
+			req := &control.PublishRequest{}
+			dir, ok := readUpload(n, writer, uploadRequest(t, test.files), req)
+			if test.status != http.StatusOK {
+				if ok || writer.Code != test.status {
+					t.Fatalf("readUpload() = %v with status %v, want %v", ok, writer.Code, test.status)
+				}
+				if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+					t.Errorf("upload not cleaned up: %v", entries)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("readUpload() failed with status %v: %v", writer.Code, writer.Body)
+			}
+
+			if !strings.HasPrefix(dir, tmp) || !strings.HasPrefix(req.Dir, dir) {
+				t.Fatalf("website unpacked in %v, not in %v", req.Dir, tmp)
+			}
+			if filepath.Base(req.Dir) != test.dir && test.dir != "" {
+				t.Errorf("website folder = %v, want %v", filepath.Base(req.Dir), test.dir)
+			}
+			var files []string
+			filepath.Walk(tmp, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					rel, _ := filepath.Rel(req.Dir, path)
+					files = append(files, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if strings.Join(files, ",") != strings.Join(test.want, ",") {
+				t.Errorf("files = %v, want %v", files, test.want)
+			}
+		})
+	}
+}
+
+func TestPublishWebsite(t *testing.T) {
+	tests := []struct {
+		name    string
+		folder  bool
+		editKey bool
+		status  int
+	}{
+		{"folder in the websites", true, false, http.StatusCreated},
+		{"missing folder", false, false, http.StatusNotFound},
+		{"existing editor key", true, true, http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t)
+			if test.folder {
+				os.Mkdir(utils.WebsiteDir+"site", 0755)
+				os.WriteFile(utils.WebsiteDir+"site/index.html", []byte("<h1>site</h1>"), 0644)
+			}
+			var editorKey []byte
+			if test.editKey {
+				if _, err := n.CreateEditorKey("site", w2pcrypto.AlgEd25519, []byte("editor")); err != nil {
+					t.Fatal(err)
+				}
+				editorKey, _ = os.ReadFile(utils.KeyDir + "site")
+				n.Keyring.Lock("site")
+			}
+
+			writer := httptest.NewRecorder()
+			request := jsonRequest(t, "POST", "/api/v1/sites", &control.PublishRequest{Name: "site", Passphrase: "secret"})
+			PublishWebsite(n)(writer, request)
+
+			if writer.Code != test.status {
+				t.Fatalf("status = %v, want %v: %v", writer.Code, test.status, writer.Body)
+			}
+			created := test.status == http.StatusCreated
+			key, err := os.ReadFile(utils.KeyDir + "site")
+			if test.editKey && !bytes.Equal(key, editorKey) {
+				t.Error("editor key overwritten")
+			} else if !test.editKey && (err == nil) != created {
+				t.Errorf("key created = %v, want %v", err == nil, created)
+			}
+			if known := n.WebsiteMap.Get("site") != nil; known != created {
+				t.Errorf("website known = %v, want %v", known, created)
+			}
+			if test.editKey {
+				if err := n.AddNewWebsite("site", nil, w2pcrypto.AlgEd25519, []byte("secret")); err == nil {
+					t.Error("AddNewWebsite() replaced an existing key")
+				}
+			}
+
+			// the node itself refuses a missing folder before creating a key
+			if err := n.AddNewWebsite("ghost", nil, w2pcrypto.AlgEd25519, []byte("secret")); err == nil {
+				t.Error("AddNewWebsite() accepted a missing folder")
+			}
+			if _, err := os.Stat(utils.KeyDir + "ghost"); err == nil {
+				t.Error("key created for a missing folder")
+			}
+		})
+	}
+}
+
+func TestRotateWebsite(t *testing.T) {
+	tests := []struct {
+		name       string
+		passphrase string
+		noSave     bool
+		status     int
+	}{
+		{"rotated", "new secret", false, http.StatusNoContent},
+		{"empty passphrase", "", false, http.StatusBadRequest},
+		{"key not saved", "new secret", true, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t)
+			os.Mkdir(utils.WebsiteDir+"site", 0755)
+			os.WriteFile(utils.WebsiteDir+"site/index.html", []byte("<h1>site</h1>"), 0644)
+			if err := n.AddNewWebsite("site", nil, w2pcrypto.AlgEd25519, []byte("secret")); err != nil {
+				t.Fatal(err)
+			}
+			website := n.WebsiteMap.Get("site")
+			oldKey, oldPubKey := n.Keyring.Get("site"), website.PubKey.String()
+			if test.noSave {
+				// the new key cannot be written over a folder
+				os.Mkdir(utils.KeyDir+".site.new", 0755)
+			}
+
+			writer := httptest.NewRecorder()
+			request := jsonRequest(t, "POST", "/api/v1/sites/site/rotate",
+				&control.RotateRequest{Passphrase: test.passphrase, Revoke: true})
+			request.SetPathValue("name", "site")
+			RotateWebsite(n)(writer, request)
+
+			if writer.Code != test.status {
+				t.Fatalf("status = %v, want %v: %v", writer.Code, test.status, writer.Body)
+			}
+			rotated := test.status == http.StatusNoContent
+			if got := website.PubKey.String() != oldPubKey; got != rotated {
+				t.Errorf("owner key changed = %v, want %v", got, rotated)
+			}
+			if got := n.Keyring.Get("site") != oldKey; got != rotated {
+				t.Errorf("unlocked key changed = %v, want %v", got, rotated)
+			}
+			passphrase := "secret"
+			if rotated {
+				passphrase = test.passphrase
+			} else if len(website.Rotations) != 0 || len(website.Revocations) != 0 {
+				t.Error("website changed by a failed rotation")
+			}
+			key, err := w2pcrypto.LoadPrivateKey("site", []byte(passphrase))
+			if err != nil || key.Public().String() != website.PubKey.String() {
+				t.Errorf("saved key does not own the website: %v", err)
+			}
+			if _, err := os.Stat(utils.KeyDir + ".site.new"); err == nil && !test.noSave {
+				t.Error("temporary key left behind")
+			}
+
+			// the website can still be published with its key
+			if err := n.UpdateWebsite("site", nil); err != nil || !website.VerifyUpdate() {
+				t.Errorf("website not updatable after the rotation: %v", err)
+			}
+		})
+	}
+}
+
+func TestFetchWebsite(t *testing.T) {
+	tests := []struct {
+		name   string
+		owned  bool
+		seeded bool
+		status int
+	}{
+		{"owned", true, true, http.StatusConflict},
+		{"up to date", false, true, http.StatusConflict},
+		{"no seeder", false, false, http.StatusBadGateway},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t)
+			os.Mkdir(utils.WebsiteDir+"site", 0755)
+			os.WriteFile(utils.WebsiteDir+"site/index.html", []byte("<h1>site</h1>"), 0644)
+			if err := n.AddNewWebsite("site", nil, w2pcrypto.AlgEd25519, []byte("secret")); err != nil {
+				t.Fatal(err)
+			}
+			website := n.WebsiteMap.Get("site")
+			if !test.owned {
+				os.Remove(utils.KeyDir + "site")
+			}
+			if !test.seeded {
+				// a new version whose only seeder is the node itself
+				website.Pieces = strings.Repeat("0", utils.HashSize)
+			}
+			archive, _ := os.ReadFile(utils.SeedDir + "site")
+
+			writer := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/api/v1/sites/site/fetch", nil)
+			request.SetPathValue("name", "site")
+			FetchWebsite(n)(writer, request)
+
+			if writer.Code != test.status {
+				t.Fatalf("status = %v, want %v: %v", writer.Code, test.status, writer.Body)
+			}
+			if got, _ := os.ReadFile(utils.SeedDir + "site"); !bytes.Equal(got, archive) {
+				t.Error("archive changed")
+			}
+			if entries, _ := os.ReadDir(utils.SeedDir); len(entries) != 1 {
+				t.Errorf("files left in the seeds: %v", entries)
+			}
+			if _, err := os.Stat(utils.WebsiteDir + "site/index.html"); err != nil {
+				t.Error("website files removed")
+			}
+		})
+	}
+}
+
+func TestSetBandwidth(t *testing.T) {
+	rate := func(kb int) *int { return &kb }
+
+	tests := []struct {
+		name     string
+		requests []control.BandwidthRequest
+		status   int
+		upload   map[string]int
+		download map[string]int
+	}{
+		{"global caps", []control.BandwidthRequest{{Upload: rate(10), Download: rate(20)}},
+			http.StatusOK, map[string]int{"": 10}, map[string]int{"": 20}},
+		{"website cap", []control.BandwidthRequest{{Name: "site", Upload: rate(5)}},
+			http.StatusOK, map[string]int{"": 0, "site": 5}, map[string]int{"": 0}},
+		{"missing cap unchanged", []control.BandwidthRequest{{Upload: rate(10), Download: rate(20)}, {Upload: rate(30)}},
+			http.StatusOK, map[string]int{"": 30}, map[string]int{"": 20}},
+		{"cap removed", []control.BandwidthRequest{{Name: "site", Download: rate(5)}, {Name: "site", Download: rate(0)}},
+			http.StatusOK, map[string]int{"": 0}, map[string]int{"": 0}},
+		{"negative cap", []control.BandwidthRequest{{Upload: rate(10), Download: rate(-1)}},
+			http.StatusBadRequest, map[string]int{"": 0}, map[string]int{"": 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t)
+			writer := httptest.NewRecorder()
+			for _, req := range test.requests {
+				writer = httptest.NewRecorder()
+				SetBandwidth(n)(writer, jsonRequest(t, "PUT", "/api/v1/bandwidth", req))
+			}
+			if writer.Code != test.status {
+				t.Fatalf("status = %v, want %v: %v", writer.Code, test.status, writer.Body)
+			}
+
+			// the node's caps are in bytes per second
+			for _, caps := range []struct {
+				got  map[string]int
+				want map[string]int
+			}{{n.Upload.Rates(), test.upload}, {n.Download.Rates(), test.download}} {
+				if len(caps.got) != len(caps.want) {
+					t.Fatalf("rates = %v, want %v KB/s", caps.got, caps.want)
+				}
+				for name, kb := range caps.want {
+					if caps.got[name] != kb*1000 {
+						t.Errorf("rates = %v, want %v KB/s", caps.got, caps.want)
+					}
+				}
+			}
+
+			if test.status == http.StatusOK {
+				answer := &control.Bandwidth{}
+				if err := json.Unmarshal(writer.Body.Bytes(), answer); err != nil {
+					t.Fatal(err)
+				}
+				if answer.Upload[test.requests[0].Name] != test.upload[test.requests[0].Name] ||
+					answer.Download[""] != test.download[""] {
+					t.Errorf("answer = %+v, want %v and %v KB/s", answer, test.upload, test.download)
+				}
+			}
+		})
+	}
+}
+
+func TestServeUI(t *testing.T) {
+	embedded, _ := webpage.ReadFile("webpage/main.js")
+	override := t.TempDir()
+	os.WriteFile(filepath.Join(override, "main.js"), []byte("// development"), 0644)
+
+	tests := []struct {
+		name   string
+		uiDir  string
+		path   string
+		status int
+		body   string
+	}{
+		{"embedded page", "", "/", http.StatusOK, "<title>Web2Peer</title>"},
+		{"embedded asset", "", "/main.js", http.StatusOK, string(embedded)},
+		{"missing embedded asset", "", "/missing.js", http.StatusNotFound, ""},
+		{"embedded root only", "", "/webpage/main.js", http.StatusNotFound, ""},
+		{"overridden asset", override, "/main.js", http.StatusOK, "// development"},
+		{"asset not overridden", override, "/main.css", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uiDir := utils.UIDir
+			t.Cleanup(func() { utils.UIDir = uiDir })
+			utils.UIDir = test.uiDir
+
+			writer := httptest.NewRecorder()
+			ServeUI().ServeHTTP(writer, httptest.NewRequest("GET", test.path, nil))
+			if writer.Code != test.status {
+				t.Fatalf("status = %v, want %v", writer.Code, test.status)
+			}
+			if !strings.Contains(writer.Body.String(), test.body) {
+				t.Errorf("body = %q, want %q", writer.Body, test.body)
+			}
+		})
+	}
+}
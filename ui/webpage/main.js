@@ -1,9 +1,16 @@
+// The path of the version of the control API used by the UI
+var API = "/api/v1";
+
+// The header proving the requests come from the UI, set to the value of the
+// CSRF cookie
+var CSRF_HEADER = "X-CSRF-Token";
+
 /***********************************
         Retrieve content
 ************************************/
 // Get the website list
 (function fetch_website_list() {
-    $.get("/list", function(data) {
+    api("GET", "/sites").done(function(data) {
         print_websites_list(data);
         setTimeout(fetch_website_list, 1000);
     });
@@ -11,9 +18,13 @@
 
 // Get status info
 (function fetch_status_info() {
-    $.get("/status", function(data) {
+    api("GET", "/status").done(function(data) {
         print_status_info(data);
         setTimeout(fetch_status_info, 1000);
+    }).fail(function (xhr) {
+        if (xhr.status == 401) {
+            $("#status_bar_name").html("<b>" + error_message(xhr) + "</b>");
+        }
     });
 })();
 
@@ -23,7 +34,7 @@
 var EXTRA_WINDOW = ""
 // Triggers "websites" folder scan and show hidden inputs
 $(document).on("click", "#share_website_button", function() {
-    $.get("/scan", function(data) {
+    api("GET", "/folders").done(function(data) {
         print_website_folder(data);
     });
     EXTRA_WINDOW = "share";
@@ -34,7 +45,7 @@ $(document).on("click", "#share_website_button", function() {
 
 // Triggers "websites" folder scan and show hidden inputs
 $(document).on("click", "#update_website_button", function() {
-    $.get("/scan", function(data) {
+    api("GET", "/folders").done(function(data) {
         print_website_folder(data);
     });
     EXTRA_WINDOW = "update";
@@ -45,44 +56,156 @@ $(document).on("click", "#update_website_button", function() {
 
 // Send name and keywords to share/update website
 $(document).on("click", "#websites_extra_button", function() {
+    var name = $("#extra_folders_select").val();
+    var keywords = $("#keywords_input").val();
+
     if (EXTRA_WINDOW == "share") {
-        $.post("/share", 
+        api("POST", "/sites",
             {
-                name: $("#extra_folders_select").val(),
-                keywords: $("#keywords_input").val()
-            },
-            function (data, status) {}
-        );
+                name: name,
+                keywords: keywords.split(","),
+                algorithm: $("#algorithm_select").val(),
+                passphrase: $("#passphrase_input").val()
+            }
+        ).fail(function (xhr) {
+            alert("Website could not be shared.\n" + error_message(xhr));
+        });
 
     } else if (EXTRA_WINDOW == "update") {
-        $.post("/update", 
+        var path = "/sites/" + encodeURIComponent(name);
+
+        // the website's key needs to be unlocked before updating it, the
+        // current keywords being kept if none are given
+        api("POST", path + "/unlock",
             {
-                name: $("#extra_folders_select").val(),
-                keywords: $("#keywords_input").val()
-            },
-            function (data, status) {
-                if (data == "false") {
-                    alert("Website could not be updated.\nYou can update only websites already existing and that you own");
-                }
+                passphrase: $("#passphrase_input").val()
             }
-        );
+        ).done(function () {
+            api("PUT", path,
+                {
+                    keywords: keywords == "" ? null : keywords.split(",")
+                }
+            ).fail(function (xhr) {
+                alert("Website could not be updated.\n" + error_message(xhr));
+            });
+        }).fail(function (xhr) {
+            alert("Website could not be unlocked.\n" + error_message(xhr));
+        });
     }
+    $("#passphrase_input").val("");
     $("#websites_section_extra").hide();
     $(".update").hide();
     $(".share").hide();
 });
 
+// Download the identity bundle of an unlocked website
+$(document).on("submit", "#export_form", function(event) {
+    event.preventDefault();
+    var fields = form_fields(this);
+    var name = fields.name;
+    delete fields.name;
+
+    fetch(API + "/sites/" + encodeURIComponent(name) + "/export", {
+        method: "POST",
+        headers: {"Content-Type": "application/json", [CSRF_HEADER]: csrf_token()},
+        body: JSON.stringify(fields)
+    }).then(function (response) {
+        if (!response.ok) {
+            return response.json().then(function (data) {
+                throw new Error(data.error.message);
+            });
+        }
+        return response.blob();
+    }).then(function (bundle) {
+        var link = document.createElement("a");
+        link.href = URL.createObjectURL(bundle);
+        link.download = name + ".w2p";
+        link.click();
+        URL.revokeObjectURL(link.href);
+    }).catch(function (error) {
+        alert("Website could not be exported.\n" + error.message);
+    });
+    this.reset();
+});
+
+// Upload an identity bundle exported by another node
+$(document).on("submit", "#import_form", function(event) {
+    event.preventDefault();
+    $.ajax({
+        url: API + "/identities",
+        type: "POST",
+        headers: {[CSRF_HEADER]: csrf_token()},
+        data: new FormData(this),
+        processData: false,
+        contentType: false,
+        dataType: "json",
+        success: function (data) {
+            alert("Website '" + data.name + "' imported.\nIt can now be updated from this node");
+        },
+        error: function (xhr) {
+            alert("Website could not be imported.\n" + error_message(xhr));
+        }
+    });
+    this.reset();
+});
+
+// Send the simple forms of the identity and bandwidth sections to the API and
+// show the result, the website name filling the path of their action
+$(document).on("submit", ".ajax_form", function(event) {
+    event.preventDefault();
+    var fields = form_fields(this);
+    var path = $(this).attr("action");
+    if (path.indexOf("{name}") >= 0) {
+        path = path.replace("{name}", encodeURIComponent(fields.name));
+        delete fields.name;
+    }
+
+    api($(this).data("method"), path, fields).done(function (data) {
+        if (data && data.key) {
+            prompt("Done", data.key);
+        } else {
+            alert("Done");
+        }
+    }).fail(function (xhr) {
+        alert("Error:\n" + error_message(xhr));
+    });
+    this.reset();
+});
+
+// Upload and share a website, the files of a folder being sent with their
+// paths as the server only keeps their base name
+$(document).on("submit", "#upload_form", function(event) {
+    event.preventDefault();
+    var data = new FormData(this);
+    $.each($("#upload_folder")[0].files, function (idx, file) {
+        data.append("files", file);
+        data.append("paths", file.webkitRelativePath || file.name);
+    });
+
+    $.ajax({
+        url: API + "/sites",
+        type: "POST",
+        headers: {[CSRF_HEADER]: csrf_token()},
+        data: data,
+        processData: false,
+        contentType: false,
+        dataType: "json",
+        success: function (data) {
+            alert("Website '" + data.name + "' shared.");
+        },
+        error: function (xhr) {
+            alert("Website could not be shared.\n" + error_message(xhr));
+        }
+    });
+    this.reset();
+});
+
 // Filter the website list based on keywords entered in the input field
 $(document).on("click", "#filter_apply_button", function() {
     k = $("#filter_keywords").val();
-    $.post("/filter", 
-        {
-            keywords: k
-        },
-        function (data, status) {
-            print_websites_filtered(data);
-        }
-    );
+    api("GET", "/sites?q=" + encodeURIComponent(k)).done(function (data) {
+        print_websites_filtered(data);
+    });
     $("#current_filter").html("<b>Current filter:</b> " + k);
     $("#websites_list").hide();
     $("#websites_list_filtered").show();
@@ -99,57 +222,40 @@ $(document).on("click", "#filter_clear_button", function() {
 /*********************
         Helpers
 **********************/
-// Format and print the JSON string for websites
-function print_websites_list(data) {
-    websites = JSON.parse(data);
-    if (websites != null) {
-        websites = websites.W
-        num_websites = Object.keys(websites).length;
-
-        if (num_websites > 0) {
-            // sort websites by name
-            var sorted =  [];
-            for (var name in websites) sorted.push(websites[name]);
-            sorted = sorted.sort(function(a,b) {
-                return (a.Name).localeCompare(b.Name)
-            });
-
-            list = ""
-            for (idx in sorted) {
-                w = sorted[idx];
-                list += `<li><a target="_blank" href="/w/${w.Name}">${w.Name}</a></li>`
-                delete w;
-            }
+// Format and print the list of websites sorted by name
+function print_websites_list(websites) {
+    websites = websites.sort(function(a,b) {
+        return (a.name).localeCompare(b.name)
+    });
 
-            $("#websites_list").html(list);
-            delete list;
-            delete sorted;
-        }
-        delete num_websites;
+    list = ""
+    for (idx in websites) {
+        w = websites[idx];
+        list += `<li><a target="_blank" href="/w/${w.name}">${w.name}</a></li>`
+        delete w;
     }
-    delete websites;
+    $("#websites_list").html(list);
+    delete list;
 }
 
 // Format and print the filtered list of websites
-function print_websites_filtered(data) {
-    websites = JSON.parse(data);
+function print_websites_filtered(websites) {
+    websites = websites.sort(function(a,b) {
+        return (a.name).localeCompare(b.name)
+    });
+
     list = ""
-    if (websites != null) {
-        websites = websites.sort()
-        for (idx in websites) {
-            w = websites[idx];
-            list += `<li><a target="_blank" href="/w/${w}">${w}</a></li>`
-            delete w;
-        }
+    for (idx in websites) {
+        w = websites[idx];
+        list += `<li><a target="_blank" href="/w/${w.name}">${w.name}</a></li>`
+        delete w;
     }
     $("#websites_list_filtered").html(list);
     delete list;
-    delete websites;
 }
 
 // Format and print the contents of the website folder
-function print_website_folder(data) {
-    websites = JSON.parse(data);
+function print_website_folder(websites) {
     websites = websites.sort();
 
     options = $("#extra_folders_select").innerHTML
@@ -164,19 +270,74 @@ function print_website_folder(data) {
 }
 
 // Format and print the stauts information
-function print_status_info(data) {
-    info = JSON.parse(data);
+function print_status_info(info) {
     name = "<b>Name:</b> " + info["name"];
+    id = "<b>ID:</b> <span title=\"" + info["id"] + "\">" + info["id"].substring(0, 16) + "</span>";
     addr = "<b>Address:</b> " + info["addr"];
     peers = "<b>#Peers:</b> " + info["peers"];
     websites = "<b>#Websites:</b> " + info["websites"];
+    bandwidth = "<b>Caps:</b> &uarr; " + rate_string(info["upload"]) +
+        " &darr; " + rate_string(info["download"]);
     $("#status_bar_name").html(name);
+    $("#status_bar_id").html(id);
     $("#status_bar_addr").html(addr);
     $("#status_bar_peers").html(peers);
     $("#status_bar_websites").html(websites);
-    delete info;
+    $("#status_bar_bandwidth").html(bandwidth);
     delete name;
+    delete id;
     delete addr;
     delete peers;
     delete websites;
+    delete bandwidth;
+}
+
+// Format a rate cap in KB/s, 0 meaning no cap
+function rate_string(rate) {
+    if (rate == 0) {
+        return "none";
+    }
+    return rate + " KB/s";
+}
+
+// Send a request to the control API with an optional JSON body
+function api(method, path, body) {
+    return $.ajax({
+        url: API + path,
+        type: method,
+        data: body === undefined ? undefined : JSON.stringify(body),
+        contentType: "application/json",
+        headers: {[CSRF_HEADER]: csrf_token()},
+        dataType: "json"
+    });
+}
+
+// Read the value of the CSRF cookie set when opening the UI with the token
+function csrf_token() {
+    var match = document.cookie.match(/(?:^|;\s*)w2p_csrf=([^;]*)/);
+    return match ? match[1] : "";
+}
+
+// Read the error message of a failed request to the control API
+function error_message(xhr) {
+    if (xhr.responseJSON && xhr.responseJSON.error) {
+        return xhr.responseJSON.error.message;
+    }
+    return xhr.statusText;
+}
+
+// Collect the fields of a form in an object, checkboxes being booleans and
+// empty numbers null
+function form_fields(form) {
+    var fields = {};
+    $(form).find("input[name]").each(function() {
+        if (this.type == "checkbox") {
+            fields[this.name] = this.checked;
+        } else if (this.type == "number") {
+            fields[this.name] = this.value == "" ? null : parseInt(this.value);
+        } else if (this.type != "file") {
+            fields[this.name] = this.value;
+        }
+    });
+    return fields;
 }
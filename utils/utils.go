@@ -1,29 +1,56 @@
 package utils
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
+
+	"golang.org/x/term"
 )
 
-// ---------
-// - Const -
-// ---------
+// -------------
+// - Variables -
+// -------------
 
-// UIDir is the path to the directory containing the UI
-const UIDir string = "./ui/webpage"
+// The directories are set by the configuration of the node
+
+// UIDir is the path to a directory overriding the UI embedded in the binary,
+// the embedded one being served if it is empty
+var UIDir = ""
 
 // WebsiteDir is the path to the directory containing all websites
-const WebsiteDir string = "./website/"
+var WebsiteDir = "./website/"
 
 // MetadataDir is the directory in which we save all serialization of websites
-const MetadataDir string = "./metadata/"
+var MetadataDir = "./metadata/"
 
 // SeedDir is the path to the directory containing all seeding binary archive
-const SeedDir string = "./seed/"
+var SeedDir = "./seed/"
 
 // KeyDir is the directory containing crypto keys
-const KeyDir string = "./keys/"
+var KeyDir = "./keys/"
+
+// IdentityFile is the path to the file containing the node's identity key
+var IdentityFile = "./identity.key"
+
+// TokenFile is the path to the file containing the token authenticating the
+// clients of the control API
+var TokenFile = "./control.token"
+
+// ---------
+// - Const -
+// ---------
+
+// The other settings are the defaults of the configuration of the node
+
+// ManifestFile is the name of the signed manifest at the root of a website
+const ManifestFile string = "contents.json"
 
 // DefaultPieceLength is the default length in bytes for a piece (8KB)
 const DefaultPieceLength int = 8192
@@ -35,21 +62,128 @@ const ListenBufferSize int = 65536
 // ConnBufferSize is the os buffer size to receive and send udp packets
 const ConnBufferSize int = 10485760 // 10MB
 
-// HeartBeatBufferSize is the default size for buffer waiting for a heartbeat
-const HeartBeatBufferSize int = 512
+// MaxPeers is the maximum number of peers a node keeps, the ones with the
+// lowest score being evicted
+const MaxPeers int = 64
+
+// MaxSeeders is the maximum number of seeders kept for a website
+const MaxSeeders int = 32
+
+// MaxSessions is the maximum number of sessions a node keeps, the ones of the
+// peers with the lowest score being evicted
+const MaxSessions int = 256
+
+// PeerRate is the number of requests per second a peer can send, up to
+// PeerBurst at once
+const PeerRate float64 = 100
 
-// HeartBeatLimit is the default maximum number of concurrent heartbeats
-const HeartBeatLimit int = 50
+// PeerBurst is the number of requests a peer can send at once
+const PeerBurst float64 = 200
+
+// Workers is the number of goroutines handling the requests of other nodes
+const Workers int = 16
+
+// WorkQueueSize is the number of requests waiting for a worker beyond which
+// new requests are dropped
+const WorkQueueSize int = 256
+
+// DefaultDownloadRate is the default cap in bytes per second of the download
+// rate of a node
+const DefaultDownloadRate int = 512000 // 500KB/s
+
+// DefaultUploadRate is the default cap in bytes per second of the upload rate
+// of a node, 0 meaning no cap
+const DefaultUploadRate int = 0
+
+// MaxBadPieces is the number of bad pieces after which a peer is banned
+const MaxBadPieces int = 3
+
+// BanDuration is the time a peer which sent invalid data is banned for
+const BanDuration time.Duration = time.Duration(600000000000) // 10min
 
 // HeartBeatTimeout is the default timeout for an answer from a peer
-const HeartBeatTimeout time.Duration = time.Duration(10000000000) // 10s
+const HeartBeatTimeout time.Duration = time.Duration(2000000000) // 2s
+
+// ProbeInterval is the interval at which the failure detector probes a peer
+const ProbeInterval time.Duration = time.Duration(1000000000) // 1s
+
+// IndirectProbes is the number of peers asked to probe a peer which does not
+// answer directly
+const IndirectProbes int = 3
+
+// SuspicionTimeout is the time a suspect peer has to show it is alive before
+// being considered dead
+const SuspicionTimeout time.Duration = time.Duration(15000000000) // 15s
+
+// PexInterval is the interval at which a node exchanges peers with a peer
+const PexInterval time.Duration = time.Duration(10000000000) // 10s
+
+// PexSize is the maximum number of peers sent in a peer exchange
+const PexSize int = 10
+
+// LANGroup is the multicast group on which nodes announce themselves on the
+// local network
+const LANGroup string = "239.255.87.50:7650"
+
+// LANNetwork identifies the announces of W2P nodes in LANGroup
+const LANNetwork string = "W2P"
+
+// LANInterval is the interval at which a node announces itself on the local
+// network
+const LANInterval time.Duration = time.Duration(5000000000) // 5s
+
+// DeadMemberTimeout is the time a dead peer is remembered to notice its rejoin
+const DeadMemberTimeout time.Duration = time.Duration(600000000000) // 10min
+
+// AntiEntropyInterval is the interval at which a node sends its WebsiteMap
+// to its peers
+const AntiEntropyInterval time.Duration = time.Duration(3000000000) // 3s
+
+// HandshakeTimeout is the timeout for establishing a session with a peer
+const HandshakeTimeout time.Duration = time.Duration(5000000000) // 5s
+
+// SessionTimeout is the time after which a session in which nothing was
+// received is closed
+const SessionTimeout time.Duration = time.Duration(600000000000) // 10min
 
 // DataReqTimeout is the timeout before receiving data
 const DataReqTimeout time.Duration = time.Duration(10000000000) // 10s
 
+// RetrieveTimeout is the time after which the retrieval of a website is given
+// up
+const RetrieveTimeout time.Duration = time.Duration(600000000000) // 10min
+
+// RelayKeepAlive is the interval at which a node behind a NAT registers again
+// with its relay, keeping its NAT mapping open
+const RelayKeepAlive time.Duration = time.Duration(15000000000) // 15s
+
+// IntroductionInterval is the minimum interval between two requests to be
+// introduced to the same peer behind a NAT
+const IntroductionInterval time.Duration = time.Duration(30000000000) // 30s
+
+// PunchAttempts is the number of handshakes tried to punch a path through NATs
+const PunchAttempts int = 5
+
+// PunchTimeout is the timeout of each handshake when punching
+const PunchTimeout time.Duration = time.Duration(1000000000) // 1s
+
+// MaxBundleSize is the maximum size in bytes of an imported identity bundle
+const MaxBundleSize int64 = 1048576 // 1MB
+
+// MaxUploadSize is the maximum size in bytes of a website uploaded from the
+// UI, once unpacked
+const MaxUploadSize int64 = 104857600 // 100MB
+
+// MaxUploadFiles is the maximum number of files of a website uploaded from
+// the UI
+const MaxUploadFiles int = 10000
+
 // HashSize is the number of hex character in a sha256 hash (for pieces)
 const HashSize int = 64
 
+// stdinReader buffers stdin when passphrases are not read from a terminal
+var stdinReader = bufio.NewReader(os.Stdin)
+
 // -----------
 // - Helpers -
 // -----------
@@ -85,3 +219,67 @@ func Contains(slice []string, str string) bool {
 	}
 	return false
 }
+
+// ValidName checks if a website name can safely be used as a file name
+func ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\")
+}
+
+// CopyDir copies the folder src and its contents to dst, which must not exist
+func CopyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		// links and other special files are not part of a website
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
+
+// ReadPassphrase prompts for a passphrase on the terminal without echoing it,
+// or reads a line from stdin if it is not a terminal
+func ReadPassphrase(prompt string) []byte {
+	fmt.Fprint(os.Stderr, prompt)
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		passphrase, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		CheckError(err)
+		return passphrase
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		CheckError(err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n"))
+}
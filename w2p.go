@@ -1,32 +1,102 @@
 package main
 
 import (
-	"log"
 	"flag"
-	"time"
+	"io/ioutil"
+	"log"
+	"os"
 
-	"github.com/yaanst/W2P/ui"
+	"github.com/yaanst/W2P/config"
 	"github.com/yaanst/W2P/node"
+	"github.com/yaanst/W2P/structs"
+	"github.com/yaanst/W2P/ui"
+	"github.com/yaanst/W2P/utils"
+	"github.com/yaanst/W2P/w2pcrypto"
 )
 
+// exportWebsite writes the encrypted identity bundle of an owned website to
+// bundlePath without starting a node
+func exportWebsite(name, bundlePath string) {
+	website := structs.LoadWebsite(name)
+
+	keyPassphrase := utils.ReadPassphrase("Passphrase of the website's key: ")
+	privKey, err := w2pcrypto.LoadPrivateKey(name, keyPassphrase)
+	utils.CheckError(err)
+
+	id, err := structs.NewIdentity(website, privKey)
+	utils.CheckError(err)
+
+	passphrase := utils.ReadPassphrase("Passphrase of the bundle: ")
+	bundle, err := id.Seal(passphrase)
+	utils.CheckError(err)
+
+	err = ioutil.WriteFile(bundlePath, bundle, w2pcrypto.KeyFilePerm)
+	utils.CheckError(err)
+
+	log.Println("[WEBSITES]\tExported identity of website '" + name + "' to " + bundlePath)
+}
+
+// importWebsite imports an identity bundle into the node
+func importWebsite(n *node.Node, bundlePath string) {
+	bundle, err := ioutil.ReadFile(bundlePath)
+	utils.CheckError(err)
+
+	passphrase := utils.ReadPassphrase("Passphrase of the bundle: ")
+	keyPassphrase := utils.ReadPassphrase("New passphrase for the website's key: ")
+
+	name, err := n.ImportWebsite(bundle, passphrase, keyPassphrase)
+	utils.CheckError(err)
+
+	log.Println("[WEBSITES]\tImported identity of website '" + name + "'")
+}
+
 func main() {
-	var name, addr, peers, uiPort string
-	flag.StringVar(&name, "name", "test", "Name of the node")
-	flag.StringVar(&addr, "addr", "", "Address of the node format IP:PORT")
-	flag.StringVar(&peers, "peers", "", "Comma-separated list of peers in the form of IP:PORT")
-	flag.StringVar(&uiPort, "uiPort", "8000", "Port for the browser based UI")
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	var configPath, exportName, importPath, bundlePath string
+	flag.StringVar(&configPath, "config", "", "JSON config file, overridden by W2P_* environment variables and flags")
+	flag.StringVar(&exportName, "export", "", "Export the identity of this website to -bundle and exit")
+	flag.StringVar(&bundlePath, "bundle", "website.w2p", "Path of the identity bundle written by -export")
+	flag.StringVar(&importPath, "import", "", "Identity bundle of a website to import when starting")
+	config.Flags(flag.CommandLine)
+	flag.Usage = usage
 	flag.Parse()
 
-	log.Println("arg name:", name)
-	log.Println("arg addr:", addr)
-	log.Println("arg peers:", peers)
+	cfg, err := config.Load(configPath, flag.CommandLine)
+	utils.CheckError(err)
+	cfg.Apply()
+
+	if exportName != "" {
+		exportWebsite(exportName, bundlePath)
+		return
+	}
+
+	log.Println("arg name:", cfg.Name)
+	log.Println("arg addr:", cfg.Addr)
+	log.Println("arg peers:", cfg.Peers)
 
-	node := node.NewNode(name, addr, peers)
+	node := node.NewNode(cfg)
 	node.Init()
 
-	go node.AntiEntropy(3 * time.Second)
+	if importPath != "" {
+		importWebsite(node, importPath)
+	}
+
+	go node.AntiEntropy(cfg.AntiEntropyInterval.Duration)
+	go node.FailureDetector(cfg.ProbeInterval.Duration)
+	go node.ExchangePeers(cfg.PexInterval.Duration)
+	if cfg.LAN {
+		go node.DiscoverLAN(cfg.LANInterval.Duration)
+	}
 
 	go node.Listen()
 
-    ui.StartServer(uiPort, node)
+	if cfg.UseRelay != "" {
+		go node.UseRelay(structs.ParsePeer(cfg.UseRelay))
+	}
+
+	ui.StartServer(cfg, node)
 }
@@ -1,32 +1,102 @@
-// Package w2pcrypto provides easy-to-use functions for creating RSA key pairs,
-// using them to sign messages and verify signatures
+// Package w2pcrypto provides easy-to-use functions for creating key pairs
+// (Ed25519 or RSA), using them to sign messages and verify signatures
 package w2pcrypto
 
 import (
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
 )
 
-const RsaKeyBits int = 1024
-const KeyFolder string = "./keys/"
+// Algorithm identifies the signature scheme of a key pair
+type Algorithm string
+
+// AlgEd25519 is the default algorithm for new keys
+const AlgEd25519 Algorithm = "ed25519"
+
+// AlgRSA is RSA (at least MinRsaKeyBits) with PKCS#1 v1.5 and SHA-256
+const AlgRSA Algorithm = "rsa"
+
+// AlgLegacyRSA is the 1024-bit RSA of websites published before algorithm
+// agility. Such keys can only be used to verify signatures
+const AlgLegacyRSA Algorithm = "rsa-legacy"
+
+// DefaultAlgorithm is the algorithm used when creating new keys
+const DefaultAlgorithm Algorithm = AlgEd25519
+
+// RsaKeyBits is the size of newly generated RSA keys
+const RsaKeyBits int = 3072
+
+// MinRsaKeyBits is the minimum size accepted for a (non legacy) RSA key
+const MinRsaKeyBits int = 3072
+
+var KeyFolder = "./keys/"
+
+// ScryptN, ScryptR and ScryptP are the scrypt parameters used to derive the
+// encryption key of private keys stored on disk from a passphrase
+const ScryptN int = 32768
+const ScryptR int = 8
+const ScryptP int = 1
+
+// maxScryptMemory and maxScryptP bound the scrypt parameters accepted when
+// decrypting a key, which may come from another machine
+const maxScryptMemory int = 256 << 20 // 256MiB
+const maxScryptP int = 16
+
+// KeyFilePerm is the permission of private key files
+const KeyFilePerm os.FileMode = 0600
+
+// ErrEmptyPassphrase is returned when trying to encrypt a key with no passphrase
+var ErrEmptyPassphrase = errors.New("passphrase cannot be empty")
+
+// ErrBadPassphrase is returned when a private key cannot be decrypted
+var ErrBadPassphrase = errors.New("wrong passphrase or corrupted key")
+
+// ErrPrivateKeyMarshal is returned when serializing a private key as text
+var ErrPrivateKeyMarshal = errors.New("private keys cannot be serialized as text")
+
+const publicKeyPEMType string = "PUBLIC KEY"
+const privateKeyPEMType string = "PRIVATE KEY"
+const encryptedPrivateKeyPEMType string = "W2P ENCRYPTED PRIVATE KEY"
+const legacyPublicKeyPEMType string = "RSA PUBLIC KEY"
+const legacyPrivateKeyPEMType string = "RSA PRIVATE KEY"
 
 // -----------
 // - Structs -
 // -----------
 
+// PublicKey is a public key of any supported algorithm
 type PublicKey struct {
-	*rsa.PublicKey
+	key crypto.PublicKey
 }
+
+// PrivateKey is a private key of any supported algorithm
 type PrivateKey struct {
-	*rsa.PrivateKey
+	key crypto.Signer
+}
+
+// Keyring holds the private keys unlocked with their passphrase, indexed by
+// key file name
+type Keyring struct {
+	mux sync.RWMutex
+	K   map[string]*PrivateKey
 }
 
 // -----------
@@ -40,34 +110,103 @@ func CheckError(err error) {
 	}
 }
 
-// CreateKey is a wrapper for the rsa.GenerateKey function.
-// It returns a *rsa.PrivateKey if no error is encountered.
-func CreateKey() (*PrivateKey, *PublicKey) {
+// CreateKey generates a new key pair for the given algorithm.
+// It returns a *PrivateKey and its *PublicKey if no error is encountered.
+func CreateKey(alg Algorithm) (*PrivateKey, *PublicKey) {
 	rng := rand.Reader
 
-	key, err := rsa.GenerateKey(rng, RsaKeyBits)
-	CheckError(err)
+	var signer crypto.Signer
+	switch alg {
+	case AlgEd25519:
+		_, key, err := ed25519.GenerateKey(rng)
+		CheckError(err)
+		signer = key
+	case AlgRSA:
+		key, err := rsa.GenerateKey(rng, RsaKeyBits)
+		CheckError(err)
+		signer = key
+	default:
+		log.Fatalf("Cannot create key for algorithm '%v'", alg)
+	}
 
-	privkey := PrivateKey{key}
-	pubkey := PublicKey{&key.PublicKey}
+	privkey := PrivateKey{signer}
+	pubkey := PublicKey{signer.Public()}
 	return &privkey, &pubkey
 }
 
-// LoadPrivateKey loads the PEM encoded private key with the given filename
+// ParseAlgorithm converts a string into an Algorithm usable for new keys
+func ParseAlgorithm(str string) (Algorithm, error) {
+	switch Algorithm(str) {
+	case AlgEd25519, AlgRSA:
+		return Algorithm(str), nil
+	}
+	return "", errors.New("unsupported algorithm '" + str + "'")
+}
+
+// NewKeyring constructs an empty Keyring
+func NewKeyring() *Keyring {
+	return &Keyring{
+		K: make(map[string]*PrivateKey),
+	}
+}
+
+// LoadPrivateKey loads and decrypts with the passphrase the PEM encoded
+// private key with the given filename. Unencrypted legacy keys are loaded as is
 // It returns a *PrivateKey
-func LoadPrivateKey(fileName string) *PrivateKey {
+func LoadPrivateKey(fileName string, passphrase []byte) (*PrivateKey, error) {
 	k, err := ioutil.ReadFile(KeyFolder + fileName)
-	CheckError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	block, _ := pem.Decode(k)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		log.Fatal("Failed to decode PEM block containing private key")
+	if block != nil && block.Type == encryptedPrivateKeyPEMType {
+		der, err := decryptBlock(block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		k = pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: der})
 	}
 
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	CheckError(err)
+	return decodePrivateKey(k)
+}
+
+// LoadOrCreateIdentity loads the Ed25519 identity key of a node stored
+// unencrypted at path (the node needs it unattended), creating it if needed
+func LoadOrCreateIdentity(path string) (*PrivateKey, error) {
+	k, err := ioutil.ReadFile(path)
+	if err == nil {
+		key, err := decodePrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if key.Algorithm() != AlgEd25519 {
+			return nil, errors.New("node identity has to be an Ed25519 key")
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, _ := CreateKey(AlgEd25519)
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(key.pem()), KeyFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// PrivateKeyEncrypted checks if the private key with the given filename is
+// stored encrypted on disk
+func PrivateKeyEncrypted(fileName string) bool {
+	k, err := ioutil.ReadFile(KeyFolder + fileName)
+	if err != nil {
+		return false
+	}
 
-	return &PrivateKey{key}
+	block, _ := pem.Decode(k)
+	return block != nil && block.Type == encryptedPrivateKeyPEMType
 }
 
 // LoadPublicKey loads the PEM encoded public key with the given filename
@@ -76,18 +215,10 @@ func LoadPublicKey(fileName string) *PublicKey {
 	k, err := ioutil.ReadFile(KeyFolder + fileName)
 	CheckError(err)
 
-	block, _ := pem.Decode(k)
-	if block == nil || block.Type != "RSA PUBLIC KEY" {
-		log.Fatal("Failed to decode PEM block containing public key")
-	}
-
-	general_key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	key, err := decodePublicKey(k)
 	CheckError(err)
-	key, ok := general_key.(*rsa.PublicKey)
-	if !ok {
-		log.Fatal("Failed to load public key")
-	}
-	return &PublicKey{key}
+
+	return key
 }
 
 // StringToPublicKey converts an hex-encoded PEM public key into a PublicKey
@@ -95,69 +226,269 @@ func StringToPublicKey(str string) *PublicKey {
 	pemdata, err := hex.DecodeString(str)
 	CheckError(err)
 
-	block, _ := pem.Decode(pemdata)
-	if block == nil || block.Type != "RSA PUBLIC KEY" {
-		log.Fatal("Failed to decode public key as string")
-	}
-	general_key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	key, err := decodePublicKey(pemdata)
 	CheckError(err)
-	key, ok := general_key.(*rsa.PublicKey)
-	if !ok {
-		log.Fatal("Failed to cast into PublicKey")
-	}
 
-	return &PublicKey{key}
+	return key
 }
 
-// StringToPublicKey converts an hex-encoded PEM private key into a PrivateKey
+// StringToPrivateKey converts an hex-encoded PEM private key into a PrivateKey
 func StringToPrivateKey(str string) *PrivateKey {
 	pemdata, err := hex.DecodeString(str)
 	CheckError(err)
 
+	key, err := decodePrivateKey(pemdata)
+	CheckError(err)
+
+	return key
+}
+
+// decodePublicKey parses a PEM encoded public key, legacy RSA blocks included
+func decodePublicKey(pemdata []byte) (*PublicKey, error) {
 	block, _ := pem.Decode(pemdata)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		log.Fatal("Failed to decode public key as string")
+	if block == nil || (block.Type != publicKeyPEMType && block.Type != legacyPublicKeyPEMType) {
+		return nil, errors.New("failed to decode PEM block containing public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case ed25519.PublicKey, *rsa.PublicKey:
+		return &PublicKey{key}, nil
+	}
+	return nil, errors.New("unsupported public key type")
+}
+
+// decodePrivateKey parses a PEM encoded private key, legacy RSA blocks included
+func decodePrivateKey(pemdata []byte) (*PrivateKey, error) {
+	block, _ := pem.Decode(pemdata)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing private key")
 	}
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	CheckError(err)
 
-	return &PrivateKey{key}
+	switch block.Type {
+	case legacyPrivateKeyPEMType:
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &PrivateKey{key}, nil
+
+	case privateKeyPEMType:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case ed25519.PrivateKey:
+			return &PrivateKey{k}, nil
+		case *rsa.PrivateKey:
+			return &PrivateKey{k}, nil
+		}
+		return nil, errors.New("unsupported private key type")
+	}
+	return nil, errors.New("failed to decode PEM block containing private key")
 }
 
 // PrivateKey
 
+// pem returns the PEM block of the PrivateKey (PKCS#8)
+func (key *PrivateKey) pem() *pem.Block {
+	k, err := x509.MarshalPKCS8PrivateKey(key.key)
+	CheckError(err)
+
+	return &pem.Block{
+		Type:  privateKeyPEMType,
+		Bytes: k,
+	}
+}
+
 // String returns a string representation of the PrivateKey
 func (key *PrivateKey) String() string {
-	pemdata := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key.PrivateKey),
-		},
-	)
+	pemdata := pem.EncodeToMemory(key.pem())
 	return hex.EncodeToString(pemdata)
 }
 
-// Save stores the private in a PEM format onto the disk
-func (key *PrivateKey) Save(fileName string) {
-	outFile, err := os.Create(KeyFolder + fileName)
-	CheckError(err)
+// Save encrypts the private key with a key derived from the passphrase and
+// stores it in a PEM format onto the disk, readable only by the user
+func (key *PrivateKey) Save(fileName string, passphrase []byte) error {
+	block, err := encryptBlock(encryptedPrivateKeyPEMType, key.pem().Bytes, passphrase)
+	if err != nil {
+		return err
+	}
 
-	pem.Encode(
-		outFile,
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key.PrivateKey),
-		},
-	)
+	path := KeyFolder + fileName
+	outFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, KeyFilePerm)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	// the file may have been created with wider permissions before
+	err = os.Chmod(path, KeyFilePerm)
+	if err != nil {
+		return err
+	}
+
+	return pem.Encode(outFile, block)
+}
+
+// EncryptPEM encrypts data with a passphrase into a PEM block of the given type
+func EncryptPEM(pemType string, data, passphrase []byte) ([]byte, error) {
+	block, err := encryptBlock(pemType, data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// DecryptPEM decrypts a PEM block of the given type encrypted by EncryptPEM
+func DecryptPEM(pemType string, pemdata, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(pemdata)
+	if block == nil || block.Type != pemType {
+		return nil, errors.New("failed to decode PEM block of type " + pemType)
+	}
+	return decryptBlock(block, passphrase)
+}
+
+// encryptBlock encrypts data into a PEM block with AES-256-GCM using a scrypt
+// derived key, the parameters of the derivation being stored in the headers
+func encryptBlock(pemType string, data, passphrase []byte) (*pem.Block, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{
+		"Kdf":   "scrypt",
+		"Kdf-N": strconv.Itoa(ScryptN),
+		"Kdf-R": strconv.Itoa(ScryptR),
+		"Kdf-P": strconv.Itoa(ScryptP),
+		"Salt":  hex.EncodeToString(salt),
+	}
+
+	aead, err := newBlockAEAD(headers, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	headers["Nonce"] = hex.EncodeToString(nonce)
+
+	return &pem.Block{
+		Type:    pemType,
+		Headers: headers,
+		Bytes:   aead.Seal(nil, nonce, data, []byte(pemType)),
+	}, nil
+}
+
+// decryptBlock decrypts a PEM block encrypted by encryptBlock
+func decryptBlock(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if block.Headers["Kdf"] != "scrypt" {
+		return nil, errors.New("unsupported key derivation function")
+	}
+
+	aead, err := newBlockAEAD(block.Headers, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce in encrypted key")
+	}
+
+	der, err := aead.Open(nil, nonce, block.Bytes, []byte(block.Type))
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return der, nil
+}
+
+// newBlockAEAD derives the AES-256-GCM cipher of an encrypted PEM block
+func newBlockAEAD(headers map[string]string, passphrase []byte) (cipher.AEAD, error) {
+	N, errN := strconv.Atoi(headers["Kdf-N"])
+	r, errR := strconv.Atoi(headers["Kdf-R"])
+	p, errP := strconv.Atoi(headers["Kdf-P"])
+	salt, errS := hex.DecodeString(headers["Salt"])
+	if errN != nil || errR != nil || errP != nil || errS != nil {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+	// encrypted blocks may come from other machines, bound the memory
+	// (128*N*r bytes) and the work asked
+	if r < 1 || r > maxScryptMemory/128 || p < 1 || p > maxScryptP || N > maxScryptMemory/128/r {
+		return nil, errors.New("key derivation parameters too expensive")
+	}
+
+	derived, err := scrypt.Key(passphrase, salt, N, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+// MarshalText refuses to serialize the PrivateKey so that it never ends up
+// unencrypted in a JSON document, String has to be used explicitly
+func (key *PrivateKey) MarshalText() ([]byte, error) {
+	return nil, ErrPrivateKeyMarshal
+}
+
+// UnmarshalText deserializes a PrivateKey from its string representation
+func (key *PrivateKey) UnmarshalText(text []byte) error {
+	pemdata, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+
+	k, err := decodePrivateKey(pemdata)
+	if err != nil {
+		return err
+	}
+
+	key.key = k.key
+	return nil
+}
+
+// Public returns the PublicKey matching the PrivateKey
+func (key *PrivateKey) Public() *PublicKey {
+	return &PublicKey{key.key.Public()}
+}
+
+// Algorithm returns the algorithm of the PrivateKey
+func (key *PrivateKey) Algorithm() Algorithm {
+	return key.Public().Algorithm()
 }
 
 // SignMessage signs a given message with the private key
 func (key *PrivateKey) SignMessage(msg []byte) string {
-	rng := rand.Reader
-	hashed := sha256.Sum256(msg)
-
-	signature, err := rsa.SignPKCS1v15(rng, key.PrivateKey, crypto.SHA256, hashed[:])
-	CheckError(err)
+	var signature []byte
+	var err error
+
+	switch k := key.key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, msg)
+	case *rsa.PrivateKey:
+		hashed := sha256.Sum256(msg)
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hashed[:])
+		CheckError(err)
+	}
 
 	signature_str := hex.EncodeToString(signature)
 	return signature_str
@@ -165,40 +496,189 @@ func (key *PrivateKey) SignMessage(msg []byte) string {
 
 // PublicKey
 
+// Algorithm returns the algorithm of the PublicKey, RSA keys smaller than
+// MinRsaKeyBits being reported as AlgLegacyRSA
+func (key *PublicKey) Algorithm() Algorithm {
+	switch k := key.key.(type) {
+	case ed25519.PublicKey:
+		return AlgEd25519
+	case *rsa.PublicKey:
+		if k.N.BitLen() < MinRsaKeyBits {
+			return AlgLegacyRSA
+		}
+		return AlgRSA
+	}
+	return ""
+}
+
 // String returns a string representation of the PublicKey
 func (key *PublicKey) String() string {
-	k, err := x509.MarshalPKIXPublicKey(key.PublicKey)
+	k, err := x509.MarshalPKIXPublicKey(key.key)
 	CheckError(err)
 	pemdata := pem.EncodeToMemory(
 		&pem.Block{
-			Type:  "RSA PUBLIC KEY",
+			Type:  publicKeyPEMType,
 			Bytes: k,
 		},
 	)
 	return hex.EncodeToString(pemdata)
 }
 
+// ID returns the short identifier of the PublicKey: the hex encoded key for
+// Ed25519 keys, the hex encoded SHA256 of the DER encoded key otherwise
+func (key *PublicKey) ID() string {
+	if k, ok := key.key.(ed25519.PublicKey); ok {
+		return hex.EncodeToString(k)
+	}
+	k, err := x509.MarshalPKIXPublicKey(key.key)
+	CheckError(err)
+	sum := sha256.Sum256(k)
+	return hex.EncodeToString(sum[:])
+}
+
 // Save stores the public key in PEM format onto disk
 func (key *PublicKey) Save(fileName string) {
-	k, err := x509.MarshalPKIXPublicKey(key.PublicKey)
+	k, err := x509.MarshalPKIXPublicKey(key.key)
 	CheckError(err)
 
 	outFile, err := os.Create(KeyFolder + fileName)
 	CheckError(err)
+	defer outFile.Close()
 
 	pem.Encode(
 		outFile,
 		&pem.Block{
-			Type:  "RSA PUBLIC KEY",
+			Type:  publicKeyPEMType,
 			Bytes: k,
 		},
 	)
 }
 
+// MarshalText serializes the PublicKey as its string representation
+func (key *PublicKey) MarshalText() ([]byte, error) {
+	return []byte(key.String()), nil
+}
+
+// UnmarshalText deserializes a PublicKey from its string representation
+func (key *PublicKey) UnmarshalText(text []byte) error {
+	pemdata, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+
+	k, err := decodePublicKey(pemdata)
+	if err != nil {
+		return err
+	}
+
+	key.key = k.key
+	return nil
+}
+
+// GobEncode serializes the PublicKey for the gob messages
+func (key *PublicKey) GobEncode() ([]byte, error) {
+	return key.MarshalText()
+}
+
+// GobDecode deserializes a PublicKey from a gob message
+func (key *PublicKey) GobDecode(data []byte) error {
+	return key.UnmarshalText(data)
+}
+
+// UnmarshalJSON deserializes a PublicKey from JSON, also accepting the
+// {"N":...,"E":...} objects of the metadata written before algorithm agility
+func (key *PublicKey) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		return key.UnmarshalText([]byte(str))
+	}
+
+	var legacy struct {
+		N *big.Int
+		E int
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	if legacy.N == nil {
+		return errors.New("invalid legacy RSA public key")
+	}
+
+	key.key = &rsa.PublicKey{N: legacy.N, E: legacy.E}
+	return nil
+}
+
 // VerifySignature verifies a signature with the given message and public key
 func (key *PublicKey) VerifySignature(msg []byte, signature_str string) bool {
-	hashed := sha256.Sum256(msg)
-	signature, _ := hex.DecodeString(signature_str)
-	err := rsa.VerifyPKCS1v15(key.PublicKey, crypto.SHA256, hashed[:], signature)
-	return (err == nil)
+	signature, err := hex.DecodeString(signature_str)
+	if err != nil {
+		return false
+	}
+
+	switch k := key.key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, msg, signature)
+	case *rsa.PublicKey:
+		hashed := sha256.Sum256(msg)
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed[:], signature)
+		return (err == nil)
+	}
+	return false
+}
+
+// VerifyAlgorithm checks that the PublicKey matches the algorithm recorded for
+// it and verifies the signature accordingly
+func (key *PublicKey) VerifyAlgorithm(alg Algorithm, msg []byte, signature_str string) bool {
+	if key.Algorithm() != alg {
+		return false
+	}
+	return key.VerifySignature(msg, signature_str)
+}
+
+// Keyring
+
+// Unlock decrypts the private key with the given filename and keeps it in
+// the Keyring if check accepts its public key. Unencrypted legacy keys are
+// then encrypted with the passphrase, a rejected key file being left as is
+func (kr *Keyring) Unlock(fileName string, passphrase []byte, check func(*PublicKey) error) error {
+	key, err := LoadPrivateKey(fileName, passphrase)
+	if err != nil {
+		return err
+	}
+
+	err = check(key.Public())
+	if err != nil {
+		return err
+	}
+
+	if !PrivateKeyEncrypted(fileName) {
+		err = key.Save(fileName, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+
+	kr.Set(fileName, key)
+	return nil
+}
+
+// Lock removes the unlocked private key from the Keyring
+func (kr *Keyring) Lock(fileName string) {
+	kr.mux.Lock()
+	defer kr.mux.Unlock()
+	delete(kr.K, fileName)
+}
+
+// Set stores an unlocked private key in the Keyring
+func (kr *Keyring) Set(fileName string, key *PrivateKey) {
+	kr.mux.Lock()
+	defer kr.mux.Unlock()
+	kr.K[fileName] = key
+}
+
+// Get returns the unlocked private key or nil if it is locked
+func (kr *Keyring) Get(fileName string) *PrivateKey {
+	kr.mux.RLock()
+	defer kr.mux.RUnlock()
+	return kr.K[fileName]
 }
@@ -0,0 +1,317 @@
+package w2pcrypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// -----------
+// - Helpers -
+// -----------
+
+// useTempKeyFolder points the KeyFolder to a temporary folder for the
+// duration of the test
+func useTempKeyFolder(t *testing.T) {
+	t.Helper()
+	keyFolder := KeyFolder
+	t.Cleanup(func() { KeyFolder = keyFolder })
+	KeyFolder = t.TempDir() + "/"
+}
+
+// createLegacyKey writes an unencrypted 1024-bit RSA key as published before
+// algorithm agility, and returns it
+func createLegacyKey(t *testing.T, fileName string) *PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemdata := pem.EncodeToMemory(&pem.Block{
+		Type:  legacyPrivateKeyPEMType,
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	if err := ioutil.WriteFile(KeyFolder+fileName, pemdata, KeyFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	return &PrivateKey{key}
+}
+
+// keys are created once as RSA keys are slow to generate
+var testKeys = map[Algorithm]*PrivateKey{}
+
+// testKey returns a key of the given algorithm
+func testKey(alg Algorithm) *PrivateKey {
+	if testKeys[alg] == nil {
+		testKeys[alg], _ = CreateKey(alg)
+	}
+	return testKeys[alg]
+}
+
+// ---------
+// - Tests -
+// ---------
+
+func TestKeyRoundTrip(t *testing.T) {
+	for _, alg := range []Algorithm{AlgEd25519, AlgRSA} {
+		t.Run(string(alg), func(t *testing.T) {
+			useTempKeyFolder(t)
+			privKey := testKey(alg)
+			pubKey := privKey.Public()
+			msg := []byte("w2p message")
+
+			if privKey.Algorithm() != alg || pubKey.Algorithm() != alg {
+				t.Fatalf("algorithm = %v, want %v", pubKey.Algorithm(), alg)
+			}
+
+			signature := privKey.SignMessage(msg)
+			if !pubKey.VerifyAlgorithm(alg, msg, signature) {
+				t.Error("signature does not verify")
+			}
+			if pubKey.VerifySignature([]byte("other message"), signature) {
+				t.Error("signature verifies another message")
+			}
+			if pubKey.VerifyAlgorithm(AlgLegacyRSA, msg, signature) {
+				t.Error("signature verifies with another algorithm")
+			}
+			other, _ := CreateKey(AlgEd25519)
+			if other.Public().VerifySignature(msg, signature) {
+				t.Error("signature verifies with another key")
+			}
+
+			// text, JSON and gob encodings of the public key
+			if StringToPublicKey(pubKey.String()).String() != pubKey.String() {
+				t.Error("public key changed by its string representation")
+			}
+			data, err := json.Marshal(pubKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := &PublicKey{}
+			if err := json.Unmarshal(data, decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.ID() != pubKey.ID() {
+				t.Error("public key changed by JSON")
+			}
+			b := bytes.Buffer{}
+			if err := gob.NewEncoder(&b).Encode(pubKey); err != nil {
+				t.Fatal(err)
+			}
+			decoded = &PublicKey{}
+			if err := gob.NewDecoder(&b).Decode(decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.ID() != pubKey.ID() {
+				t.Error("public key changed by gob")
+			}
+
+			// private key stored encrypted on disk
+			if err := privKey.Save("site", []byte("secret")); err != nil {
+				t.Fatal(err)
+			}
+			if !PrivateKeyEncrypted("site") {
+				t.Error("private key stored unencrypted")
+			}
+			loaded, err := LoadPrivateKey("site", []byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pubKey.VerifyAlgorithm(alg, msg, loaded.SignMessage(msg)) {
+				t.Error("loaded private key does not match")
+			}
+		})
+	}
+}
+
+func TestLoadPrivateKeyPassphrase(t *testing.T) {
+	useTempKeyFolder(t)
+	privKey := testKey(AlgEd25519)
+	if err := privKey.Save("site", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		passphrase string
+		err        error
+	}{
+		{"right passphrase", "secret", nil},
+		{"wrong passphrase", "guess", ErrBadPassphrase},
+		{"empty passphrase", "", ErrBadPassphrase},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadPrivateKey("site", []byte(test.passphrase))
+			if err != test.err {
+				t.Errorf("LoadPrivateKey() error = %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	if err := privKey.Save("other", nil); err != ErrEmptyPassphrase {
+		t.Errorf("Save() error = %v, want %v", err, ErrEmptyPassphrase)
+	}
+}
+
+func TestLegacyKey(t *testing.T) {
+	useTempKeyFolder(t)
+	legacy := createLegacyKey(t, "site")
+	msg := []byte("w2p message")
+
+	if legacy.Public().Algorithm() != AlgLegacyRSA {
+		t.Errorf("algorithm = %v, want %v", legacy.Public().Algorithm(), AlgLegacyRSA)
+	}
+	if !legacy.Public().VerifyAlgorithm(AlgLegacyRSA, msg, legacy.SignMessage(msg)) {
+		t.Error("legacy signature does not verify")
+	}
+
+	// metadata written before algorithm agility
+	rsaKey := legacy.key.(*rsa.PrivateKey)
+	data, err := json.Marshal(struct {
+		N interface{}
+		E int
+	}{rsaKey.N, rsaKey.E})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := &PublicKey{}
+	if err := json.Unmarshal(data, pubKey); err != nil {
+		t.Fatal(err)
+	}
+	if pubKey.String() != legacy.Public().String() {
+		t.Error("legacy JSON public key does not match")
+	}
+}
+
+func TestPublicKeyID(t *testing.T) {
+	for _, alg := range []Algorithm{AlgEd25519, AlgRSA} {
+		t.Run(string(alg), func(t *testing.T) {
+			privKey, _ := CreateKey(alg)
+			other, _ := CreateKey(alg)
+
+			// the ID is the same once the key is sent to another node
+			decoded := &PublicKey{}
+			if err := decoded.UnmarshalText([]byte(privKey.Public().String())); err != nil {
+				t.Fatal(err)
+			}
+			id := privKey.Public().ID()
+			if len(id) != 64 || decoded.ID() != id {
+				t.Errorf("ID() = %v, decoded %v", id, decoded.ID())
+			}
+			if other.Public().ID() == id {
+				t.Error("two keys with the same ID")
+			}
+		})
+	}
+}
+
+func TestPrivateKeyNotMarshaled(t *testing.T) {
+	privKey := testKey(AlgEd25519)
+
+	data, err := json.Marshal(struct{ Key *PrivateKey }{privKey})
+	if !errors.Is(err, ErrPrivateKeyMarshal) {
+		t.Errorf("json.Marshal() error = %v, want %v", err, ErrPrivateKeyMarshal)
+	}
+	if strings.Contains(string(data), privKey.String()) {
+		t.Error("private key serialized in JSON")
+	}
+}
+
+func TestKeyringUnlock(t *testing.T) {
+	reject := errors.New("key does not match")
+	tests := []struct {
+		name      string
+		accept    bool
+		err       error
+		encrypted bool
+	}{
+		{"accepted legacy key", true, nil, true},
+		{"rejected legacy key", false, reject, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTempKeyFolder(t)
+			legacy := createLegacyKey(t, "site")
+			before, err := ioutil.ReadFile(KeyFolder + "site")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kr := NewKeyring()
+			err = kr.Unlock("site", []byte("secret"), func(pubKey *PublicKey) error {
+				if pubKey.String() != legacy.Public().String() {
+					t.Error("checked key does not match the key file")
+				}
+				if !test.accept {
+					return reject
+				}
+				return nil
+			})
+			if err != test.err {
+				t.Fatalf("Unlock() error = %v, want %v", err, test.err)
+			}
+
+			if got := PrivateKeyEncrypted("site"); got != test.encrypted {
+				t.Errorf("key file encrypted = %v, want %v", got, test.encrypted)
+			}
+			if !test.accept {
+				after, err := ioutil.ReadFile(KeyFolder + "site")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(before, after) {
+					t.Error("rejected key file was rewritten")
+				}
+				if kr.Get("site") != nil {
+					t.Error("rejected key kept in the keyring")
+				}
+			} else if kr.Get("site") == nil {
+				t.Error("accepted key not kept in the keyring")
+			}
+		})
+	}
+}
+
+func TestDecryptPEMBoundsWork(t *testing.T) {
+	data, err := EncryptPEM("TEST", []byte("data"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		N, r, p string
+	}{
+		{"N too large", "1073741824", "8", "1"},
+		{"4GiB of memory", "1048576", "32", "1"},
+		{"r too large", "32768", "1048576", "1"},
+		{"p too large", "32768", "8", "17"},
+		{"no r", "32768", "0", "1"},
+		{"no p", "32768", "8", "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block, _ := pem.Decode(data)
+			block.Headers["Kdf-N"], block.Headers["Kdf-R"], block.Headers["Kdf-P"] = test.N, test.r, test.p
+			_, err := DecryptPEM("TEST", pem.EncodeToMemory(block), []byte("secret"))
+			if err == nil {
+				t.Error("expensive key derivation parameters accepted")
+			}
+		})
+	}
+
+	plain, err := DecryptPEM("TEST", data, []byte("secret"))
+	if err != nil || string(plain) != "data" {
+		t.Errorf("DecryptPEM() = %q, %v", plain, err)
+	}
+}